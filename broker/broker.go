@@ -0,0 +1,82 @@
+package broker
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrClosed is returned when using a broker after it has been closed
+var ErrClosed = errors.New("broker is closed")
+
+// State of the connection between a broker and its server
+type State string
+
+const (
+	StateConnected    State = "connected"
+	StateReconnecting State = "reconnecting"
+	StateClosed       State = "closed"
+)
+
+// Topics received by every instance. Every other message is
+// published with the ID of its room as the topic.
+const (
+	// PresenceTopic carries presence changes
+	PresenceTopic = "presence"
+	// RoomJoinTopic carries the users joining a room, whichever instance they joined through
+	RoomJoinTopic = "room_join"
+)
+
+// Message is a message received from the broker. It must be acknowledged
+// once processed, or it is delivered again.
+type Message struct {
+	Topic string
+	Body  []byte
+	// Redelivered is set when the message failed to be processed before
+	Redelivered bool
+	// Acknowledger settles the delivery, nil when the broker does not track deliveries
+	Acknowledger Acknowledger
+}
+
+// Acknowledger settles the delivery of a message with the broker
+type Acknowledger interface {
+	Ack() error
+	// Nack rejects the message, it is delivered again when requeue is set
+	// and dead-lettered otherwise
+	Nack(requeue bool) error
+}
+
+// Ack confirms that the message has been processed
+func (m Message) Ack() error {
+	if m.Acknowledger == nil {
+		return nil
+	}
+
+	return m.Acknowledger.Ack()
+}
+
+// Nack rejects the message. A message failing for the first time is delivered
+// again, a message failing repeatedly is dead-lettered.
+func (m Message) Nack() error {
+	if m.Acknowledger == nil {
+		return nil
+	}
+
+	return m.Acknowledger.Nack(!m.Redelivered)
+}
+
+// Broker fans messages out between the server instances. Each instance only
+// receives the messages of the topics it subscribed to.
+type Broker interface {
+	// Publish sends the message to every instance subscribed to the topic.
+	// It returns once the broker confirmed that it took over the message.
+	Publish(ctx context.Context, topic string, body []byte) error
+	// Subscribe starts routing the messages of the topic to this instance
+	Subscribe(topic string) error
+	// Unsubscribe stops routing the messages of the topic to this instance
+	Unsubscribe(topic string) error
+	// Consume returns the messages of the subscribed topics, to be acknowledged once processed
+	Consume() (<-chan Message, error)
+	// State reports whether the broker is currently usable
+	State() State
+	Close() error
+}
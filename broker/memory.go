@@ -0,0 +1,143 @@
+package broker
+
+import (
+	"context"
+	"sync"
+)
+
+// Memory is an in-process broker for single instance deployments and tests.
+// Messages never leave the process. Brokers created with Connect share the
+// messages of their topics, like several instances sharing a broker.
+type Memory struct {
+	bus      *memoryBus
+	mu       sync.RWMutex
+	topics   map[string]bool
+	messages chan Message
+	closed   bool
+}
+
+// memoryBus routes the messages between the connected brokers
+type memoryBus struct {
+	mu      sync.RWMutex
+	brokers map[*Memory]bool
+}
+
+func NewMemory() *Memory {
+	return (&memoryBus{brokers: make(map[*Memory]bool)}).connect()
+}
+
+// Connect returns the broker of another instance, subscribed to no topic. The messages
+// published through any connected broker reach every broker subscribed to their topic.
+func (m *Memory) Connect() *Memory {
+	return m.bus.connect()
+}
+
+func (b *memoryBus) connect() *Memory {
+	m := &Memory{
+		bus:      b,
+		topics:   make(map[string]bool),
+		messages: make(chan Message, 1024),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.brokers[m] = true
+
+	return m
+}
+
+func (m *Memory) Publish(ctx context.Context, topic string, body []byte) error {
+	if m.State() == StateClosed {
+		return ErrClosed
+	}
+
+	m.bus.mu.RLock()
+	defer m.bus.mu.RUnlock()
+
+	for subscriber := range m.bus.brokers {
+		err := subscriber.deliver(ctx, Message{Topic: topic, Body: body})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deliver queues the message when the broker is subscribed to its topic
+func (m *Memory) deliver(ctx context.Context, message Message) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	// Like a broker routing to no queue, messages without subscription are dropped
+	if m.closed || !m.topics[message.Topic] {
+		return nil
+	}
+
+	select {
+	case m.messages <- message:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *Memory) Subscribe(topic string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+
+	m.topics[topic] = true
+
+	return nil
+}
+
+func (m *Memory) Unsubscribe(topic string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return ErrClosed
+	}
+
+	delete(m.topics, topic)
+
+	return nil
+}
+
+func (m *Memory) Consume() (<-chan Message, error) {
+	return m.messages, nil
+}
+
+func (m *Memory) State() State {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.closed {
+		return StateClosed
+	}
+
+	return StateConnected
+}
+
+// Close stops the broker and ends the message channel returned by Consume
+func (m *Memory) Close() error {
+	m.bus.mu.Lock()
+	delete(m.bus.brokers, m)
+	m.bus.mu.Unlock()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil
+	}
+
+	m.closed = true
+	close(m.messages)
+
+	return nil
+}
@@ -1,12 +1,25 @@
 package controller
 
 import (
+	"chat-server/broker"
 	"github.com/labstack/echo/v4"
 	"net/http"
 )
 
-func Health(c echo.Context) error {
-	return c.JSON(http.StatusOK, echo.Map{
-		"status": "Server is up and running!",
-	})
+// Health reports the server as unavailable while the message broker is not connected
+func Health(messageBroker broker.Broker) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		brokerState := messageBroker.State()
+		if brokerState != broker.StateConnected {
+			return c.JSON(http.StatusServiceUnavailable, echo.Map{
+				"status": "Message broker is unavailable",
+				"broker": brokerState,
+			})
+		}
+
+		return c.JSON(http.StatusOK, echo.Map{
+			"status": "Server is up and running!",
+			"broker": brokerState,
+		})
+	}
 }
@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"chat-server/broker"
+	"encoding/json"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// stateBroker reports a fixed connection state
+type stateBroker struct {
+	broker.Broker
+	state broker.State
+}
+
+func (b stateBroker) State() broker.State {
+	return b.state
+}
+
+func TestHealth(t *testing.T) {
+	tests := []struct {
+		state broker.State
+		code  int
+	}{
+		{broker.StateConnected, http.StatusOK},
+		{broker.StateReconnecting, http.StatusServiceUnavailable},
+		{broker.StateClosed, http.StatusServiceUnavailable},
+	}
+
+	for _, test := range tests {
+		t.Run(string(test.state), func(t *testing.T) {
+			e := echo.New()
+			e.GET("/health", Health(stateBroker{state: test.state}))
+
+			recorder := httptest.NewRecorder()
+			e.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+			var body struct {
+				Broker broker.State `json:"broker"`
+			}
+			err := json.Unmarshal(recorder.Body.Bytes(), &body)
+			if err != nil {
+				t.Fatalf("invalid response %s: %v", recorder.Body, err)
+			}
+
+			if recorder.Code != test.code || body.Broker != test.state {
+				t.Errorf("GET /health = %d, broker %s; want %d, broker %s", recorder.Code, body.Broker, test.code, test.state)
+			}
+		})
+	}
+}
@@ -8,46 +8,38 @@ import (
 	"context"
 	"fmt"
 	"github.com/labstack/echo/v4"
-	"go.mongodb.org/mongo-driver/bson"
 	"net/http"
 	"time"
 )
 
-func Login(c echo.Context) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	loginData := new(dto.UserLogin)
-	if err := c.Bind(loginData); err != nil {
-		return err
-	}
-
-	userRepository := repository.NewUser()
-
-	filter := bson.M{"username": loginData.Username}
-	userModel, err := userRepository.FindOne(ctx, filter)
-	if err != nil {
-		unAuthorizeErr := echo.ErrUnauthorized
-		unAuthorizeErr.Message = "invalid username/password"
-
-		return unAuthorizeErr
+func Login(store *repository.Store) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		loginData := new(dto.UserLogin)
+		if err := c.Bind(loginData); err != nil {
+			return err
+		}
+
+		userModel, err := store.Users.FindUserByUsername(ctx, loginData.Username)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusUnauthorized, "invalid username/password")
+		}
+
+		isValidPassword := password.Verify(loginData.Password, userModel.Password)
+		if !isValidPassword {
+			return echo.NewHTTPError(http.StatusUnauthorized, "invalid username/password")
+		}
+
+		authToken, err := auth.GenToken(userModel)
+		if err != nil {
+			return fmt.Errorf("failed to generate auth token: %w", err)
+		}
+
+		return c.JSON(http.StatusOK, echo.Map{
+			"data":  dto.ToUserDto(userModel),
+			"token": authToken,
+		})
 	}
-
-	isValidPassword := password.Verify(loginData.Password, (*userModel).Password)
-	if !isValidPassword {
-		unAuthorizeErr := echo.ErrUnauthorized
-		unAuthorizeErr.Message = "invalid username/password"
-
-		return unAuthorizeErr
-	}
-
-	authToken, err := auth.GenToken(*userModel)
-	if err != nil {
-		return fmt.Errorf("failed to generate auth token: %w", err)
-	}
-
-	return c.JSON(http.StatusOK, echo.Map{
-		"data":  dto.ToUserDto(*userModel),
-		"token": authToken,
-	})
 }
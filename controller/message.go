@@ -6,52 +6,154 @@ import (
 	"context"
 	"fmt"
 	"github.com/labstack/echo/v4"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"log"
 	"net/http"
-	"strconv"
 	"time"
 )
 
-func GetMessages(c echo.Context) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+func GetMessages(store *repository.Store) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
 
-	pageString := c.QueryParam("page")
-	limitString := c.QueryParam("limit")
+		roomId := c.QueryParam("roomId")
 
-	roomId := c.QueryParam("roomId")
-
-	page, err := strconv.Atoi(pageString)
-	if err != nil {
-		page = 1
-	}
+		// Oldest messages first by default
+		page, err := parsePage(c, messageSortFields, repository.Sort{Field: "timestamp"})
+		if err != nil {
+			return err
+		}
 
-	limit, err := strconv.Atoi(limitString)
-	if err != nil {
-		limit = 10
-	}
+		var roomObjectID primitive.ObjectID
+		if len(roomId) > 0 {
+			roomObjectID, err = primitive.ObjectIDFromHex(roomId)
+			if err != nil {
+				return fmt.Errorf("invalid channel id received: %w", err)
+			}
+		}
 
-	filter := bson.M{}
-	if len(roomId) > 0 {
-		objectID, err := primitive.ObjectIDFromHex(roomId)
+		total, err := store.Messages.CountMessages(ctx, roomObjectID)
 		if err != nil {
-			return fmt.Errorf("invalid channel id received: %w", err)
+			return err
+		}
+
+		// Cursors page from a message, page and limit are kept for older clients
+		before := c.QueryParam("before")
+		after := c.QueryParam("after")
+		if before != "" && after != "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "only one of 'before' and 'after' can be given")
 		}
 
-		filter = bson.M{"room_id": objectID}
+		var response echo.Map
+		var messages []*repository.MessageModel
+		var prevCursor, nextCursor *string
+		switch {
+		case before != "":
+			var timestamp time.Time
+			var beforeId primitive.ObjectID
+			if before != LatestCursor {
+				timestamp, beforeId, err = dto.ParseMessageCursor(before)
+				if err != nil {
+					log.Println(err)
+					return echo.NewHTTPError(http.StatusBadRequest, "invalid 'before' cursor received")
+				}
+			}
+
+			// One more message tells whether older messages remain
+			messages, err = store.Messages.FindBefore(ctx, roomObjectID, timestamp, beforeId, page.Limit+1)
+			if err != nil {
+				return err
+			}
+
+			hasOlder := len(messages) > page.Limit
+			if hasOlder {
+				messages = messages[1:]
+			}
+
+			prevCursor = firstCursor(messages, hasOlder)
+			nextCursor = lastCursor(messages, before != LatestCursor)
+			response = cursorPaginated(dto.ToMessageListDto(messages), page, total, hasOlder)
+		case after != "":
+			timestamp, afterId, err := dto.ParseMessageCursor(after)
+			if err != nil {
+				log.Println(err)
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid 'after' cursor received")
+			}
+
+			// One more message tells whether newer messages remain
+			messages, err = store.Messages.FindAfter(ctx, roomObjectID, timestamp, afterId, page.Limit+1)
+			if err != nil {
+				return err
+			}
+
+			hasNewer := len(messages) > page.Limit
+			if hasNewer {
+				messages = messages[:page.Limit]
+			}
+
+			prevCursor = firstCursor(messages, true)
+			nextCursor = lastCursor(messages, hasNewer)
+			response = cursorPaginated(dto.ToMessageListDto(messages), page, total, hasNewer)
+		default:
+			messages, err = store.Messages.FindMessages(ctx, roomObjectID, page)
+			if err != nil {
+				log.Println("no room exist")
+
+				return echo.ErrNotFound
+			}
+
+			hasMore := int64(page.Skip()+len(messages)) < total
+			prevCursor = firstCursor(messages, page.Number > 1)
+			nextCursor = lastCursor(messages, hasMore)
+			// Cursors follow the history, which is only in order when sorted oldest first
+			if page.Sort.Descending {
+				prevCursor, nextCursor = nil, nil
+			}
+			response = paginated(dto.ToMessageListDto(messages), page, total)
+		}
+
+		response["prevCursor"] = prevCursor
+		response["nextCursor"] = nextCursor
+
+		return c.JSON(http.StatusOK, response)
+	}
+}
+
+// cursorPaginated is the response listing the messages next to a cursor, hasMore
+// tells whether more messages follow in the direction of the cursor
+func cursorPaginated(data any, page repository.Page, total int64, hasMore bool) echo.Map {
+	response := paginated(data, page, total)
+	// Pages do not apply
+	delete(response, "page")
+	response["hasMore"] = hasMore
+
+	return response
+}
+
+// LatestCursor is passed as 'before' to get the newest messages
+const LatestCursor = "latest"
+
+// firstCursor returns the position to pass as 'before' to get the older messages,
+// nil when there are none
+func firstCursor(messages []*repository.MessageModel, hasOlder bool) *string {
+	if !hasOlder || len(messages) == 0 {
+		return nil
 	}
 
-	messageRepository := repository.NewMessage()
-	messages, err := messageRepository.Find(ctx, filter, page, limit, "")
-	if err != nil {
-		log.Println("no room exist")
+	cursor := dto.ToMessageCursor(messages[0])
 
-		return echo.ErrNotFound
+	return &cursor
+}
+
+// lastCursor returns the position to pass as 'after' to get the newer messages,
+// nil when there are none
+func lastCursor(messages []*repository.MessageModel, hasNewer bool) *string {
+	if !hasNewer || len(messages) == 0 {
+		return nil
 	}
 
-	return c.JSON(http.StatusOK, echo.Map{
-		"data": dto.ToMessageListDto(messages),
-	})
+	cursor := dto.ToMessageCursor(messages[len(messages)-1])
+
+	return &cursor
 }
@@ -0,0 +1,192 @@
+package controller
+
+import (
+	"chat-server/dto"
+	"chat-server/repository"
+	"chat-server/repository/memory"
+	"chat-server/repository/storetest"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"testing"
+	"time"
+)
+
+type messagePage struct {
+	Data       []dto.Message `json:"data"`
+	Page       *int          `json:"page"`
+	HasMore    bool          `json:"hasMore"`
+	PrevCursor *string       `json:"prevCursor"`
+	NextCursor *string       `json:"nextCursor"`
+}
+
+// getMessages requests the messages with the query params and returns the status and page
+func getMessages(t *testing.T, store *repository.Store, query url.Values) (int, messagePage) {
+	t.Helper()
+
+	e := echo.New()
+	e.GET("/messages", GetMessages(store))
+
+	recorder := httptest.NewRecorder()
+	e.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/messages?"+query.Encode(), nil))
+
+	var page messagePage
+	if recorder.Code == http.StatusOK {
+		err := json.Unmarshal(recorder.Body.Bytes(), &page)
+		if err != nil {
+			t.Fatalf("invalid response %s: %v", recorder.Body, err)
+		}
+	}
+
+	return recorder.Code, page
+}
+
+// expectPage requests a page of messages and checks their contents and cursors
+func expectPage(t *testing.T, store *repository.Store, query url.Values, contents []string, hasPrev, hasNext bool) messagePage {
+	t.Helper()
+
+	code, page := getMessages(t, store, query)
+	if code != http.StatusOK {
+		t.Fatalf("GET /messages?%s = %d; want %d", query.Encode(), code, http.StatusOK)
+	}
+
+	var got []string
+	for _, message := range page.Data {
+		got = append(got, message.Content)
+	}
+	if !slices.Equal(got, contents) {
+		t.Errorf("GET /messages?%s = %v; want %v", query.Encode(), got, contents)
+	}
+	if (page.PrevCursor != nil) != hasPrev || (page.NextCursor != nil) != hasNext {
+		t.Errorf("GET /messages?%s cursors = %v, %v; want previous %v, next %v", query.Encode(), page.PrevCursor, page.NextCursor, hasPrev, hasNext)
+	}
+
+	return page
+}
+
+func cursorQuery(roomID primitive.ObjectID, direction, cursor string, limit int) url.Values {
+	return url.Values{"roomId": {roomID.Hex()}, direction: {cursor}, "limit": {fmt.Sprint(limit)}}
+}
+
+// TestMessageCursors pages through the history of a room from the newest
+// messages to the oldest and back, cursors are null at both ends
+func TestMessageCursors(t *testing.T) {
+	store := memory.NewStore()
+	alice := storetest.CreateUser(t, store, "alice")
+	room := storetest.JoinGroup(t, store, alice, "general")
+	other := storetest.JoinGroup(t, store, alice, "other")
+
+	var messages []*repository.MessageModel
+	for i := 0; i < 5; i++ {
+		messages = append(messages, storetest.SendMessage(t, store, alice, room, fmt.Sprintf("m%d", i), ""))
+	}
+	storetest.SendMessage(t, store, alice, other, "elsewhere", "")
+
+	newest := expectPage(t, store, cursorQuery(room.ID, "before", LatestCursor, 2), []string{"m3", "m4"}, true, false)
+	if !newest.HasMore || newest.Page != nil {
+		t.Errorf("newest page has more %v, page %v; want more and no page", newest.HasMore, newest.Page)
+	}
+
+	middle := expectPage(t, store, cursorQuery(room.ID, "before", *newest.PrevCursor, 2), []string{"m1", "m2"}, true, true)
+	oldest := expectPage(t, store, cursorQuery(room.ID, "before", *middle.PrevCursor, 2), []string{"m0"}, false, true)
+	if oldest.HasMore {
+		t.Error("oldest page has more older messages")
+	}
+
+	newer := expectPage(t, store, cursorQuery(room.ID, "after", *oldest.NextCursor, 2), []string{"m1", "m2"}, true, true)
+	if !newer.HasMore {
+		t.Error("page before the newest messages has no more newer messages")
+	}
+
+	latest := expectPage(t, store, cursorQuery(room.ID, "after", *newer.NextCursor, 2), []string{"m3", "m4"}, true, false)
+	if latest.HasMore {
+		t.Error("newest page has more newer messages")
+	}
+
+	// Nothing is newer than the newest message
+	expectPage(t, store, cursorQuery(room.ID, "after", dto.ToMessageCursor(messages[4]), 2), nil, false, false)
+
+	// A room without messages
+	empty := storetest.JoinGroup(t, store, alice, "empty")
+	expectPage(t, store, cursorQuery(empty.ID, "before", LatestCursor, 2), nil, false, false)
+
+	// Without a cursor, the first page has no previous cursor and the last page no next one
+	expectPage(t, store, url.Values{"roomId": {room.ID.Hex()}, "limit": {"3"}}, []string{"m0", "m1", "m2"}, false, true)
+	expectPage(t, store, url.Values{"roomId": {room.ID.Hex()}, "limit": {"3"}, "page": {"2"}}, []string{"m3", "m4"}, true, false)
+	expectPage(t, store, url.Values{"roomId": {room.ID.Hex()}, "limit": {"3"}, "order": {"desc"}}, []string{"m4", "m3", "m2"}, false, false)
+}
+
+// TestMessageCursorTies pages from positions sharing the timestamp of a message,
+// the message is ordered against them by ID
+func TestMessageCursorTies(t *testing.T) {
+	store := memory.NewStore()
+	alice := storetest.CreateUser(t, store, "alice")
+	room := storetest.JoinGroup(t, store, alice, "general")
+	message := storetest.SendMessage(t, store, alice, room, "tied", "")
+
+	lowerID := primitive.ObjectID{11: 1}
+	higherID := primitive.ObjectID{0: 0xff, 1: 0xff, 2: 0xff, 3: 0xff, 4: 0xff, 5: 0xff, 6: 0xff, 7: 0xff, 8: 0xff, 9: 0xff, 10: 0xff, 11: 0xff}
+	lower := dto.ToMessageCursor(&repository.MessageModel{ID: lowerID, Timestamp: message.Timestamp})
+	higher := dto.ToMessageCursor(&repository.MessageModel{ID: higherID, Timestamp: message.Timestamp})
+
+	expectPage(t, store, cursorQuery(room.ID, "after", lower, 10), []string{"tied"}, true, false)
+	expectPage(t, store, cursorQuery(room.ID, "after", higher, 10), nil, false, false)
+	expectPage(t, store, cursorQuery(room.ID, "before", higher, 10), []string{"tied"}, false, true)
+	expectPage(t, store, cursorQuery(room.ID, "before", lower, 10), nil, false, false)
+
+	// The cursor of the message itself excludes it in both directions
+	own := dto.ToMessageCursor(message)
+	expectPage(t, store, cursorQuery(room.ID, "after", own, 10), nil, false, false)
+	expectPage(t, store, cursorQuery(room.ID, "before", own, 10), nil, false, false)
+}
+
+// TestMessageCursorErrors rejects malformed cursors and cursors that
+// were not issued as message cursors
+func TestMessageCursorErrors(t *testing.T) {
+	store := memory.NewStore()
+	alice := storetest.CreateUser(t, store, "alice")
+	room := storetest.JoinGroup(t, store, alice, "general")
+	message := storetest.SendMessage(t, store, alice, room, "hello", "")
+	cursor := dto.ToMessageCursor(message)
+
+	encode := func(position string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(position))
+	}
+
+	tests := []struct {
+		name  string
+		query url.Values
+	}{
+		{"before and after", url.Values{"roomId": {room.ID.Hex()}, "before": {cursor}, "after": {cursor}}},
+		{"not base64", cursorQuery(room.ID, "before", "!!!", 10)},
+		{"padded base64", cursorQuery(room.ID, "after", base64.URLEncoding.EncodeToString([]byte("x")), 10)},
+		{"latest after", cursorQuery(room.ID, "after", LatestCursor, 10)},
+		{"no timestamp", cursorQuery(room.ID, "before", encode(message.ID.Hex()), 10)},
+		{"page number", cursorQuery(room.ID, "after", encode("2"), 10)},
+		{"invalid ID", cursorQuery(room.ID, "after", encode(message.Timestamp.UTC().Format(time.RFC3339Nano)+"_user"), 10)},
+		{"invalid limit", cursorQuery(room.ID, "before", cursor, 0)},
+		{"sort on a hidden field", url.Values{"roomId": {room.ID.Hex()}, "sort": {"content"}}},
+		{"invalid order", url.Values{"roomId": {room.ID.Hex()}, "order": {"newest"}}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code, _ := getMessages(t, store, test.query)
+			if code != http.StatusBadRequest {
+				t.Errorf("GET /messages?%s = %d; want %d", test.query.Encode(), code, http.StatusBadRequest)
+			}
+		})
+	}
+
+	// Limits are capped rather than rejected
+	code, _ := getMessages(t, store, cursorQuery(room.ID, "before", LatestCursor, maxLimit+1))
+	if code != http.StatusOK {
+		t.Errorf("GET /messages with a limit above %d = %d; want %d", maxLimit, code, http.StatusOK)
+	}
+}
@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"chat-server/repository"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultLimit = 10
+	maxLimit     = 100
+)
+
+// sortFields whitelists the fields a list can be sorted on, by their name in the API
+type sortFields map[string]string
+
+var (
+	userSortFields    = sortFields{"createdAt": "created_at", "username": "username", "firstName": "first_name", "lastName": "last_name"}
+	roomSortFields    = sortFields{"createdAt": "created_at", "name": "name"}
+	messageSortFields = sortFields{"timestamp": "timestamp"}
+)
+
+// parsePage reads the page, limit, sort and order query params. Limits above maxLimit
+// are capped, invalid values and sort fields that are not whitelisted are rejected.
+func parsePage(c echo.Context, fields sortFields, defaultSort repository.Sort) (repository.Page, error) {
+	page := repository.Page{Number: 1, Limit: defaultLimit, Sort: defaultSort}
+
+	if pageString := c.QueryParam("page"); pageString != "" {
+		number, err := strconv.Atoi(pageString)
+		if err != nil || number < 1 {
+			return page, echo.NewHTTPError(http.StatusBadRequest, "page must be a positive number")
+		}
+
+		page.Number = number
+	}
+
+	if limitString := c.QueryParam("limit"); limitString != "" {
+		limit, err := strconv.Atoi(limitString)
+		if err != nil || limit < 1 {
+			return page, echo.NewHTTPError(http.StatusBadRequest, "limit must be a positive number")
+		}
+
+		page.Limit = min(limit, maxLimit)
+	}
+
+	if sortString := c.QueryParam("sort"); sortString != "" {
+		field, found := fields[sortString]
+		if !found {
+			return page, echo.NewHTTPError(http.StatusBadRequest, "cannot sort on '"+sortString+"'")
+		}
+
+		// Ascending unless ordered otherwise
+		page.Sort = repository.Sort{Field: field}
+	}
+
+	switch c.QueryParam("order") {
+	case "":
+	case "asc":
+		page.Sort.Descending = false
+	case "desc":
+		page.Sort.Descending = true
+	default:
+		return page, echo.NewHTTPError(http.StatusBadRequest, "order must be either 'asc' or 'desc'")
+	}
+
+	return page, nil
+}
+
+// paginated is the response listing a page of data out of total entities
+func paginated(data any, page repository.Page, total int64) echo.Map {
+	return echo.Map{
+		"data":    data,
+		"page":    page.Number,
+		"limit":   page.Limit,
+		"total":   total,
+		"hasMore": int64(page.Skip()+page.Limit) < total,
+	}
+}
@@ -0,0 +1,59 @@
+package controller
+
+import (
+	"chat-server/repository"
+	"errors"
+	"github.com/labstack/echo/v4"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParsePage(t *testing.T) {
+	defaultSort := repository.Sort{Field: "created_at", Descending: true}
+
+	tests := []struct {
+		query string
+		page  repository.Page
+		code  int // Status of the rejection, zero when accepted
+	}{
+		{query: "", page: repository.Page{Number: 1, Limit: defaultLimit, Sort: defaultSort}},
+		{query: "page=3&limit=20", page: repository.Page{Number: 3, Limit: 20, Sort: defaultSort}},
+		{query: "limit=100", page: repository.Page{Number: 1, Limit: maxLimit, Sort: defaultSort}},
+		{query: "limit=101", page: repository.Page{Number: 1, Limit: maxLimit, Sort: defaultSort}},
+		{query: "limit=100000", page: repository.Page{Number: 1, Limit: maxLimit, Sort: defaultSort}},
+		{query: "sort=name", page: repository.Page{Number: 1, Limit: defaultLimit, Sort: repository.Sort{Field: "name"}}},
+		{query: "sort=createdAt&order=desc", page: repository.Page{Number: 1, Limit: defaultLimit, Sort: repository.Sort{Field: "created_at", Descending: true}}},
+		{query: "order=asc", page: repository.Page{Number: 1, Limit: defaultLimit, Sort: repository.Sort{Field: "created_at"}}},
+		{query: "page=0", code: http.StatusBadRequest},
+		{query: "page=-1", code: http.StatusBadRequest},
+		{query: "page=first", code: http.StatusBadRequest},
+		{query: "limit=0", code: http.StatusBadRequest},
+		{query: "limit=ten", code: http.StatusBadRequest},
+		{query: "sort=password", code: http.StatusBadRequest},
+		{query: "sort=created_at", code: http.StatusBadRequest}, // Fields are named as in the API
+		{query: "sort=name&order=random", code: http.StatusBadRequest},
+		{query: "order=DESC", code: http.StatusBadRequest},
+	}
+
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			request := httptest.NewRequest(http.MethodGet, "/rooms?"+test.query, nil)
+			c := echo.New().NewContext(request, httptest.NewRecorder())
+
+			page, err := parsePage(c, roomSortFields, defaultSort)
+
+			var httpErr *echo.HTTPError
+			switch {
+			case test.code != 0:
+				if !errors.As(err, &httpErr) || httpErr.Code != test.code {
+					t.Errorf("parsePage() = %+v, %v; want a %d", page, err, test.code)
+				}
+			case err != nil:
+				t.Errorf("parsePage() failed: %v", err)
+			case page != test.page:
+				t.Errorf("parsePage() = %+v; want %+v", page, test.page)
+			}
+		})
+	}
+}
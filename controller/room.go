@@ -6,128 +6,198 @@ import (
 	"chat-server/repository"
 	"context"
 	"github.com/labstack/echo/v4"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"log"
 	"net/http"
-	"strconv"
+	"slices"
 	"time"
 )
 
-func JoinRoom(c echo.Context) error {
+func JoinRoom(store *repository.Store) echo.HandlerFunc {
+	return func(c echo.Context) error {
 
-	principal := auth.GetPrincipal(c)
-	currentParticipant, err := primitive.ObjectIDFromHex(principal.ID)
-	if err != nil {
-		badRequest := echo.ErrBadRequest
-		badRequest.Message = err
+		principal := auth.GetPrincipal(c)
+		currentParticipant, err := primitive.ObjectIDFromHex(principal.ID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
 
-		return badRequest
-	}
+		roomType := c.Param("type")
+		if roomType != repository.PrivateChatRoom && roomType != repository.GroupChatRoom {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid room type received: type must be either 'private' or 'group'")
+		}
+		targetParticipantHex := c.QueryParam("targetParticipant")
+		if roomType == repository.PrivateChatRoom && targetParticipantHex == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "missing 'targetParticipant' query param")
+		}
 
-	roomType := c.Param("type")
-	if roomType != repository.PrivateChatRoom && roomType != repository.GroupChatRoom {
-		badRequest := echo.ErrBadRequest
-		badRequest.Message = "invalid room type received: type must be either 'private' or 'group'"
+		var targetParticipant primitive.ObjectID
+		if targetParticipantHex != "" {
+			targetParticipant, err = primitive.ObjectIDFromHex(targetParticipantHex)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid targetParticipant received")
+			}
+		}
 
-		return badRequest
-	}
-	targetParticipantHex := c.QueryParam("targetParticipant")
-	if roomType == repository.PrivateChatRoom && targetParticipantHex == "" {
-		badRequest := echo.ErrBadRequest
-		badRequest.Message = "missing 'targetParticipant' query param"
+		roomName := c.QueryParam("name")
+		if roomType == repository.GroupChatRoom && roomName == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "room name is required for group chat")
+		}
 
-		return badRequest
+		var room *repository.RoomModel
+		if roomType == repository.PrivateChatRoom {
+			room, err = store.Rooms.JoinPrivateChatRoom(currentParticipant, targetParticipant)
+		} else if roomType == repository.GroupChatRoom {
+			room, err = store.Rooms.JoinGroupChatRoom(currentParticipant, roomName)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, echo.Map{
+			"data": dto.ToRoomDto(room),
+		})
 	}
+}
 
-	var targetParticipant primitive.ObjectID
-	if targetParticipantHex != "" {
-		targetParticipant, err = primitive.ObjectIDFromHex(targetParticipantHex)
+func GetRoomById(store *repository.Store) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		roomIdString := c.Param("roomId")
+		roomId, err := primitive.ObjectIDFromHex(roomIdString)
 		if err != nil {
-			badRequest := echo.ErrBadRequest
-			badRequest.Message = "invalid targetParticipant received"
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid roomId: "+roomIdString)
+		}
 
-			return badRequest
+		room, err := store.Rooms.FindRoom(ctx, roomId)
+		if err != nil {
+			log.Println("no room exist")
+
+			return echo.ErrNotFound
 		}
-	}
 
-	roomName := c.QueryParam("name")
-	if roomType == repository.GroupChatRoom && roomName == "" {
-		badRequest := echo.ErrBadRequest
-		badRequest.Message = "room name is required for group chat"
+		roomDto := []dto.Room{dto.ToRoomDto(room)}
+		err = withUnreadCount(ctx, store, roomDto, []*repository.RoomModel{room}, auth.GetPrincipal(c))
+		if err != nil {
+			return err
+		}
 
-		return badRequest
+		return c.JSON(http.StatusOK, echo.Map{
+			"data": roomDto[0],
+		})
 	}
+}
 
-	roomRepo := repository.NewRoom()
-	var room *repository.RoomModel
-	if roomType == repository.PrivateChatRoom {
-		room, err = roomRepo.JoinPrivateChatRoom(currentParticipant, targetParticipant)
-	} else if roomType == repository.GroupChatRoom {
-		room, err = roomRepo.JoinGroupChatRoom(currentParticipant, roomName)
-	}
+func GetRooms(store *repository.Store) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
 
-	if err != nil {
-		return err
-	}
+		// Newest rooms first by default
+		page, err := parsePage(c, roomSortFields, repository.Sort{Field: "created_at", Descending: true})
+		if err != nil {
+			return err
+		}
 
-	return c.JSON(http.StatusOK, echo.Map{
-		"data": dto.ToRoomDto(room),
-	})
-}
+		rooms, err := store.Rooms.FindRooms(ctx, page)
+		if err != nil {
+			log.Println("no room exist")
 
-func GetRoomById(c echo.Context) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+			return echo.ErrNotFound
+		}
 
-	roomIdString := c.Param("roomId")
-	roomId, err := primitive.ObjectIDFromHex(roomIdString)
-	if err != nil {
-		badRequest := echo.ErrBadRequest
-		badRequest.Message = "invalid roomId: " + roomIdString
+		total, err := store.Rooms.CountRooms(ctx)
+		if err != nil {
+			return err
+		}
+
+		roomDtos := dto.ToRoomListDto(rooms)
+		err = withUnreadCount(ctx, store, roomDtos, rooms, auth.GetPrincipal(c))
+		if err != nil {
+			return err
+		}
 
-		return badRequest
+		return c.JSON(http.StatusOK, paginated(roomDtos, page, total))
 	}
+}
 
-	roomRepository := repository.NewRoom()
-	room, err := roomRepository.FindOne(ctx, bson.M{"_id": roomId})
-	if err != nil {
-		log.Println("no room exist")
+func MarkRoomRead(store *repository.Store) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
 
-		return echo.ErrNotFound
-	}
+		principal := auth.GetPrincipal(c)
+		userId, err := primitive.ObjectIDFromHex(principal.ID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid userId")
+		}
 
-	return c.JSON(http.StatusOK, echo.Map{
-		"data": dto.ToRoomDto(*room),
-	})
-}
+		readData := new(dto.ReadDto)
+		if err := c.Bind(readData); err != nil {
+			return err
+		}
 
-func GetRooms(c echo.Context) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+		roomIdString := c.Param("roomId")
+		roomId, err := primitive.ObjectIDFromHex(roomIdString)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid roomId: "+roomIdString)
+		}
 
-	pageString := c.QueryParam("page")
-	limitString := c.QueryParam("limit")
+		room, err := store.Rooms.FindRoom(ctx, roomId)
+		if err != nil || !slices.Contains(room.Participants, userId) {
+			log.Println("no room exist with the current user as participant")
 
-	page, err := strconv.Atoi(pageString)
-	if err != nil {
-		page = 1
+			return echo.ErrNotFound
+		}
+
+		messageId, err := primitive.ObjectIDFromHex(readData.MessageID)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid messageId: "+readData.MessageID)
+		}
+
+		message, err := store.Messages.FindMessage(ctx, messageId)
+		if err != nil || message.RoomID != roomId {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid messageId: "+readData.MessageID)
+		}
+
+		receipt, err := store.ReadReceipts.MarkRead(ctx, userId, message)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, echo.Map{
+			"data": dto.ToReadReceiptDto(receipt),
+		})
 	}
+}
 
-	limit, err := strconv.Atoi(limitString)
+// withUnreadCount sets the unread count of the current user on the rooms they participate in
+func withUnreadCount(ctx context.Context, store *repository.Store, rooms []dto.Room, roomModels []*repository.RoomModel, principal auth.Principal) error {
+	userId, err := primitive.ObjectIDFromHex(principal.ID)
 	if err != nil {
-		limit = 10
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid userId")
+	}
+
+	var roomIds []primitive.ObjectID
+	for _, room := range roomModels {
+		if slices.Contains(room.Participants, userId) {
+			roomIds = append(roomIds, room.ID)
+		}
 	}
 
-	roomRepository := repository.NewRoom()
-	rooms, err := roomRepository.Find(ctx, bson.M{}, page, limit, "created_at")
+	counts, err := store.ReadReceipts.CountUnreadByRooms(ctx, userId, roomIds)
 	if err != nil {
-		log.Println("no room exist")
+		return err
+	}
 
-		return echo.ErrNotFound
+	for i, room := range roomModels {
+		if unreadCount, ok := counts[room.ID]; ok {
+			rooms[i].UnreadCount = &unreadCount
+		}
 	}
 
-	return c.JSON(http.StatusOK, echo.Map{
-		"data": dto.ToRoomListDto(rooms),
-	})
+	return nil
 }
@@ -6,62 +6,62 @@ import (
 	"chat-server/password"
 	"chat-server/repository"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/labstack/echo/v4"
-	"go.mongodb.org/mongo-driver/bson"
 	"log"
 	"net/http"
 	"time"
 )
 
-func Signup(c echo.Context) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+func Signup(store *repository.Store) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
 
-	signupData := new(dto.NewUser)
-	if err := c.Bind(signupData); err != nil {
-		return err
-	}
+		signupData := new(dto.NewUser)
+		if err := c.Bind(signupData); err != nil {
+			return err
+		}
 
-	userRepository := repository.NewUser()
-	modelData, err := dto.ToUserModel(*signupData)
-	if err != nil {
-		return err
-	}
+		modelData, err := dto.ToUserModel(*signupData)
+		if err != nil {
+			return err
+		}
 
-	existingUser, err := userRepository.FindOne(ctx, bson.M{"username": modelData.Username})
-	if err != nil {
-		log.Println("username is free.")
-	}
+		existingUser, err := store.Users.FindUserByUsername(ctx, modelData.Username)
+		if err != nil {
+			log.Println("username is free.")
+		}
 
-	if existingUser != nil {
-		httpError := echo.ErrBadRequest
+		if existingUser != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "user with the same username already exist")
+		}
 
-		httpError.Message = "user with the same username already exist"
+		hash, err := password.Hash(signupData.Password)
+		if err != nil {
+			return err
+		}
 
-		return httpError
-	}
+		modelData.Password = hash
+		// The username may have been taken since it was checked
+		newUser, err := store.Users.CreateUser(ctx, modelData)
+		if errors.Is(err, repository.ErrDuplicate) {
+			return echo.NewHTTPError(http.StatusBadRequest, "user with the same username already exist")
+		} else if err != nil {
+			return err
+		}
 
-	hash, err := password.Hash(signupData.Password)
-	if err != nil {
-		return err
-	}
+		authToken, err := auth.GenToken(newUser)
+		if err != nil {
+			return fmt.Errorf("failed to generate auth token: %w", err)
+		}
 
-	modelData.Password = hash
-	newUser, err := userRepository.Create(ctx, modelData)
-	if err != nil {
-		return err
-	}
+		userDto := dto.ToUserDto(modelData)
 
-	authToken, err := auth.GenToken(*newUser)
-	if err != nil {
-		return fmt.Errorf("failed to generate auth token: %w", err)
+		return c.JSON(http.StatusOK, echo.Map{
+			"data":  userDto,
+			"token": authToken,
+		})
 	}
-
-	userDto := dto.ToUserDto(modelData)
-
-	return c.JSON(http.StatusOK, echo.Map{
-		"data":  userDto,
-		"token": authToken,
-	})
 }
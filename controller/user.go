@@ -5,66 +5,69 @@ import (
 	"chat-server/repository"
 	"context"
 	"github.com/labstack/echo/v4"
-	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"log"
 	"net/http"
-	"strconv"
 	"time"
 )
 
-func GetUsers(c echo.Context) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+func GetUsers(store *repository.Store) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
 
-	pageString := c.QueryParam("page")
-	limitString := c.QueryParam("limit")
+		// Newest users first by default
+		page, err := parsePage(c, userSortFields, repository.Sort{Field: "created_at", Descending: true})
+		if err != nil {
+			return err
+		}
 
-	page, err := strconv.Atoi(pageString)
-	if err != nil {
-		page = 1
-	}
+		users, err := store.Users.FindUsers(ctx, page)
+		if err != nil {
+			log.Println("No user available")
 
-	limit, err := strconv.Atoi(limitString)
-	if err != nil {
-		limit = 10
-	}
+			return echo.ErrNotFound
+		}
 
-	userRepository := repository.NewUser()
-	users, err := userRepository.Find(ctx, bson.M{}, page, limit, "created_at")
-	if err != nil {
-		log.Println("No user available")
+		total, err := store.Users.CountUsers(ctx)
+		if err != nil {
+			return err
+		}
 
-		return echo.ErrNotFound
+		return c.JSON(http.StatusOK, paginated(dto.ToUserListDto(users), page, total))
 	}
-
-	return c.JSON(http.StatusOK, echo.Map{
-		"data": dto.ToUserListDto(users),
-	})
 }
 
-func GetUserById(c echo.Context) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+func GetUserById(store *repository.Store) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
 
-	userIdString := c.Param("userId")
-	userId, err := primitive.ObjectIDFromHex(userIdString)
-	if err != nil {
-		badRequest := echo.ErrBadRequest
-		badRequest.Message = "invalid userId: " + userIdString
+		userIdString := c.Param("userId")
+		userId, err := primitive.ObjectIDFromHex(userIdString)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "invalid userId: "+userIdString)
+		}
 
-		return badRequest
-	}
+		user, err := store.Users.FindUser(ctx, userId)
+		if err != nil {
+			log.Println("no user exist with the provided id")
 
-	userRepo := repository.NewUser()
-	user, err := userRepo.FindOne(ctx, bson.M{"_id": userId})
-	if err != nil {
-		log.Println("no user exist with the provided id")
+			return echo.ErrNotFound
+		}
 
-		return echo.ErrNotFound
-	}
+		userDto := dto.ToUserDto(user)
+
+		// Users without a presence record have never been online
+		presence := dto.Presence{UserID: userIdString, Status: repository.PresenceOffline}
+		presenceModel, err := store.Presence.FindPresence(ctx, userId)
+		if err == nil {
+			presence = dto.ToPresenceDto(presenceModel)
+		}
+		userDto.Presence = &presence
 
-	return c.JSON(http.StatusOK, echo.Map{
-		"data": dto.ToUserDto(*user),
-	})
+		return c.JSON(http.StatusOK, echo.Map{
+			"data": userDto,
+		})
+	}
 }
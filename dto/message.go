@@ -2,36 +2,96 @@ package dto
 
 import (
 	"chat-server/repository"
+	"encoding/base64"
 	"fmt"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strings"
 	"time"
 )
 
 type MessageDto struct {
-	RoomID  string `json:"roomId"`
-	Content string `json:"content"`
+	RoomID          string `json:"roomId"`
+	ClientMessageID string `json:"clientMessageId"`
+	Content         string `json:"content"`
 }
 
 type Message struct {
-	ID        string    `json:"id"`
-	RoomID    string    `json:"roomId"`
-	SenderID  string    `json:"senderId"`
-	Content   string    `json:"content"`
-	Username  string    `json:"username"`
-	Timestamp time.Time `json:"timestamp"`
+	ID              string    `json:"id"`
+	RoomID          string    `json:"roomId"`
+	SenderID        string    `json:"senderId"`
+	ClientMessageID string    `json:"clientMessageId,omitempty"`
+	Content         string    `json:"content"`
+	Username        string    `json:"username"`
+	Timestamp       time.Time `json:"timestamp"`
 }
 
-func ToMessageListDto(messageModel []**repository.MessageModel) []Message {
+// MessageAck confirms to the sender that a message has been persisted
+type MessageAck struct {
+	ClientMessageID string    `json:"clientMessageId,omitempty"`
+	ID              string    `json:"id"`
+	Timestamp       time.Time `json:"timestamp"`
+}
+
+// SyncDto requests the messages a client missed while it was offline
+type SyncDto struct {
+	Rooms []RoomSyncDto `json:"rooms"`
+}
+
+// RoomSyncDto is the last position a client has seen in a room, either
+// the ID of the last received message or the time it was last online
+type RoomSyncDto struct {
+	RoomID        string    `json:"roomId"`
+	LastMessageID string    `json:"lastMessageId"`
+	Since         time.Time `json:"since"`
+}
+
+type RoomSyncResult struct {
+	RoomID   string `json:"roomId"`
+	Replayed int    `json:"replayed"`
+	HasMore  bool   `json:"hasMore"`
+}
+
+// ToMessageCursor returns the opaque position of the message in the history,
+// its timestamp and ID, used to page through the messages
+func ToMessageCursor(message *repository.MessageModel) string {
+	position := message.Timestamp.UTC().Format(time.RFC3339Nano) + "_" + message.ID.Hex()
+
+	return base64.RawURLEncoding.EncodeToString([]byte(position))
+}
+
+// ParseMessageCursor returns the position encoded by ToMessageCursor
+func ParseMessageCursor(cursor string) (time.Time, primitive.ObjectID, error) {
+	position, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, primitive.NilObjectID, fmt.Errorf("invalid cursor '%s': %w", cursor, err)
+	}
+
+	timestampString, idHex, _ := strings.Cut(string(position), "_")
+	timestamp, err := time.Parse(time.RFC3339Nano, timestampString)
+	if err != nil {
+		return time.Time{}, primitive.NilObjectID, fmt.Errorf("invalid cursor '%s': %w", cursor, err)
+	}
+
+	id, err := primitive.ObjectIDFromHex(idHex)
+	if err != nil {
+		return time.Time{}, primitive.NilObjectID, fmt.Errorf("invalid cursor '%s': %w", cursor, err)
+	}
+
+	return timestamp, id, nil
+}
+
+func ToMessageListDto(messageModel []*repository.MessageModel) []Message {
 	messages := make([]Message, len(messageModel))
 
 	for i, message := range messageModel {
 		messages[i] = Message{
-			ID:        (*message).ID.Hex(),
-			RoomID:    (*message).RoomID.Hex(),
-			SenderID:  (*message).SenderID.Hex(),
-			Content:   (*message).Content,
-			Username:  (*message).Username,
-			Timestamp: (*message).Timestamp,
+			ID:              (*message).ID.Hex(),
+			RoomID:          (*message).RoomID.Hex(),
+			SenderID:        (*message).SenderID.Hex(),
+			ClientMessageID: (*message).ClientMessageID,
+			Content:         (*message).Content,
+			Username:        (*message).Username,
+			Timestamp:       (*message).Timestamp,
 		}
 	}
 
@@ -42,16 +102,27 @@ func ToMessageDto(messageModel *repository.MessageModel) Message {
 	message := *messageModel
 
 	return Message{
-		ID:        message.ID.Hex(),
-		RoomID:    message.RoomID.Hex(),
-		SenderID:  message.SenderID.Hex(),
-		Content:   message.Content,
-		Username:  message.Username,
-		Timestamp: message.Timestamp,
+		ID:              message.ID.Hex(),
+		RoomID:          message.RoomID.Hex(),
+		SenderID:        message.SenderID.Hex(),
+		ClientMessageID: message.ClientMessageID,
+		Content:         message.Content,
+		Username:        message.Username,
+		Timestamp:       message.Timestamp,
 	}
 
 }
 
+func ToMessageAck(messageModel *repository.MessageModel) MessageAck {
+	message := *messageModel
+
+	return MessageAck{
+		ClientMessageID: message.ClientMessageID,
+		ID:              message.ID.Hex(),
+		Timestamp:       message.Timestamp,
+	}
+}
+
 func ToMessageModel(message MessageDto) (*repository.MessageModel, error) {
 	roomID, err := primitive.ObjectIDFromHex(message.RoomID)
 	if err != nil {
@@ -59,7 +130,8 @@ func ToMessageModel(message MessageDto) (*repository.MessageModel, error) {
 	}
 
 	return &repository.MessageModel{
-		Content: message.Content,
-		RoomID:  roomID,
+		Content:         message.Content,
+		ClientMessageID: message.ClientMessageID,
+		RoomID:          roomID,
 	}, nil
 }
@@ -0,0 +1,27 @@
+package dto
+
+import (
+	"chat-server/repository"
+	"time"
+)
+
+// PresenceDto changes the status of the current user, either online or away
+type PresenceDto struct {
+	Status string `json:"status"`
+}
+
+type Presence struct {
+	UserID   string    `json:"userId"`
+	Status   string    `json:"status"`
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+func ToPresenceDto(presenceModel *repository.PresenceModel) Presence {
+	presence := *presenceModel
+
+	return Presence{
+		UserID:   presence.ID.Hex(),
+		Status:   presence.Status,
+		LastSeen: presence.LastSeen,
+	}
+}
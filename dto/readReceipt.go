@@ -0,0 +1,30 @@
+package dto
+
+import (
+	"chat-server/repository"
+	"time"
+)
+
+// ReadDto marks every message of a room up to the given message as read
+type ReadDto struct {
+	RoomID    string `json:"roomId"`
+	MessageID string `json:"messageId"`
+}
+
+type ReadReceipt struct {
+	RoomID            string    `json:"roomId"`
+	UserID            string    `json:"userId"`
+	LastReadMessageID string    `json:"lastReadMessageId"`
+	LastReadAt        time.Time `json:"lastReadAt"`
+}
+
+func ToReadReceiptDto(readReceiptModel *repository.ReadReceiptModel) ReadReceipt {
+	receipt := *readReceiptModel
+
+	return ReadReceipt{
+		RoomID:            receipt.RoomID.Hex(),
+		UserID:            receipt.UserID.Hex(),
+		LastReadMessageID: receipt.LastReadMessageID.Hex(),
+		LastReadAt:        receipt.LastReadAt,
+	}
+}
@@ -11,12 +11,18 @@ type Room struct {
 	Name         string   `json:"name"`
 	Type         string   `json:"type"`
 	Participants []string `json:"participants"`
+	UnreadCount  *int64   `json:"unreadCount,omitempty"` // Only set for rooms the current user participates in
 }
 
-func ToRoomListDto(roomModel []**repository.RoomModel) []Room {
+type JoinRoomDto struct {
+	Type              string `json:"type"`
+	Name              string `json:"name"`
+	TargetParticipant string `json:"targetParticipant"`
+}
+
+func ToRoomListDto(roomModel []*repository.RoomModel) []Room {
 	rooms := make([]Room, len(roomModel))
 
-	var participants []string
 	for i, roomReference := range roomModel {
 		room := *roomReference
 
@@ -26,6 +32,7 @@ func ToRoomListDto(roomModel []**repository.RoomModel) []Room {
 			Name: room.Name,
 		}
 
+		var participants []string
 		for _, v := range room.Participants {
 			participants = append(participants, v.Hex())
 		}
@@ -0,0 +1,12 @@
+package dto
+
+type TypingDto struct {
+	RoomID string `json:"roomId"`
+}
+
+// Typing tells the participants of a room that a user started or stopped typing
+type Typing struct {
+	RoomID   string `json:"roomId"`
+	UserID   string `json:"userId"`
+	Username string `json:"username"`
+}
@@ -14,13 +14,14 @@ type NewUser struct {
 }
 
 type User struct {
-	ID        string `json:"id"`
-	FirstName string `json:"firstName"`
-	LastName  string `json:"lastName"`
-	Username  string `json:"username"`
+	ID        string    `json:"id"`
+	FirstName string    `json:"firstName"`
+	LastName  string    `json:"lastName"`
+	Username  string    `json:"username"`
+	Presence  *Presence `json:"presence,omitempty"`
 }
 
-func ToUserListDto(userModel []**repository.UserModel) []User {
+func ToUserListDto(userModel []*repository.UserModel) []User {
 	users := make([]User, len(userModel))
 
 	for i, user := range userModel {
@@ -2,9 +2,14 @@ package main
 
 import (
 	"chat-server/auth"
+	"chat-server/broker"
 	"chat-server/controller"
+	"chat-server/nats"
 	"chat-server/rabbitmq"
+	"chat-server/redis"
 	"chat-server/repository"
+	"chat-server/repository/memory"
+	"chat-server/repository/sqlstore"
 	"chat-server/websocket"
 	"context"
 	"errors"
@@ -16,6 +21,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -40,51 +48,52 @@ func main() {
 		log.Println("no .env file present on the server project path")
 	}
 
-	// Initialize RabbitMQ connection
-	rmq, err := rabbitmq.New()
-	if err != nil {
-		log.Fatal("Failed to initialize RabbitMQ:", err)
-	}
-	err = rmq.DeclareExchange(rabbitmq.ExchangeName)
-	if err != nil {
-		log.Fatal("failed to declare connection exchange: ", err)
+	// `chat-server migrate` applies the database migrations and exits
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate()
+		return
 	}
 
-	// Initialize WebSocket handler
-	socketHandler := websocket.New(rmq)
-	go socketHandler.ConsumeMessages(rabbitmq.ExchangeName, rabbitmq.QueueName)
+	// Initialize the storage
+	store, closeStore := newStore()
+
+	// Initialize the message broker
+	socketConfig := websocket.LoadConfig()
+	messageBroker := newBroker(socketConfig.InstanceID)
 
-	// Initialize MongoDB
-	repository.SetupDatabase()
+	// Initialize WebSocket handler
+	socketHandler := websocket.New(messageBroker, store, socketConfig)
+	go socketHandler.ConsumeMessages()
 
 	// Public route for health check and metrics
-	e.GET("/health", controller.Health)
+	e.GET("/health", controller.Health(messageBroker))
 	e.GET("/metrics", echoprometheus.NewHandler())
 
 	// Auth route for signup and login,
 	// these routes are public and does not require authentication
 	authRoute := e.Group("/auth")
-	authRoute.POST("/signup", controller.Signup)
-	authRoute.POST("/login", controller.Login)
+	authRoute.POST("/signup", controller.Signup(store))
+	authRoute.POST("/login", controller.Login(store))
 
 	// Protected routes grouped according to their resources
 	protectedRoute := e.Group("", echojwt.WithConfig(auth.JwtCustomConfig()))
 
 	// Protected: Routes for the user resource
 	userRoute := protectedRoute.Group("/users")
-	userRoute.GET("/:userId", controller.GetUserById)
-	userRoute.GET("", controller.GetUsers)
+	userRoute.GET("/:userId", controller.GetUserById(store))
+	userRoute.GET("", controller.GetUsers(store))
 
 	// Protected: Routes for the room resource
 	roomRoute := protectedRoute.Group("/rooms")
-	roomRoute.GET("/:roomId", controller.GetRoomById)
-	roomRoute.GET("", controller.GetRooms)
+	roomRoute.GET("/:roomId", controller.GetRoomById(store))
+	roomRoute.GET("", controller.GetRooms(store))
 	//roomRoute.POST("/:roomName/join", controller.JoinRoom)
-	roomRoute.POST("/:type/join", controller.JoinRoom)
+	roomRoute.POST("/:type/join", controller.JoinRoom(store))
+	roomRoute.POST("/:roomId/read", controller.MarkRoomRead(store))
 
 	// Protected: Routes for the message resource
 	msgRoute := protectedRoute.Group("/messages")
-	msgRoute.GET("", controller.GetMessages)
+	msgRoute.GET("", controller.GetMessages(store))
 
 	// Protected: Routes for websocket connection - chat
 	wsRoute := protectedRoute.Group("/chat")
@@ -99,14 +108,158 @@ func main() {
 		Addr:    ":" + serverPort,
 		Handler: e,
 	}
-	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
-		log.Fatal(err)
+	go func() {
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	// Stop on SIGTERM, e.g. when the pod is scaled down or redeployed
+	stop, cancelStop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancelStop()
+	<-stop.Done()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = server.Shutdown(ctx)
+	if err != nil {
+		log.Print(err)
+	}
+
+	// Take the users of this instance offline while the broker and the
+	// database are still connected
+	err = socketHandler.Shutdown(ctx)
+	if err != nil {
+		log.Print(err)
 	}
 
 	// AFTER server shutdown
-	// close database connection
-	err = repository.Database.Client().Disconnect(context.TODO())
+	// close broker and database connection
+	err = messageBroker.Close()
+	if err != nil {
+		log.Print(err)
+	}
+
+	err = closeStore()
 	if err != nil {
 		log.Print(err) // Handle potential disconnect error
 	}
 }
+
+// migrate applies the migrations of the storage selected by the STORAGE environment variable
+func migrate() {
+	switch os.Getenv("STORAGE") {
+	case "", "mongo":
+		repository.SetupDatabase()
+		migrateDatabase()
+
+		err := repository.Database.Client().Disconnect(context.TODO())
+		if err != nil {
+			log.Print(err)
+		}
+	default:
+		// The SQL storages apply their migrations when opened
+		_, closeStore := newStore()
+
+		err := closeStore()
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// migrateDatabase applies the pending MongoDB migrations, creating indexes may take a while
+func migrateDatabase() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+
+	err := repository.Migrate(ctx)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newStore connects to the storage selected by the STORAGE environment variable.
+// It also returns the function closing the connection on shutdown.
+func newStore() (*repository.Store, func() error) {
+	switch os.Getenv("STORAGE") {
+	case "memory":
+		// Nothing is persisted, for development and tests
+		return memory.NewStore(), func() error { return nil }
+	case "postgres":
+		db, err := sqlstore.Open(sqlstore.Postgres, os.Getenv("POSTGRES_URL"))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		return db.Store(), db.Close
+	case "sqlite":
+		// A single data file, for single instance deployments together with BROKER=memory
+		path := os.Getenv("SQLITE_PATH")
+		if path == "" {
+			path = "chat-server.db"
+		}
+
+		db, err := sqlstore.Open(sqlstore.SQLite, sqlstore.SQLiteDataSource(path))
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		return db.Store(), db.Close
+	case "", "mongo":
+		repository.SetupDatabase()
+
+		if os.Getenv("SKIP_MIGRATIONS") != "true" {
+			migrateDatabase()
+		}
+
+		return repository.NewMongoStore(), func() error {
+			return repository.Database.Client().Disconnect(context.TODO())
+		}
+	default:
+		log.Fatal("unsupported STORAGE: ", os.Getenv("STORAGE"))
+		return nil, nil
+	}
+}
+
+// newBroker connects to the message broker selected by the BROKER environment variable
+func newBroker(instanceID string) broker.Broker {
+	switch os.Getenv("BROKER") {
+	case "memory":
+		// Single instance deployments don't need to share messages
+		return broker.NewMemory()
+	case "nats":
+		natsBroker, err := nats.New(instanceID)
+		if err != nil {
+			log.Fatal("Failed to initialize NATS:", err)
+		}
+
+		return natsBroker
+	case "redis":
+		redisBroker, err := redis.New()
+		if err != nil {
+			log.Fatal("Failed to initialize Redis:", err)
+		}
+
+		return redisBroker
+	case "", "rabbitmq":
+		rmq, err := rabbitmq.New()
+		if err != nil {
+			log.Fatal("Failed to initialize RabbitMQ:", err)
+		}
+		err = rmq.DeclareExchange(rabbitmq.ExchangeName)
+		if err != nil {
+			log.Fatal("failed to declare connection exchange: ", err)
+		}
+		err = rmq.DeclareDeadLetter(rabbitmq.DeadLetterExchange)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		return rabbitmq.NewBroker(rmq, rabbitmq.ExchangeName, rabbitmq.InstanceQueueName(instanceID))
+	default:
+		log.Fatal("unsupported BROKER: ", os.Getenv("BROKER"))
+		return nil
+	}
+}
@@ -0,0 +1,494 @@
+package nats
+
+import (
+	"chat-server/broker"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// StreamName is the JetStream stream carrying the messages of every topic,
+	// published on the subject SubjectPrefix.<topic>
+	StreamName    = "CHAT_ROOMS"
+	SubjectPrefix = "chat_rooms"
+
+	// DeadLetterStreamName keeps the messages that repeatedly failed to be processed
+	DeadLetterStreamName    = "CHAT_ROOMS_DEAD"
+	DeadLetterSubjectPrefix = "chat_rooms_dead"
+
+	// ConsumerExpiry is how long the consumer of an instance outlives the instance,
+	// so that messages are kept for an instance that is reconnecting
+	ConsumerExpiry = time.Minute
+
+	// ConfirmTimeout is how long a publish waits for the server to store the message
+	ConfirmTimeout = 5 * time.Second
+
+	// maxAge caps how long an undelivered message is kept
+	maxAge = time.Hour
+
+	// deadLetterMaxAge is how long dead-lettered messages are kept for inspection
+	deadLetterMaxAge = 7 * 24 * time.Hour
+
+	// filterUpdateDelay batches the subscription changes made meanwhile into a
+	// single consumer update, e.g. when many clients connect at once
+	filterUpdateDelay = 100 * time.Millisecond
+
+	// filterRetryDelay is how long a failed consumer update waits before it is retried
+	filterRetryDelay = time.Second
+)
+
+// Broker implements broker.Broker on top of NATS JetStream. Topics are subjects
+// of a stream with interest retention, every instance consumes through its own
+// durable consumer filtered on the topics it subscribed to. The consumer only
+// exists while the instance is subscribed to a topic. Like the AMQP path,
+// publishes are confirmed by the server, messages are acknowledged once processed
+// and dead-lettered when they fail repeatedly.
+type Broker struct {
+	conn         *nats.Conn
+	js           jetstream.JetStream
+	consumerName string
+
+	mu       sync.Mutex
+	topics   map[string]bool
+	consumer jetstream.Consumer // Nil while subscribed to no topic
+	ready    chan struct{}      // Closed once the consumer exists or the broker is closed
+	iterator jetstream.MessagesContext
+	closed   bool
+
+	filterChanged chan struct{} // Wakes up the consumer filter updater
+	done          chan struct{} // Closed with the broker
+	consumed      chan struct{} // Closed once consuming stopped, nil until Consume is called
+}
+
+func New(instanceID string) (*Broker, error) {
+	url := os.Getenv("NATS_URL")
+	if url == "" {
+		log.Fatal("NATS_URL environment variable not set")
+	}
+
+	conn, err := nats.Connect(
+		url,
+		nats.MaxReconnects(-1), // Reconnect forever, publishes wait in the meantime
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Printf("NATS connection lost, reconnecting: %v", err)
+		}),
+		nats.ReconnectHandler(func(_ *nats.Conn) {
+			log.Println("NATS connection restored")
+		}),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open JetStream context: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Like messages routed to no queue, messages no consumer is interested in are dropped
+	_, err = js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:      StreamName,
+		Subjects:  []string{SubjectPrefix + ".>"},
+		Retention: jetstream.InterestPolicy,
+		Storage:   jetstream.FileStorage,
+		MaxAge:    maxAge,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to declare stream: %w", err)
+	}
+
+	_, err = js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:     DeadLetterStreamName,
+		Subjects: []string{DeadLetterSubjectPrefix + ".>"},
+		Storage:  jetstream.FileStorage,
+		MaxAge:   deadLetterMaxAge,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to declare dead letter stream: %w", err)
+	}
+
+	b := &Broker{
+		conn:          conn,
+		js:            js,
+		consumerName:  ConsumerName(instanceID),
+		topics:        make(map[string]bool),
+		ready:         make(chan struct{}),
+		filterChanged: make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+	go b.updateFilter()
+
+	return b, nil
+}
+
+// ConsumerName returns the name of the durable consumer of a server instance.
+// Consumer names cannot contain dots, which are common in host names.
+func ConsumerName(instanceID string) string {
+	return "instance_" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		default:
+			return '_'
+		}
+	}, instanceID)
+}
+
+func subject(topic string) string {
+	return SubjectPrefix + "." + topic
+}
+
+// Publish sends the message and waits for the server to store it. While the
+// connection is lost the publish is retried, for as long as the context allows.
+func (b *Broker) Publish(ctx context.Context, topic string, body []byte) error {
+	for { // Retry loop for publishing
+		if b.State() == broker.StateClosed {
+			return broker.ErrClosed
+		}
+
+		pubCtx, cancel := context.WithTimeout(ctx, ConfirmTimeout)
+		_, err := b.js.Publish(pubCtx, subject(topic), body)
+		cancel()
+		if err == nil {
+			return nil // Success!
+		}
+
+		retryable := errors.Is(err, context.DeadlineExceeded) ||
+			errors.Is(err, nats.ErrNoResponders) ||
+			errors.Is(err, nats.ErrTimeout) ||
+			b.State() == broker.StateReconnecting
+		if !retryable {
+			return fmt.Errorf("failed to publish message: %w", err)
+		}
+
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return fmt.Errorf("failed to publish message while reconnecting: %w", ctx.Err())
+		}
+	}
+}
+
+// Subscribe adds the topic to the filter of the consumer of this instance,
+// which is updated shortly after together with the other subscription changes
+func (b *Broker) Subscribe(topic string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return broker.ErrClosed
+	}
+
+	b.topics[topic] = true
+	b.changeFilter()
+
+	return nil
+}
+
+// Unsubscribe removes the topic from the filter of the consumer of this instance,
+// which is updated shortly after together with the other subscription changes
+func (b *Broker) Unsubscribe(topic string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return broker.ErrClosed
+	}
+
+	delete(b.topics, topic)
+	b.changeFilter()
+
+	return nil
+}
+
+// changeFilter wakes up the filter updater, unless an update is already pending
+func (b *Broker) changeFilter() {
+	select {
+	case b.filterChanged <- struct{}{}:
+	default:
+	}
+}
+
+// updateFilter applies the subscription changes to the consumer until the broker is closed.
+// Each change waits for the next ones, so that a burst of changes costs a single update.
+func (b *Broker) updateFilter() {
+	for {
+		select {
+		case <-b.filterChanged:
+		case <-b.done:
+			return
+		}
+
+		select {
+		case <-time.After(filterUpdateDelay):
+		case <-b.done:
+			return
+		}
+
+		err := b.applyFilter()
+		if err != nil {
+			log.Println(err)
+
+			time.AfterFunc(filterRetryDelay, b.changeFilter)
+		}
+	}
+}
+
+// applyFilter filters the consumer of this instance on the subscribed topics, creating
+// the consumer on the first subscription and deleting it once no topic is left
+func (b *Broker) applyFilter() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+
+	subjects := make([]string, 0, len(b.topics))
+	for topic := range b.topics {
+		subjects = append(subjects, subject(topic))
+	}
+	b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// An empty filter would match every topic
+	if len(subjects) == 0 {
+		return b.deleteConsumer(ctx)
+	}
+
+	consumer, err := b.js.CreateOrUpdateConsumer(ctx, StreamName, jetstream.ConsumerConfig{
+		Durable:           b.consumerName,
+		FilterSubjects:    subjects,
+		DeliverPolicy:     jetstream.DeliverNewPolicy,
+		AckPolicy:         jetstream.AckExplicitPolicy,
+		InactiveThreshold: ConsumerExpiry,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update consumer '%s': %w", b.consumerName, err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.consumer == nil && !b.closed {
+		b.consumer = consumer
+		close(b.ready)
+	}
+
+	return nil
+}
+
+// deleteConsumer stops consuming and deletes the consumer of this instance, so that
+// the stream no longer keeps messages for it. Consuming resumes with the next consumer.
+func (b *Broker) deleteConsumer(ctx context.Context) error {
+	b.mu.Lock()
+	if b.consumer == nil {
+		b.mu.Unlock()
+		return nil
+	}
+
+	iterator := b.iterator
+	b.consumer = nil
+	b.iterator = nil
+	b.ready = make(chan struct{})
+	b.mu.Unlock()
+
+	if iterator != nil {
+		iterator.Stop()
+	}
+
+	err := b.js.DeleteConsumer(ctx, StreamName, b.consumerName)
+	if err != nil && !errors.Is(err, jetstream.ErrConsumerNotFound) {
+		return fmt.Errorf("failed to delete consumer '%s': %w", b.consumerName, err)
+	}
+
+	return nil
+}
+
+// Consume returns the messages of the subscribed topics, which must be acknowledged.
+// Messages only flow once the first topic has been subscribed to.
+func (b *Broker) Consume() (<-chan broker.Message, error) {
+	consumed := make(chan struct{})
+
+	b.mu.Lock()
+	b.consumed = consumed
+	b.mu.Unlock()
+
+	messages := make(chan broker.Message)
+	go b.consume(messages, consumed)
+
+	return messages, nil
+}
+
+func (b *Broker) consume(messages chan<- broker.Message, consumed chan<- struct{}) {
+	defer close(consumed)
+	defer close(messages)
+
+	for {
+		iterator := b.nextIterator()
+		if iterator == nil {
+			return
+		}
+
+		b.consumeIterator(iterator, messages)
+	}
+}
+
+// nextIterator waits for the consumer of this instance to exist and starts iterating
+// over its messages. It returns nil once the broker is closed.
+func (b *Broker) nextIterator() jetstream.MessagesContext {
+	for {
+		b.mu.Lock()
+		if b.closed {
+			b.mu.Unlock()
+			return nil
+		}
+
+		if b.consumer == nil {
+			ready := b.ready
+			b.mu.Unlock()
+
+			<-ready
+			continue
+		}
+
+		iterator, err := b.consumer.Messages()
+		if err != nil {
+			b.mu.Unlock()
+			log.Printf("Failed to consume from '%s': %v", b.consumerName, err)
+
+			select {
+			case <-time.After(filterRetryDelay):
+			case <-b.done:
+			}
+			continue
+		}
+		b.iterator = iterator
+		b.mu.Unlock()
+
+		return iterator
+	}
+}
+
+// consumeIterator forwards the messages of the iterator until it is stopped
+func (b *Broker) consumeIterator(iterator jetstream.MessagesContext, messages chan<- broker.Message) {
+	for {
+		msg, err := iterator.Next()
+		if errors.Is(err, jetstream.ErrMsgIteratorClosed) {
+			return
+		}
+		if err != nil {
+			// Missed heartbeats while reconnecting, the iterator recovers on its own
+			log.Printf("Error consuming from '%s': %v", b.consumerName, err)
+			continue
+		}
+
+		redelivered := false
+		metadata, err := msg.Metadata()
+		if err == nil {
+			redelivered = metadata.NumDelivered > 1
+		}
+
+		// A message left unacknowledged on close is delivered again later
+		select {
+		case messages <- broker.Message{
+			Topic:        strings.TrimPrefix(msg.Subject(), SubjectPrefix+"."),
+			Body:         msg.Data(),
+			Redelivered:  redelivered,
+			Acknowledger: msgAcknowledger{msg: msg, js: b.js},
+		}:
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// msgAcknowledger settles a JetStream message. A message rejected without
+// requeueing is copied to the dead letter stream, then terminated.
+type msgAcknowledger struct {
+	msg jetstream.Msg
+	js  jetstream.JetStream
+}
+
+func (a msgAcknowledger) Ack() error {
+	return a.msg.Ack()
+}
+
+func (a msgAcknowledger) Nack(requeue bool) error {
+	if requeue {
+		return a.msg.Nak()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ConfirmTimeout)
+	defer cancel()
+
+	topic := strings.TrimPrefix(a.msg.Subject(), SubjectPrefix+".")
+	_, err := a.js.Publish(ctx, DeadLetterSubjectPrefix+"."+topic, a.msg.Data())
+	if err != nil {
+		// Delivered again, to be dead-lettered on the next failure
+		_ = a.msg.Nak()
+		return fmt.Errorf("failed to dead-letter message: %w", err)
+	}
+
+	return a.msg.Term()
+}
+
+func (b *Broker) State() broker.State {
+	switch b.conn.Status() {
+	case nats.CONNECTED:
+		return broker.StateConnected
+	case nats.CLOSED:
+		return broker.StateClosed
+	default:
+		return broker.StateReconnecting
+	}
+}
+
+// Close stops consuming and closes the connection, ending the message channel returned by Consume
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+
+	b.closed = true
+	close(b.done)
+	if b.consumer == nil {
+		close(b.ready)
+	}
+	iterator := b.iterator
+	consumed := b.consumed
+	b.mu.Unlock()
+
+	// The iterator only ends once it unsubscribed, which needs the connection
+	if iterator != nil {
+		iterator.Stop()
+	}
+	if consumed != nil {
+		select {
+		case <-consumed:
+		case <-time.After(ConfirmTimeout):
+			log.Printf("Timed out waiting for '%s' to stop consuming", b.consumerName)
+		}
+	}
+
+	b.conn.Close()
+
+	return nil
+}
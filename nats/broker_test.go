@@ -0,0 +1,285 @@
+package nats
+
+import (
+	"chat-server/broker"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go/jetstream"
+	"slices"
+	"testing"
+	"time"
+)
+
+const testTimeout = 5 * time.Second
+
+// newTestBroker starts an embedded JetStream server and connects a broker to it
+func newTestBroker(t *testing.T) *Broker {
+	t.Helper()
+
+	natsServer, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create NATS server: %v", err)
+	}
+
+	go natsServer.Start()
+	if !natsServer.ReadyForConnections(testTimeout) {
+		t.Fatal("NATS server did not start")
+	}
+	t.Cleanup(natsServer.Shutdown)
+
+	t.Setenv("NATS_URL", natsServer.ClientURL())
+
+	b, err := New("test")
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+	t.Cleanup(func() { _ = b.Close() })
+
+	return b
+}
+
+// filter returns the topics the consumer of the broker is filtered on, nil without consumer
+func filter(t *testing.T, b *Broker) []string {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	consumer, err := b.js.Consumer(ctx, StreamName, b.consumerName)
+	if errors.Is(err, jetstream.ErrConsumerNotFound) {
+		return nil
+	} else if err != nil {
+		t.Fatalf("failed to look up consumer: %v", err)
+	}
+
+	var topics []string
+	for _, filterSubject := range consumer.CachedInfo().Config.FilterSubjects {
+		topics = append(topics, filterSubject[len(SubjectPrefix)+1:])
+	}
+	slices.Sort(topics)
+
+	return topics
+}
+
+func waitFilter(t *testing.T, b *Broker, topics ...string) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for {
+		current := filter(t, b)
+		if slices.Equal(current, topics) {
+			return
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatalf("consumer filtered on %v; want %v", current, topics)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func publish(t *testing.T, b *Broker, topic string, body string) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	err := b.Publish(ctx, topic, []byte(body))
+	if err != nil {
+		t.Fatalf("Publish() failed: %v", err)
+	}
+}
+
+func receive(t *testing.T, messages <-chan broker.Message) broker.Message {
+	t.Helper()
+
+	select {
+	case message, ok := <-messages:
+		if !ok {
+			t.Fatal("message channel closed")
+		}
+		return message
+	case <-time.After(testTimeout):
+		t.Fatal("no message received")
+	}
+
+	return broker.Message{}
+}
+
+func expectNone(t *testing.T, messages <-chan broker.Message) {
+	t.Helper()
+
+	select {
+	case message := <-messages:
+		t.Fatalf("unexpected message %s on %s", message.Body, message.Topic)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestPublishConsume(t *testing.T) {
+	b := newTestBroker(t)
+
+	messages, err := b.Consume()
+	if err != nil {
+		t.Fatalf("Consume() failed: %v", err)
+	}
+
+	err = b.Subscribe("room1")
+	if err != nil {
+		t.Fatalf("Subscribe() failed: %v", err)
+	}
+	waitFilter(t, b, "room1")
+
+	publish(t, b, "room2", "elsewhere")
+	publish(t, b, "room1", "hello")
+
+	message := receive(t, messages)
+	if message.Topic != "room1" || string(message.Body) != "hello" || message.Redelivered {
+		t.Errorf("received %s on %s, redelivered %v; want a first delivery of hello on room1", message.Body, message.Topic, message.Redelivered)
+	}
+
+	err = message.Ack()
+	if err != nil {
+		t.Fatalf("Ack() failed: %v", err)
+	}
+	expectNone(t, messages)
+
+	err = b.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	select {
+	case _, ok := <-messages:
+		if ok {
+			t.Error("message received after Close()")
+		}
+	case <-time.After(testTimeout):
+		t.Error("message channel still open after Close()")
+	}
+}
+
+// TestBatchedSubscriptions subscribes to many topics at once, the consumer is updated
+// once the burst is over rather than for each topic
+func TestBatchedSubscriptions(t *testing.T) {
+	b := newTestBroker(t)
+
+	var topics []string
+	for i := 0; i < 50; i++ {
+		topic := fmt.Sprintf("room%02d", i)
+		topics = append(topics, topic)
+
+		err := b.Subscribe(topic)
+		if err != nil {
+			t.Fatalf("Subscribe() failed: %v", err)
+		}
+	}
+
+	waitFilter(t, b, topics...)
+
+	// Subscription changes that cancel each other out leave the filter as is
+	_ = b.Subscribe("extra")
+	_ = b.Unsubscribe("extra")
+	time.Sleep(2 * filterUpdateDelay)
+	waitFilter(t, b, topics...)
+}
+
+// TestNackDeadLetter rejects a message twice, it is delivered again
+// after the first rejection and dead-lettered after the second one
+func TestNackDeadLetter(t *testing.T) {
+	b := newTestBroker(t)
+
+	messages, err := b.Consume()
+	if err != nil {
+		t.Fatalf("Consume() failed: %v", err)
+	}
+
+	_ = b.Subscribe("room1")
+	waitFilter(t, b, "room1")
+	publish(t, b, "room1", "poison")
+
+	message := receive(t, messages)
+	if message.Redelivered {
+		t.Error("first delivery marked as redelivered")
+	}
+
+	err = message.Nack()
+	if err != nil {
+		t.Fatalf("Nack() failed: %v", err)
+	}
+
+	message = receive(t, messages)
+	if string(message.Body) != "poison" || !message.Redelivered {
+		t.Fatalf("received %s, redelivered %v; want poison redelivered", message.Body, message.Redelivered)
+	}
+
+	err = message.Nack()
+	if err != nil {
+		t.Fatalf("Nack() failed: %v", err)
+	}
+	expectNone(t, messages)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	stream, err := b.js.Stream(ctx, DeadLetterStreamName)
+	if err != nil {
+		t.Fatalf("failed to look up the dead letter stream: %v", err)
+	}
+
+	deadLetter, err := stream.GetLastMsgForSubject(ctx, DeadLetterSubjectPrefix+".room1")
+	if err != nil {
+		t.Fatalf("no dead-lettered message: %v", err)
+	}
+	if string(deadLetter.Data) != "poison" {
+		t.Errorf("dead-lettered %s; want poison", deadLetter.Data)
+	}
+}
+
+// TestUnsubscribe checks that unsubscribed topics are no longer received, and that
+// the consumer is deleted with the last topic and created again with the next one
+func TestUnsubscribe(t *testing.T) {
+	b := newTestBroker(t)
+
+	messages, err := b.Consume()
+	if err != nil {
+		t.Fatalf("Consume() failed: %v", err)
+	}
+
+	_ = b.Subscribe("room1")
+	_ = b.Subscribe("room2")
+	waitFilter(t, b, "room1", "room2")
+
+	err = b.Unsubscribe("room1")
+	if err != nil {
+		t.Fatalf("Unsubscribe() failed: %v", err)
+	}
+	waitFilter(t, b, "room2")
+
+	publish(t, b, "room1", "gone")
+	expectNone(t, messages)
+
+	_ = b.Unsubscribe("room2")
+	waitFilter(t, b)
+
+	publish(t, b, "room2", "gone too")
+
+	_ = b.Subscribe("room3")
+	waitFilter(t, b, "room3")
+	publish(t, b, "room3", "back")
+
+	message := receive(t, messages)
+	if message.Topic != "room3" || string(message.Body) != "back" {
+		t.Errorf("received %s on %s; want back on room3", message.Body, message.Topic)
+	}
+	_ = message.Ack()
+}
@@ -0,0 +1,121 @@
+package rabbitmq
+
+import (
+	"chat-server/broker"
+	"context"
+	"github.com/rabbitmq/amqp091-go"
+)
+
+// Broker implements broker.Broker on top of RabbitMQ. Topics are routing keys
+// of the topic exchange, bound to the queue of this server instance.
+type Broker struct {
+	rabbitMQ  *RabbitMQ
+	exchange  string
+	queueName string
+}
+
+func NewBroker(rabbitMQ *RabbitMQ, exchange, queueName string) *Broker {
+	return &Broker{
+		rabbitMQ:  rabbitMQ,
+		exchange:  exchange,
+		queueName: queueName,
+	}
+}
+
+func (b *Broker) Publish(ctx context.Context, topic string, body []byte) error {
+	return b.rabbitMQ.Publish(ctx, b.exchange, topic, body)
+}
+
+func (b *Broker) Subscribe(topic string) error {
+	return b.rabbitMQ.Bind(b.exchange, b.queueName, topic)
+}
+
+func (b *Broker) Unsubscribe(topic string) error {
+	return b.rabbitMQ.Unbind(b.exchange, b.queueName, topic)
+}
+
+func (b *Broker) Consume() (<-chan broker.Message, error) {
+	deliveries, err := b.rabbitMQ.Consume(b.exchange, b.queueName)
+	if err != nil {
+		return nil, err
+	}
+
+	messages := make(chan broker.Message)
+	go func() {
+		defer close(messages)
+
+		for delivery := range deliveries {
+			messages <- b.message(delivery)
+		}
+	}()
+
+	return messages, nil
+}
+
+// message maps a delivery to a message. The delivery of a retried message
+// carries its original routing key and its failures in headers.
+func (b *Broker) message(delivery amqp091.Delivery) broker.Message {
+	return broker.Message{
+		Topic:        routingKey(delivery),
+		Body:         delivery.Body,
+		Redelivered:  failures(delivery) > 0,
+		Acknowledger: deliveryAcknowledger{b, delivery},
+	}
+}
+
+func routingKey(delivery amqp091.Delivery) string {
+	if key, ok := delivery.Headers[RoutingKeyHeader].(string); ok {
+		return key
+	}
+
+	return delivery.RoutingKey
+}
+
+func failures(delivery amqp091.Delivery) int {
+	switch count := delivery.Headers[FailuresHeader].(type) {
+	case int32:
+		return int(count)
+	case int64:
+		return int(count)
+	default:
+		return 0
+	}
+}
+
+// deliveryAcknowledger settles a delivery on the channel it was received on
+type deliveryAcknowledger struct {
+	broker   *Broker
+	delivery amqp091.Delivery
+}
+
+func (a deliveryAcknowledger) Ack() error {
+	return a.delivery.Ack(false)
+}
+
+// Nack dead-letters the delivery, or publishes it again with its failure
+// counted and acknowledges it. When publishing fails, it is requeued as is.
+func (a deliveryAcknowledger) Nack(requeue bool) error {
+	if !requeue {
+		return a.delivery.Nack(false, false)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ConfirmTimeout)
+	defer cancel()
+
+	err := a.broker.rabbitMQ.Retry(ctx, a.broker.queueName, a.delivery)
+	if err != nil {
+		return a.delivery.Nack(false, true)
+	}
+
+	return a.delivery.Ack(false)
+}
+
+func (b *Broker) State() broker.State {
+	return b.rabbitMQ.State()
+}
+
+func (b *Broker) Close() error {
+	b.rabbitMQ.Close()
+
+	return nil
+}
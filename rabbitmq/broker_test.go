@@ -0,0 +1,408 @@
+package rabbitmq
+
+import (
+	"chat-server/broker"
+	"context"
+	"errors"
+	"github.com/rabbitmq/amqp091-go"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const testTimeout = 5 * time.Second
+
+// testTopology names the exchanges and queues of a test, removed afterwards
+type testTopology struct {
+	exchange   string
+	deadLetter string
+	queues     []string
+}
+
+func newTestTopology(t *testing.T) *testTopology {
+	t.Helper()
+
+	if os.Getenv("RABBITMQ_URL") == "" {
+		t.Skip("RABBITMQ_URL is not set")
+	}
+
+	suffix := strconv.FormatInt(time.Now().UnixNano(), 36)
+	topology := &testTopology{
+		exchange:   ExchangeName + ".test." + suffix,
+		deadLetter: DeadLetterExchange + ".test." + suffix,
+	}
+
+	t.Cleanup(func() {
+		ch := rawChannel(t)
+		for _, queueName := range append(topology.queues, topology.deadLetter) {
+			_, _ = ch.QueueDelete(queueName, false, false, false)
+		}
+		_ = ch.ExchangeDelete(topology.exchange, false, false)
+		_ = ch.ExchangeDelete(topology.deadLetter, false, false)
+	})
+
+	return topology
+}
+
+// newTestBroker connects an instance to RabbitMQ, declaring the topology as main does
+func (topology *testTopology) newTestBroker(t *testing.T, instanceID string) *Broker {
+	t.Helper()
+
+	rmq, err := New()
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+	t.Cleanup(rmq.Close)
+
+	err = rmq.DeclareExchange(topology.exchange)
+	if err != nil {
+		t.Fatalf("DeclareExchange() failed: %v", err)
+	}
+
+	err = rmq.DeclareDeadLetter(topology.deadLetter)
+	if err != nil {
+		t.Fatalf("DeclareDeadLetter() failed: %v", err)
+	}
+
+	queueName := InstanceQueueName(instanceID + "." + topology.exchange)
+	topology.queues = append(topology.queues, queueName)
+
+	return NewBroker(rmq, topology.exchange, queueName)
+}
+
+// rawChannel opens a channel outside of the supervised connections, to inspect the broker
+func rawChannel(t *testing.T) *amqp091.Channel {
+	t.Helper()
+
+	conn, err := amqp091.Dial(os.Getenv("RABBITMQ_URL"))
+	if err != nil {
+		t.Fatalf("failed to connect to RabbitMQ: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatalf("failed to open a channel: %v", err)
+	}
+
+	return ch
+}
+
+func consume(t *testing.T, b *Broker) <-chan broker.Message {
+	t.Helper()
+
+	messages, err := b.Consume()
+	if err != nil {
+		t.Fatalf("Consume() failed: %v", err)
+	}
+
+	return messages
+}
+
+func subscribe(t *testing.T, b *Broker, topics ...string) {
+	t.Helper()
+
+	for _, topic := range topics {
+		err := b.Subscribe(topic)
+		if err != nil {
+			t.Fatalf("Subscribe(%s) failed: %v", topic, err)
+		}
+	}
+}
+
+func publishMessage(t *testing.T, b *Broker, topic string, body string) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	err := b.Publish(ctx, topic, []byte(body))
+	if err != nil {
+		t.Fatalf("Publish() failed: %v", err)
+	}
+}
+
+func receive(t *testing.T, messages <-chan broker.Message) broker.Message {
+	t.Helper()
+
+	select {
+	case message, ok := <-messages:
+		if !ok {
+			t.Fatal("message channel closed")
+		}
+		return message
+	case <-time.After(testTimeout):
+		t.Fatal("no message received")
+	}
+
+	return broker.Message{}
+}
+
+// expectMessage receives the message and acknowledges it
+func expectMessage(t *testing.T, messages <-chan broker.Message, topic, body string) {
+	t.Helper()
+
+	message := receive(t, messages)
+	if message.Topic != topic || string(message.Body) != body {
+		t.Fatalf("received %s on %s; want %s on %s", message.Body, message.Topic, body, topic)
+	}
+
+	err := message.Ack()
+	if err != nil {
+		t.Fatalf("Ack() failed: %v", err)
+	}
+}
+
+func expectNone(t *testing.T, messages <-chan broker.Message) {
+	t.Helper()
+
+	select {
+	case message := <-messages:
+		t.Fatalf("unexpected message %s on %s", message.Body, message.Topic)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+// eventually polls the condition until it holds, failing the test after the timeout
+func eventually(t *testing.T, condition func() bool, format string, args ...any) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting: "+format, args...)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// expectDeadLetter waits for the message in the dead letter queue
+func expectDeadLetter(t *testing.T, ch *amqp091.Channel, queueName, topic, body string) {
+	t.Helper()
+
+	var deadLetter amqp091.Delivery
+	eventually(t, func() bool {
+		delivery, ok, err := ch.Get(queueName, true)
+		if err != nil {
+			t.Fatalf("failed to get from %s: %v", queueName, err)
+		}
+		deadLetter = delivery
+
+		return ok
+	}, "dead letter of %s", body)
+
+	if routingKey(deadLetter) != topic || string(deadLetter.Body) != body {
+		t.Errorf("dead-lettered %s on %s; want %s on %s", deadLetter.Body, routingKey(deadLetter), body, topic)
+	}
+}
+
+// TestInstances runs two instances with their own queue on the same exchange,
+// each one only receives the rooms it subscribed to and every presence change
+func TestInstances(t *testing.T) {
+	topology := newTestTopology(t)
+	a := topology.newTestBroker(t, "a")
+	b := topology.newTestBroker(t, "b")
+	messagesA := consume(t, a)
+	messagesB := consume(t, b)
+
+	subscribe(t, a, broker.PresenceTopic, "room1")
+	subscribe(t, b, broker.PresenceTopic, "room1", "room2")
+
+	publishMessage(t, a, "room1", "hello")
+	expectMessage(t, messagesA, "room1", "hello")
+	expectMessage(t, messagesB, "room1", "hello")
+
+	publishMessage(t, a, "room2", "only b")
+	expectMessage(t, messagesB, "room2", "only b")
+	expectNone(t, messagesA)
+
+	publishMessage(t, b, broker.PresenceTopic, "online")
+	expectMessage(t, messagesA, broker.PresenceTopic, "online")
+	expectMessage(t, messagesB, broker.PresenceTopic, "online")
+
+	err := b.Unsubscribe("room1")
+	if err != nil {
+		t.Fatalf("Unsubscribe() failed: %v", err)
+	}
+
+	publishMessage(t, b, "room1", "only a")
+	expectMessage(t, messagesA, "room1", "only a")
+	expectNone(t, messagesB)
+
+	// The queue of an instance expires and dead-letters, re-declaring it
+	// without these arguments is refused
+	ch := rawChannel(t)
+	_, err = ch.QueueDeclare(a.queueName, false, false, false, false, nil)
+	var amqpErr *amqp091.Error
+	if !errors.As(err, &amqpErr) || amqpErr.Code != amqp091.PreconditionFailed {
+		t.Errorf("QueueDeclare() without arguments = %v; want %d PRECONDITION_FAILED", err, amqp091.PreconditionFailed)
+	}
+}
+
+// TestNackDeadLetter rejects a message twice, it is delivered again after the
+// first rejection and dead-lettered after the second one
+func TestNackDeadLetter(t *testing.T) {
+	topology := newTestTopology(t)
+	b := topology.newTestBroker(t, "a")
+	messages := consume(t, b)
+	subscribe(t, b, "room1")
+
+	publishMessage(t, b, "room1", "poison")
+
+	message := receive(t, messages)
+	if message.Redelivered {
+		t.Error("first delivery marked as redelivered")
+	}
+
+	err := message.Nack()
+	if err != nil {
+		t.Fatalf("Nack() failed: %v", err)
+	}
+
+	message = receive(t, messages)
+	if message.Topic != "room1" || string(message.Body) != "poison" || !message.Redelivered {
+		t.Fatalf("received %s on %s, redelivered %v; want poison redelivered on room1", message.Body, message.Topic, message.Redelivered)
+	}
+
+	err = message.Nack()
+	if err != nil {
+		t.Fatalf("Nack() failed: %v", err)
+	}
+	expectNone(t, messages)
+
+	expectDeadLetter(t, rawChannel(t), topology.deadLetter, "room1", "poison")
+}
+
+// TestMessage maps deliveries to messages, only the deliveries that failed
+// before are redelivered messages
+func TestMessage(t *testing.T) {
+	tests := []struct {
+		name        string
+		delivery    amqp091.Delivery
+		topic       string
+		redelivered bool
+	}{
+		{"first delivery", amqp091.Delivery{RoutingKey: "room1"}, "room1", false},
+		{"requeued after a connection loss", amqp091.Delivery{RoutingKey: "room1", Redelivered: true}, "room1", false},
+		{"retried", amqp091.Delivery{
+			RoutingKey: "message.a",
+			Headers:    amqp091.Table{FailuresHeader: int32(1), RoutingKeyHeader: "room1"},
+		}, "room1", true},
+		{"retried with a wide counter", amqp091.Delivery{
+			RoutingKey: "message.a",
+			Headers:    amqp091.Table{FailuresHeader: int64(1), RoutingKeyHeader: "room1"},
+		}, "room1", true},
+	}
+
+	b := NewBroker(nil, ExchangeName, InstanceQueueName("a"))
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := b.message(test.delivery)
+			if message.Topic != test.topic || message.Redelivered != test.redelivered {
+				t.Errorf("message() = %s, redelivered %v; want %s, redelivered %v", message.Topic, message.Redelivered, test.topic, test.redelivered)
+			}
+		})
+	}
+}
+
+// TestPublishWhileReconnecting publishes while the connection is lost, the
+// publish gives up when its context expires and fails at once after Close()
+func TestPublishWhileReconnecting(t *testing.T) {
+	r := &RabbitMQ{state: broker.StateReconnecting, reconnected: make(chan struct{})}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	err := r.Publish(ctx, ExchangeName, "room1", []byte("hello"))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Publish() while reconnecting = %v; want the context deadline", err)
+	}
+
+	r.mu.Lock()
+	r.state = broker.StateClosed
+	close(r.reconnected)
+	r.mu.Unlock()
+
+	err = r.Publish(context.Background(), ExchangeName, "room1", []byte("hello"))
+	if !errors.Is(err, broker.ErrClosed) {
+		t.Errorf("Publish() after Close() = %v; want %v", err, broker.ErrClosed)
+	}
+}
+
+// TestPublishRejected publishes to a full queue refusing new messages, the
+// broker does not confirm the message and the publish fails
+func TestPublishRejected(t *testing.T) {
+	topology := newTestTopology(t)
+	b := topology.newTestBroker(t, "a")
+
+	queueName := "full." + topology.exchange
+	topology.queues = append(topology.queues, queueName)
+
+	ch := rawChannel(t)
+	_, err := ch.QueueDeclare(queueName, false, false, false, false, amqp091.Table{
+		"x-max-length": int32(0),
+		"x-overflow":   "reject-publish",
+	})
+	if err != nil {
+		t.Fatalf("failed to declare the full queue: %v", err)
+	}
+
+	err = ch.QueueBind(queueName, "room1", topology.exchange, false, nil)
+	if err != nil {
+		t.Fatalf("failed to bind the full queue: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	err = b.Publish(ctx, "room1", []byte("hello"))
+	if err == nil {
+		t.Error("Publish() to a full queue succeeded; want the message rejected")
+	}
+}
+
+// TestReconnect drops the connection while a message is being processed, the
+// message is delivered again without counting as a failure, so that it is
+// retried once before being dead-lettered, and the bindings are restored
+func TestReconnect(t *testing.T) {
+	topology := newTestTopology(t)
+	b := topology.newTestBroker(t, "a")
+	messages := consume(t, b)
+	subscribe(t, b, "room1")
+
+	publishMessage(t, b, "room1", "in flight")
+	receive(t, messages)
+
+	b.rabbitMQ.mu.RLock()
+	conn := b.rabbitMQ.conn
+	b.rabbitMQ.mu.RUnlock()
+	_ = conn.Close()
+
+	message := receive(t, messages)
+	if message.Topic != "room1" || string(message.Body) != "in flight" || message.Redelivered {
+		t.Fatalf("received %s on %s, redelivered %v; want in flight on room1, not failed before", message.Body, message.Topic, message.Redelivered)
+	}
+	eventually(t, func() bool { return b.State() == broker.StateConnected }, "connected state")
+
+	err := message.Nack()
+	if err != nil {
+		t.Fatalf("Nack() failed: %v", err)
+	}
+
+	message = receive(t, messages)
+	if message.Topic != "room1" || string(message.Body) != "in flight" || !message.Redelivered {
+		t.Fatalf("received %s on %s, redelivered %v; want in flight retried on room1", message.Body, message.Topic, message.Redelivered)
+	}
+
+	err = message.Nack()
+	if err != nil {
+		t.Fatalf("Nack() failed: %v", err)
+	}
+	expectDeadLetter(t, rawChannel(t), topology.deadLetter, "room1", "in flight")
+
+	publishMessage(t, b, "room1", "after")
+	expectMessage(t, messages, "room1", "after")
+	expectNone(t, messages)
+}
@@ -1,23 +1,76 @@
 package rabbitmq
 
 import (
+	"chat-server/broker"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/rabbitmq/amqp091-go"
 	"log"
 	"math/rand"
 	"os"
+	"sync"
 	"time"
 )
 
 const (
-	ExchangeName = "chat_messages"
+	// ExchangeName is a topic exchange, messages are routed by their room ID.
+	// The previous fanout exchange was named chat_messages.
+	ExchangeName = "chat_rooms"
 	QueueName    = "message"
+
+	// QueueExpiry is how long the queue of an instance outlives the instance,
+	// so that deliveries are kept for an instance that is reconnecting
+	QueueExpiry = time.Minute
+
+	// DeadLetterExchange receives the deliveries that repeatedly failed to be
+	// processed. They are kept in the queue of the same name for inspection.
+	DeadLetterExchange = "chat_rooms.dead"
+
+	// FailuresHeader counts the failed processings of a retried delivery, and
+	// RoutingKeyHeader keeps its original routing key
+	FailuresHeader   = "x-failures"
+	RoutingKeyHeader = "x-routing-key"
+
+	// ConfirmTimeout is how long a publish waits for the broker to confirm the message
+	ConfirmTimeout = 5 * time.Second
+
+	// maxBackoff caps the wait between two connection attempts
+	maxBackoff = 30 * time.Second
+
+	// prefetchCount limits the deliveries not acknowledged yet
+	prefetchCount = 100
 )
 
+// RabbitMQ is a supervised connection to RabbitMQ. When the connection or
+// channel is lost, it reconnects with backoff and restores the declared
+// exchanges, queues, bindings and consumers.
 type RabbitMQ struct {
-	conn    *amqp091.Connection
-	channel *amqp091.Channel
+	uri string
+
+	mu          sync.RWMutex
+	conn        *amqp091.Connection
+	channel     *amqp091.Channel
+	state       broker.State
+	reconnected chan struct{} // Closed and replaced after every reconnection
+
+	// Topology restored after a reconnection
+	exchanges map[string]string // Kind by exchange name
+	queues    map[string]queueOptions
+	bindings  map[binding]bool
+
+	deadLetterExchange string
+}
+
+type queueOptions struct {
+	durable bool
+	args    amqp091.Table
+}
+
+type binding struct {
+	exchange   string
+	queueName  string
+	routingKey string
 }
 
 func New() (*RabbitMQ, error) {
@@ -26,46 +79,257 @@ func New() (*RabbitMQ, error) {
 		log.Fatal("RABBITMQ_URL environment variable not set")
 	}
 
+	r := &RabbitMQ{
+		uri:         uri,
+		state:       broker.StateReconnecting,
+		reconnected: make(chan struct{}),
+		exchanges:   make(map[string]string),
+		queues:      make(map[string]queueOptions),
+		bindings:    make(map[binding]bool),
+	}
+
+	err := r.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	go r.supervise()
+
+	return r, nil
+}
+
+// connect dials RabbitMQ until it succeeds and opens the channel
+func (r *RabbitMQ) connect() error {
 	for attempts := 1; ; attempts++ {
-		conn, err := amqp091.Dial(uri)
+		conn, err := amqp091.Dial(r.uri)
 		if err == nil {
-			ch, err := conn.Channel()
+			ch, err := openChannel(conn)
 
 			if err != nil {
 				// Close connection on channel error
 				err := conn.Close()
 				if err != nil {
-					return nil, fmt.Errorf("failed to close RabbitMQ connection: %w", err)
+					return fmt.Errorf("failed to close RabbitMQ connection: %w", err)
 				}
 
-				return nil, fmt.Errorf("failed to open RabbitMQ channel: %w", err)
+				return fmt.Errorf("failed to open RabbitMQ channel: %w", err)
 			}
 
-			return &RabbitMQ{conn: conn, channel: ch}, nil
+			r.mu.Lock()
+			r.conn = conn
+			r.channel = ch
+			r.mu.Unlock()
+
+			return nil
 		}
 
-		waitTime := time.Duration(attempts*5) * time.Second // Adjust backoff
+		waitTime := min(time.Duration(attempts*5)*time.Second, maxBackoff) // Adjust backoff
 		log.Printf("Connection failed. Retrying in %v (attempt %d): %v", waitTime, attempts, err)
 		time.Sleep(waitTime + time.Duration(rand.Intn(1000))*time.Millisecond) // Add jitter
 	}
 }
 
+// openChannel opens a channel in confirm mode, so that every publish is confirmed by the broker
+func openChannel(conn *amqp091.Connection) (*amqp091.Channel, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	err = ch.Confirm(false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+
+	err = ch.Qos(prefetchCount, 0, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set prefetch count: %w", err)
+	}
+
+	return ch, nil
+}
+
+// supervise waits for the connection or channel to close and reconnects,
+// until the RabbitMQ instance is closed
+func (r *RabbitMQ) supervise() {
+	err := r.restore()
+	if err != nil {
+		return
+	}
+
+	for {
+		r.mu.RLock()
+		conn := r.conn
+		ch := r.channel
+		r.mu.RUnlock()
+
+		connClosed := conn.NotifyClose(make(chan *amqp091.Error, 1))
+		channelClosed := ch.NotifyClose(make(chan *amqp091.Error, 1))
+
+		var closeErr *amqp091.Error
+		select {
+		case closeErr = <-connClosed:
+		case closeErr = <-channelClosed:
+		}
+
+		if r.State() == broker.StateClosed {
+			return
+		}
+
+		log.Printf("RabbitMQ connection lost, reconnecting: %v", closeErr)
+		r.mu.Lock()
+		r.state = broker.StateReconnecting
+		r.mu.Unlock()
+
+		// The channel can close on its own, e.g. on a failed bind
+		_ = conn.Close()
+
+		for {
+			err = r.connect()
+			if err == nil {
+				err = r.restore()
+			}
+			if err == nil {
+				break
+			}
+			if errors.Is(err, broker.ErrClosed) {
+				return
+			}
+
+			log.Println("failed to restore RabbitMQ connection: ", err)
+			r.mu.RLock()
+			_ = r.conn.Close()
+			r.mu.RUnlock()
+			time.Sleep(time.Second)
+		}
+
+		log.Println("RabbitMQ connection restored")
+	}
+}
+
+// restore re-declares the topology on the new channel, then marks the
+// connection usable and wakes up everyone waiting for it. The lock is held
+// throughout, so that no binding made meanwhile is missed.
+func (r *RabbitMQ) restore() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.state == broker.StateClosed {
+		// Closed while reconnecting
+		_ = r.conn.Close()
+		return broker.ErrClosed
+	}
+
+	for exchange, kind := range r.exchanges {
+		err := declareExchange(r.channel, exchange, kind)
+		if err != nil {
+			return fmt.Errorf("failed to re-declare exchange: %w", err)
+		}
+	}
+
+	for queueName, opts := range r.queues {
+		err := declareQueue(r.channel, queueName, opts)
+		if err != nil {
+			return fmt.Errorf("failed to re-declare queue: %w", err)
+		}
+	}
+
+	for b := range r.bindings {
+		err := r.channel.QueueBind(b.queueName, b.routingKey, b.exchange, false, nil)
+		if err != nil {
+			return fmt.Errorf("failed to re-bind '%s' to queue: %w", b.routingKey, err)
+		}
+	}
+
+	r.state = broker.StateConnected
+	close(r.reconnected)
+	r.reconnected = make(chan struct{})
+
+	return nil
+}
+
+// State reports whether the connection is usable
+func (r *RabbitMQ) State() broker.State {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.state
+}
+
 func (r *RabbitMQ) Close() {
-	err := r.channel.Close()
+	r.mu.Lock()
+	if r.state == broker.StateClosed {
+		r.mu.Unlock()
+		return
+	}
+
+	r.state = broker.StateClosed
+	close(r.reconnected) // Release everyone waiting for a reconnection
+	conn := r.conn
+	ch := r.channel
+	r.mu.Unlock()
+
+	err := ch.Close()
 	if err != nil {
 		return
 	}
 
-	err = r.conn.Close()
+	err = conn.Close()
 	if err != nil {
 		return
 	}
 }
 
+// current returns the channel in use together with the signal of the next reconnection
+func (r *RabbitMQ) current() (*amqp091.Channel, broker.State, <-chan struct{}) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.channel, r.state, r.reconnected
+}
+
 func (r *RabbitMQ) DeclareExchange(name string) error {
-	return r.channel.ExchangeDeclare(
+	return r.declareExchange(name, "topic")
+}
+
+// DeclareDeadLetter declares the exchange receiving the rejected deliveries of
+// the queues consumed afterwards, along with a durable queue keeping them
+func (r *RabbitMQ) DeclareDeadLetter(name string) error {
+	err := r.declareExchange(name, "fanout")
+	if err != nil {
+		return fmt.Errorf("failed to declare dead letter exchange: %w", err)
+	}
+
+	err = r.declareQueue(name, queueOptions{durable: true})
+	if err != nil {
+		return fmt.Errorf("failed to declare dead letter queue: %w", err)
+	}
+
+	err = r.Bind(name, name, "")
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.deadLetterExchange = name
+	r.mu.Unlock()
+
+	return nil
+}
+
+func (r *RabbitMQ) declareExchange(name, kind string) error {
+	r.mu.Lock()
+	r.exchanges[name] = kind
+	ch := r.channel
+	r.mu.Unlock()
+
+	return declareExchange(ch, name, kind)
+}
+
+func declareExchange(ch *amqp091.Channel, name, kind string) error {
+	return ch.ExchangeDeclare(
 		name,
-		"fanout", // exchange type
+		kind, // exchange type
 		true,
 		false,
 		false,
@@ -74,80 +338,215 @@ func (r *RabbitMQ) DeclareExchange(name string) error {
 	)
 }
 
+func (r *RabbitMQ) declareQueue(queueName string, opts queueOptions) error {
+	r.mu.Lock()
+	r.queues[queueName] = opts
+	ch := r.channel
+	r.mu.Unlock()
+
+	return declareQueue(ch, queueName, opts)
+}
+
+func declareQueue(ch *amqp091.Channel, queueName string, opts queueOptions) error {
+	_, err := ch.QueueDeclare(queueName, opts.durable, false, false, false, opts.args)
+
+	return err
+}
+
+// Publish sends the message and waits for the broker to confirm it. When the
+// connection is lost before the confirmation, the message is published again
+// once reconnected, for as long as the context allows.
 func (r *RabbitMQ) Publish(ctx context.Context, exchange, routingKey string, body []byte) error {
+	return r.send(ctx, exchange, routingKey, amqp091.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp091.Persistent,
+		Body:         body,
+	})
+}
+
+// Retry publishes a delivery that failed to be processed again, at the back of
+// the queue it was consumed from, with its failures counted in a header.
+// Deliveries requeued by RabbitMQ after a connection loss are flagged as
+// redelivered too, although they did not fail.
+func (r *RabbitMQ) Retry(ctx context.Context, queueName string, delivery amqp091.Delivery) error {
+	return r.send(ctx, "", queueName, amqp091.Publishing{
+		ContentType:  delivery.ContentType,
+		DeliveryMode: delivery.DeliveryMode,
+		Headers: amqp091.Table{
+			FailuresHeader:   int32(failures(delivery) + 1),
+			RoutingKeyHeader: routingKey(delivery),
+		},
+		Body: delivery.Body,
+	})
+}
+
+// send publishes the message until it is confirmed, reconnecting as needed
+func (r *RabbitMQ) send(ctx context.Context, exchange, routingKey string, msg amqp091.Publishing) error {
 	for { // Retry loop for publishing
-		if err := r.channel.PublishWithContext(
-			ctx,
-			exchange,
-			routingKey,
-			false,
-			false,
-			amqp091.Publishing{
-				ContentType: "application/json",
-				Body:        body,
-			},
-		); err != nil {
-			r.Close()
-			r, err = New() // Attempt to reconnect
-			if err != nil {
-				return fmt.Errorf("failed to reconnect for publishing: %w", err)
+		ch, state, reconnected := r.current()
+		if state == broker.StateClosed {
+			return broker.ErrClosed
+		}
+
+		if state == broker.StateConnected {
+			confirmed, err := publish(ctx, ch, exchange, routingKey, msg)
+			if confirmed {
+				return nil // Success!
+			}
+
+			if err != nil && !errors.Is(err, amqp091.ErrClosed) {
+				return err
 			}
+		}
 
-			time.Sleep(1 * time.Second) // Example: 1-second delay
-		} else {
-			return nil // Success!
+		select {
+		case <-reconnected:
+		case <-ctx.Done():
+			return fmt.Errorf("failed to publish message while reconnecting: %w", ctx.Err())
 		}
 	}
 }
 
-func (r *RabbitMQ) Consume(exchange, queueName string) (<-chan amqp091.Delivery, error) {
-	// Declare the queue
-	_, err := r.channel.QueueDeclare(queueName, true, false, false, false, nil)
+// publish sends the message on the channel and waits for its confirmation.
+// It returns amqp091.ErrClosed when the channel closed before the confirmation.
+func publish(ctx context.Context, ch *amqp091.Channel, exchange, routingKey string, msg amqp091.Publishing) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, ConfirmTimeout)
+	defer cancel()
+
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(
+		ctx,
+		exchange,
+		routingKey,
+		false,
+		false,
+		msg,
+	)
 	if err != nil {
-		return nil, fmt.Errorf("failed to declare queue: %w", err)
+		if errors.Is(err, amqp091.ErrClosed) {
+			return false, err
+		}
+
+		return false, fmt.Errorf("failed to publish message: %w", err)
+	}
+
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return false, fmt.Errorf("message was not confirmed by the broker: %w", err)
+	}
+
+	if !acked {
+		if ch.IsClosed() {
+			return false, amqp091.ErrClosed
+		}
+
+		return false, errors.New("message was rejected by the broker")
+	}
+
+	return true, nil
+}
+
+// InstanceQueueName returns the name of the queue of a server instance. Every
+// instance consumes from its own queue, bound to the rooms of its clients,
+// so that all instances receive the messages of their rooms instead of
+// sharing a single queue.
+func InstanceQueueName(instanceID string) string {
+	return QueueName + "." + instanceID
+}
+
+// instanceQueueArgs lets the broker delete the queue of an instance that is gone,
+// and dead-letter the deliveries rejected by the instance
+func instanceQueueArgs(deadLetterExchange string) amqp091.Table {
+	args := amqp091.Table{"x-expires": QueueExpiry.Milliseconds()}
+	if deadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = deadLetterExchange
+	}
+
+	return args
+}
+
+// Bind routes the messages published with the routing key to the queue.
+// The binding is restored after a reconnection.
+func (r *RabbitMQ) Bind(exchange, queueName, routingKey string) error {
+	r.mu.Lock()
+	r.bindings[binding{exchange, queueName, routingKey}] = true
+	ch, state := r.channel, r.state
+	r.mu.Unlock()
+
+	if state != broker.StateConnected {
+		return nil // Applied once reconnected
+	}
+
+	err := ch.QueueBind(queueName, routingKey, exchange, false, nil)
+	if err != nil && !errors.Is(err, amqp091.ErrClosed) {
+		return fmt.Errorf("failed to bind '%s' to queue: %w", routingKey, err)
 	}
 
-	// Bind the queue to the exchange
-	if err := r.channel.QueueBind(queueName, "", exchange, false, nil); err != nil {
-		return nil, fmt.Errorf("failed to bind queue to exchange: %w", err)
+	return nil
+}
+
+// Unbind stops routing the messages published with the routing key to the queue
+func (r *RabbitMQ) Unbind(exchange, queueName, routingKey string) error {
+	r.mu.Lock()
+	delete(r.bindings, binding{exchange, queueName, routingKey})
+	ch, state := r.channel, r.state
+	r.mu.Unlock()
+
+	if state != broker.StateConnected {
+		return nil // Not restored once reconnected
 	}
 
-	// Consume messages from the queue
-	msgs, err := r.channel.Consume(queueName, "", true, false, false, false, nil)
+	err := ch.QueueUnbind(queueName, routingKey, exchange, nil)
+	if err != nil && !errors.Is(err, amqp091.ErrClosed) {
+		return fmt.Errorf("failed to unbind '%s' from queue: %w", routingKey, err)
+	}
+
+	return nil
+}
+
+// Consume declares the queue and returns its deliveries, which must be acknowledged.
+// The returned channel survives reconnections and is only closed when the
+// RabbitMQ instance is closed. Deliveries not acknowledged before a connection
+// loss are delivered again.
+func (r *RabbitMQ) Consume(exchange, queueName string) (<-chan amqp091.Delivery, error) {
+	r.mu.RLock()
+	args := instanceQueueArgs(r.deadLetterExchange)
+	r.mu.RUnlock()
+
+	// Declare the queue
+	err := r.declareQueue(queueName, queueOptions{args: args})
 	if err != nil {
-		return nil, fmt.Errorf("failed to consume messages: %w", err)
+		return nil, fmt.Errorf("failed to declare queue: %w", err)
 	}
 
-	// Reconnection Logic
-	for {
-		select {
-		case _, ok := <-msgs:
-			if !ok {
-				// Channel closed, likely due to connection loss
-				r.Close()
-				r, err = New() // Attempt to reconnect
-				if err != nil {
-					return nil, fmt.Errorf("failed to reconnect: %w", err)
-				}
+	deliveries := make(chan amqp091.Delivery)
+	go r.consume(queueName, deliveries)
 
-				// Re-declare queue and re-bind
-				_, err = r.channel.QueueDeclare(queueName, true, false, false, false, nil)
-				if err != nil {
-					return nil, fmt.Errorf("failed to re-declare queue: %w", err)
-				}
-				err = r.channel.QueueBind(queueName, "", exchange, false, nil)
-				if err != nil {
-					return nil, fmt.Errorf("failed to re-bind queue: %w", err)
-				}
+	return deliveries, nil
+}
 
-				// Retry Consume
-				msgs, err = r.channel.Consume(queueName, "", true, false, false, false, nil)
-				if err != nil {
-					log.Printf("Failed to consume after reconnection: %v. Retrying...", err)
-				}
+// consume forwards the deliveries of the queue, re-establishing the consumer after every reconnection
+func (r *RabbitMQ) consume(queueName string, deliveries chan<- amqp091.Delivery) {
+	defer close(deliveries)
+
+	for {
+		ch, state, reconnected := r.current()
+		if state == broker.StateClosed {
+			return
+		}
+
+		if state == broker.StateConnected {
+			// Consume messages from the queue
+			msgs, err := ch.Consume(queueName, "", false, false, false, false, nil)
+			if err != nil {
+				log.Printf("Failed to consume from '%s': %v. Retrying after reconnection...", queueName, err)
 			} else {
-				return msgs, nil // Successful consumption
+				// Ends when the channel closes, likely due to connection loss
+				for msg := range msgs {
+					deliveries <- msg
+				}
 			}
 		}
+
+		<-reconnected
 	}
 }
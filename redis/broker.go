@@ -0,0 +1,451 @@
+package redis
+
+import (
+	"chat-server/broker"
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ChannelPrefix prefixes the Pub/Sub channel of a topic, used for live fan-out
+	ChannelPrefix = "chat_rooms."
+	// StreamPrefix prefixes the stream of a topic, from which missed messages are replayed
+	StreamPrefix = "chat_rooms:"
+	// DeadLetterStream keeps the messages that repeatedly failed to be processed
+	DeadLetterStream = "chat_rooms_dead"
+
+	// StreamMaxLen is roughly how many messages are kept for replay per topic
+	StreamMaxLen = 1000
+	// StreamExpiry is how long the stream of a topic is kept after its last message
+	StreamExpiry = time.Hour
+
+	// ConfirmTimeout is how long a publish waits for Redis to store the message
+	ConfirmTimeout = 5 * time.Second
+
+	// replayBatchSize is how many stream entries are read at once while replaying
+	replayBatchSize = 200
+	// retryBufferSize is how many rejected messages can wait to be delivered again
+	retryBufferSize = 64
+	// stateCheckInterval is how often Redis is pinged to refresh the state of the connection
+	stateCheckInterval = 5 * time.Second
+)
+
+// publishScript appends the message to the stream of the topic and announces it
+// on the channel of the topic, prefixed with its stream entry ID, atomically
+var publishScript = redis.NewScript(`
+local id = redis.call('XADD', KEYS[1], 'MAXLEN', '~', ARGV[3], '*', 'body', ARGV[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+redis.call('PUBLISH', ARGV[2], id .. ' ' .. ARGV[1])
+return id
+`)
+
+// Broker implements broker.Broker on top of Redis. Messages are fanned out live
+// over Pub/Sub and kept in a stream per topic. When the Pub/Sub connection is
+// lost, the messages published in the meantime are replayed from the streams
+// once it is re-established, so that no message is missed.
+type Broker struct {
+	client *redis.Client
+	pubSub *redis.PubSub
+
+	mu     sync.Mutex
+	lastID map[string]string // Stream entry ID of the last message forwarded, by topic
+	state  broker.State
+
+	retries chan broker.Message // Rejected messages to deliver again
+	done    chan struct{}       // Closed with the broker
+}
+
+func New() (*Broker, error) {
+	url := os.Getenv("REDIS_URL")
+	if url == "" {
+		log.Fatal("REDIS_URL environment variable not set")
+	}
+
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+
+	client := redis.NewClient(opts)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err = client.Ping(ctx).Err()
+	if err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("failed to connect to Redis: %w", err)
+	}
+
+	b := &Broker{
+		client:  client,
+		pubSub:  client.Subscribe(context.Background()),
+		lastID:  make(map[string]string),
+		state:   broker.StateConnected,
+		retries: make(chan broker.Message, retryBufferSize),
+		done:    make(chan struct{}),
+	}
+	go b.checkState()
+
+	return b, nil
+}
+
+// Publish stores the message in the stream of the topic and fans it out. It returns
+// once Redis replied, retrying while Redis is unreachable for as long as the context allows.
+func (b *Broker) Publish(ctx context.Context, topic string, body []byte) error {
+	for { // Retry loop for publishing
+		if b.isClosed() {
+			return broker.ErrClosed
+		}
+
+		pubCtx, cancel := context.WithTimeout(ctx, ConfirmTimeout)
+		err := publishScript.Run(
+			pubCtx,
+			b.client,
+			[]string{StreamPrefix + topic},
+			body,
+			ChannelPrefix+topic,
+			StreamMaxLen,
+			StreamExpiry.Milliseconds(),
+		).Err()
+		cancel()
+		if err == nil {
+			b.setState(broker.StateConnected)
+			return nil // Success!
+		}
+
+		if errors.Is(err, redis.ErrClosed) {
+			return broker.ErrClosed
+		}
+
+		// Errors replied by Redis, e.g. a script error, are not retried
+		var redisErr redis.Error
+		if errors.As(err, &redisErr) {
+			return fmt.Errorf("failed to publish message: %w", err)
+		}
+		b.setState(broker.StateReconnecting)
+
+		select {
+		case <-time.After(time.Second):
+		case <-ctx.Done():
+			return fmt.Errorf("failed to publish message while reconnecting: %w", err)
+		}
+	}
+}
+
+// Subscribe starts forwarding the messages of the topic published from now on
+func (b *Broker) Subscribe(topic string) error {
+	b.mu.Lock()
+	if b.state == broker.StateClosed {
+		b.mu.Unlock()
+		return broker.ErrClosed
+	}
+	_, subscribed := b.lastID[topic]
+	b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if !subscribed {
+		lastID, err := b.lastStreamID(ctx, topic)
+		if err != nil {
+			return fmt.Errorf("failed to subscribe to '%s': %w", topic, err)
+		}
+
+		b.mu.Lock()
+		_, subscribed = b.lastID[topic]
+		if !subscribed {
+			b.lastID[topic] = lastID
+		}
+		b.mu.Unlock()
+	}
+
+	err := b.pubSub.Subscribe(ctx, ChannelPrefix+topic)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to '%s': %w", topic, err)
+	}
+
+	return nil
+}
+
+// lastStreamID returns the ID of the newest entry of the topic's stream, the messages
+// published from now on come after it. IDs are generated by Redis, so unlike the local
+// clock this holds whatever the clock skew between Redis and this instance.
+func (b *Broker) lastStreamID(ctx context.Context, topic string) (string, error) {
+	entries, err := b.client.XRevRangeN(ctx, StreamPrefix+topic, "+", "-", 1).Result()
+	if err != nil {
+		return "", err
+	}
+
+	// Without stream, every entry added from now on is new
+	if len(entries) == 0 {
+		return "0-0", nil
+	}
+
+	return entries[0].ID, nil
+}
+
+func (b *Broker) Unsubscribe(topic string) error {
+	b.mu.Lock()
+	if b.state == broker.StateClosed {
+		b.mu.Unlock()
+		return broker.ErrClosed
+	}
+
+	delete(b.lastID, topic)
+	b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	err := b.pubSub.Unsubscribe(ctx, ChannelPrefix+topic)
+	if err != nil {
+		return fmt.Errorf("failed to unsubscribe from '%s': %w", topic, err)
+	}
+
+	return nil
+}
+
+// Consume returns the messages of the subscribed topics. A message rejected for
+// the first time is delivered again, a message rejected twice is dead-lettered.
+func (b *Broker) Consume() (<-chan broker.Message, error) {
+	incoming := make(chan broker.Message)
+	messages := make(chan broker.Message)
+
+	go b.receive(incoming)
+
+	go func() {
+		defer close(messages)
+
+		for {
+			select {
+			case message, ok := <-incoming:
+				if !ok {
+					return
+				}
+				messages <- message
+			case message := <-b.retries:
+				messages <- message
+			}
+		}
+	}()
+
+	return messages, nil
+}
+
+// receive reads the Pub/Sub connection until the broker is closed. Every
+// (re)subscription to a channel replays what its stream holds beyond the last
+// forwarded message, which covers the messages missed while disconnected.
+func (b *Broker) receive(incoming chan<- broker.Message) {
+	defer close(incoming)
+
+	ctx := context.Background()
+
+	for {
+		received, err := b.pubSub.Receive(ctx)
+		if err != nil {
+			if b.isClosed() {
+				return
+			}
+
+			b.setState(broker.StateReconnecting)
+			log.Printf("Redis Pub/Sub connection lost, reconnecting: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		b.setState(broker.StateConnected)
+
+		switch msg := received.(type) {
+		case *redis.Subscription:
+			if msg.Kind == "subscribe" {
+				b.replay(ctx, strings.TrimPrefix(msg.Channel, ChannelPrefix), incoming)
+			}
+		case *redis.Message:
+			topic := strings.TrimPrefix(msg.Channel, ChannelPrefix)
+			id, body, found := strings.Cut(msg.Payload, " ")
+			if !found {
+				log.Printf("could not parse message of topic '%s'", topic)
+				continue
+			}
+
+			b.forward(topic, id, []byte(body), incoming)
+		}
+	}
+}
+
+// replay forwards the entries of the topic's stream that come after the last forwarded message
+func (b *Broker) replay(ctx context.Context, topic string, incoming chan<- broker.Message) {
+	for {
+		b.mu.Lock()
+		lastID, subscribed := b.lastID[topic]
+		b.mu.Unlock()
+
+		if !subscribed {
+			return
+		}
+
+		entries, err := b.client.XRangeN(ctx, StreamPrefix+topic, "("+lastID, "+", replayBatchSize).Result()
+		if err != nil {
+			log.Printf("failed to replay messages of topic '%s': %v", topic, err)
+			return
+		}
+
+		for _, entry := range entries {
+			body, _ := entry.Values["body"].(string)
+			b.forward(topic, entry.ID, []byte(body), incoming)
+		}
+
+		if len(entries) < replayBatchSize {
+			return
+		}
+	}
+}
+
+// forward hands the message over to the consumer, unless it was forwarded already
+// or the topic is no longer subscribed
+func (b *Broker) forward(topic, id string, body []byte, incoming chan<- broker.Message) {
+	b.mu.Lock()
+	lastID, subscribed := b.lastID[topic]
+	isNew := subscribed && compareIDs(id, lastID) > 0
+	if isNew {
+		b.lastID[topic] = id
+	}
+	b.mu.Unlock()
+
+	if !isNew {
+		return
+	}
+
+	message := broker.Message{Topic: topic, Body: body}
+	message.Acknowledger = retryAcknowledger{broker: b, message: message}
+	incoming <- message
+}
+
+// compareIDs orders two stream entry IDs, formatted as <milliseconds>-<sequence>
+func compareIDs(a, b string) int {
+	aMs, aSeq := parseID(a)
+	bMs, bSeq := parseID(b)
+
+	if aMs != bMs {
+		return cmp.Compare(aMs, bMs)
+	}
+
+	return cmp.Compare(aSeq, bSeq)
+}
+
+func parseID(id string) (uint64, uint64) {
+	msPart, seqPart, _ := strings.Cut(id, "-")
+	ms, _ := strconv.ParseUint(msPart, 10, 64)
+	seq, _ := strconv.ParseUint(seqPart, 10, 64)
+
+	return ms, seq
+}
+
+// retryAcknowledger settles a message locally: Pub/Sub has no acknowledgements,
+// so a rejected message is delivered again by this instance or dead-lettered
+type retryAcknowledger struct {
+	broker  *Broker
+	message broker.Message
+}
+
+func (a retryAcknowledger) Ack() error {
+	return nil
+}
+
+func (a retryAcknowledger) Nack(requeue bool) error {
+	if requeue {
+		redelivery := a.message
+		redelivery.Redelivered = true
+		redelivery.Acknowledger = a
+
+		select {
+		case a.broker.retries <- redelivery:
+			return nil
+		default: // Too many messages waiting to be delivered again
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ConfirmTimeout)
+	defer cancel()
+
+	err := a.broker.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: DeadLetterStream,
+		Values: map[string]interface{}{"topic": a.message.Topic, "body": a.message.Body},
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("failed to dead-letter message: %w", err)
+	}
+
+	return nil
+}
+
+// State reports whether Redis was reachable when last used or checked
+func (b *Broker) State() broker.State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+func (b *Broker) setState(state broker.State) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != broker.StateClosed {
+		b.state = state
+	}
+}
+
+func (b *Broker) isClosed() bool {
+	return b.State() == broker.StateClosed
+}
+
+// checkState pings Redis periodically until the broker is closed, so that the state
+// is kept up to date while no message goes through
+func (b *Broker) checkState() {
+	ticker := time.NewTicker(stateCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.done:
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err := b.client.Ping(ctx).Err()
+		cancel()
+
+		if err != nil {
+			b.setState(broker.StateReconnecting)
+		} else {
+			b.setState(broker.StateConnected)
+		}
+	}
+}
+
+// Close stops receiving and closes the connections, ending the message channel returned by Consume
+func (b *Broker) Close() error {
+	b.mu.Lock()
+	if b.state == broker.StateClosed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.state = broker.StateClosed
+	close(b.done)
+	b.mu.Unlock()
+
+	_ = b.pubSub.Close()
+
+	return b.client.Close()
+}
@@ -0,0 +1,240 @@
+package redis
+
+import (
+	"chat-server/broker"
+	"context"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"testing"
+	"time"
+)
+
+const testTimeout = 5 * time.Second
+
+// newTestBroker starts an in-process Redis server and connects a broker to it
+func newTestBroker(t *testing.T) (*Broker, *miniredis.Miniredis) {
+	t.Helper()
+
+	server := miniredis.RunT(t)
+	t.Setenv("REDIS_URL", "redis://"+server.Addr())
+
+	b, err := New()
+	if err != nil {
+		t.Fatalf("New() failed: %v", err)
+	}
+	t.Cleanup(func() { _ = b.Close() })
+
+	return b, server
+}
+
+func consume(t *testing.T, b *Broker) <-chan broker.Message {
+	t.Helper()
+
+	messages, err := b.Consume()
+	if err != nil {
+		t.Fatalf("Consume() failed: %v", err)
+	}
+
+	return messages
+}
+
+// subscribe subscribes to the topic and waits for the Pub/Sub subscription to be active
+func subscribe(t *testing.T, b *Broker, server *miniredis.Miniredis, topic string) {
+	t.Helper()
+
+	err := b.Subscribe(topic)
+	if err != nil {
+		t.Fatalf("Subscribe() failed: %v", err)
+	}
+	waitSubscribers(t, server, topic, 1)
+}
+
+func waitSubscribers(t *testing.T, server *miniredis.Miniredis, topic string, subscribers int) {
+	t.Helper()
+
+	eventually(t, func() bool {
+		return server.PubSubNumSub(ChannelPrefix + topic)[ChannelPrefix+topic] == subscribers
+	}, "%d subscribers to %s", subscribers, topic)
+}
+
+func publish(t *testing.T, b *Broker, topic string, body string) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	err := b.Publish(ctx, topic, []byte(body))
+	if err != nil {
+		t.Fatalf("Publish() failed: %v", err)
+	}
+}
+
+func receive(t *testing.T, messages <-chan broker.Message) broker.Message {
+	t.Helper()
+
+	select {
+	case message, ok := <-messages:
+		if !ok {
+			t.Fatal("message channel closed")
+		}
+		return message
+	case <-time.After(testTimeout):
+		t.Fatal("no message received")
+	}
+
+	return broker.Message{}
+}
+
+func expectNone(t *testing.T, messages <-chan broker.Message) {
+	t.Helper()
+
+	select {
+	case message := <-messages:
+		t.Fatalf("unexpected message %s on %s", message.Body, message.Topic)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+// eventually polls the condition until it holds, failing the test after the timeout
+func eventually(t *testing.T, condition func() bool, format string, args ...any) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting: "+format, args...)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPublishConsume(t *testing.T) {
+	b, server := newTestBroker(t)
+	messages := consume(t, b)
+
+	// Messages published before subscribing are not replayed, even when
+	// the clock of Redis is ahead of the clock of the instance
+	publish(t, b, "room1", "before")
+	future := time.Now().Add(time.Hour).UnixMilli()
+	_, err := server.XAdd(StreamPrefix+"room1", fmt.Sprintf("%d-0", future), []string{"body", "ahead"})
+	if err != nil {
+		t.Fatalf("failed to add a stream entry: %v", err)
+	}
+
+	subscribe(t, b, server, "room1")
+	publish(t, b, "room2", "elsewhere")
+	publish(t, b, "room1", "hello")
+
+	message := receive(t, messages)
+	if message.Topic != "room1" || string(message.Body) != "hello" || message.Redelivered {
+		t.Errorf("received %s on %s, redelivered %v; want a first delivery of hello on room1", message.Body, message.Topic, message.Redelivered)
+	}
+	expectNone(t, messages)
+
+	err = b.Unsubscribe("room1")
+	if err != nil {
+		t.Fatalf("Unsubscribe() failed: %v", err)
+	}
+	waitSubscribers(t, server, "room1", 0)
+
+	publish(t, b, "room1", "gone")
+	expectNone(t, messages)
+
+	err = b.Close()
+	if err != nil {
+		t.Fatalf("Close() failed: %v", err)
+	}
+
+	select {
+	case _, ok := <-messages:
+		if ok {
+			t.Error("message received after Close()")
+		}
+	case <-time.After(testTimeout):
+		t.Error("message channel still open after Close()")
+	}
+}
+
+// TestReplay drops the Pub/Sub connection, the messages published until it is
+// re-established are replayed from the stream, once each
+func TestReplay(t *testing.T) {
+	b, server := newTestBroker(t)
+	messages := consume(t, b)
+	subscribe(t, b, server, "room1")
+
+	publish(t, b, "room1", "live")
+	if message := receive(t, messages); string(message.Body) != "live" {
+		t.Fatalf("received %s; want live", message.Body)
+	}
+
+	server.Close()
+	eventually(t, func() bool { return b.State() == broker.StateReconnecting }, "reconnecting state")
+
+	err := server.Restart()
+	if err != nil {
+		t.Fatalf("failed to restart Redis: %v", err)
+	}
+
+	// The receive loop waits a second before reconnecting
+	publish(t, b, "room1", "missed 1")
+	publish(t, b, "room1", "missed 2")
+
+	for _, body := range []string{"missed 1", "missed 2"} {
+		message := receive(t, messages)
+		if string(message.Body) != body {
+			t.Errorf("received %s; want %s", message.Body, body)
+		}
+	}
+
+	waitSubscribers(t, server, "room1", 1)
+	eventually(t, func() bool { return b.State() == broker.StateConnected }, "connected state")
+
+	publish(t, b, "room1", "live again")
+	if message := receive(t, messages); string(message.Body) != "live again" {
+		t.Errorf("received %s; want live again", message.Body)
+	}
+	expectNone(t, messages)
+}
+
+// TestNackDeadLetter rejects a message twice, it is delivered again
+// after the first rejection and dead-lettered after the second one
+func TestNackDeadLetter(t *testing.T) {
+	b, server := newTestBroker(t)
+	messages := consume(t, b)
+	subscribe(t, b, server, "room1")
+
+	publish(t, b, "room1", "poison")
+
+	message := receive(t, messages)
+	if message.Redelivered {
+		t.Error("first delivery marked as redelivered")
+	}
+
+	err := message.Nack()
+	if err != nil {
+		t.Fatalf("Nack() failed: %v", err)
+	}
+
+	message = receive(t, messages)
+	if message.Topic != "room1" || string(message.Body) != "poison" || !message.Redelivered {
+		t.Fatalf("received %s on %s, redelivered %v; want poison redelivered on room1", message.Body, message.Topic, message.Redelivered)
+	}
+
+	err = message.Nack()
+	if err != nil {
+		t.Fatalf("Nack() failed: %v", err)
+	}
+	expectNone(t, messages)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	entries, err := b.client.XRange(ctx, DeadLetterStream, "-", "+").Result()
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("dead-lettered %v, %v; want one message", entries, err)
+	}
+	if entries[0].Values["topic"] != "room1" || entries[0].Values["body"] != "poison" {
+		t.Errorf("dead-lettered %v; want poison on room1", entries[0].Values)
+	}
+}
@@ -10,6 +10,12 @@ import (
 	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
+// ErrNotFound is returned when no entity matches a lookup
+var ErrNotFound = errors.New("entity not found")
+
+// ErrDuplicate is returned when an entity violates a uniqueness constraint
+var ErrDuplicate = errors.New("entity already exists")
+
 // Should not be exported outside the package.
 type identifier interface {
 	GetID() primitive.ObjectID
@@ -23,12 +29,14 @@ type _[T identifier] interface {
 	Create(ctx context.Context, entity T) (*T, error)
 	FindById(ctx context.Context, id string) (*T, error)
 	FindOne(ctx context.Context, filter interface{}) (*T, error)
-	Find(ctx context.Context, page int, limit int) ([]*T, error)
+	Find(ctx context.Context, filter interface{}, page Page) ([]*T, error)
+	Count(ctx context.Context, filter interface{}) (int64, error)
 	Update(ctx context.Context, id string, entity T) (*T, error)
 }
 
 type Model[T identifier] struct {
 	collection *mongo.Collection
+	listeners  *Listeners
 }
 
 // Should not be exported outside the package.
@@ -76,7 +84,7 @@ func (m *Model[T]) FindById(ctx context.Context, id string) (*T, error) {
 func (m *Model[T]) FindOne(ctx context.Context, filter interface{}) (*T, error) {
 	result := m.collection.FindOne(ctx, filter)
 	if errors.Is(result.Err(), mongo.ErrNoDocuments) {
-		return nil, fmt.Errorf("entity not found")
+		return nil, ErrNotFound
 	} else if result.Err() != nil {
 		return nil, fmt.Errorf("failed to find entity: %w", result.Err())
 	}
@@ -90,13 +98,18 @@ func (m *Model[T]) FindOne(ctx context.Context, filter interface{}) (*T, error)
 	return &entity, nil
 }
 
-func (m *Model[T]) Find(ctx context.Context, filter interface{}, page int, limit int, sortKey string) ([]*T, error) {
+func (m *Model[T]) Find(ctx context.Context, filter interface{}, page Page) ([]*T, error) {
 	findOptions := options.Find()
-	findOptions.SetSkip(int64((page - 1) * limit))
-	findOptions.SetLimit(int64(limit))
+	findOptions.SetSkip(int64(page.Skip()))
+	findOptions.SetLimit(int64(page.Limit))
 
-	if sortKey != "" {
-		findOptions.SetSort(bson.D{{sortKey, -1}})
+	if page.Sort.Field != "" {
+		direction := 1
+		if page.Sort.Descending {
+			direction = -1
+		}
+
+		findOptions.SetSort(bson.D{{Key: page.Sort.Field, Value: direction}, {Key: "_id", Value: direction}})
 	}
 
 	if filter == nil {
@@ -122,6 +135,30 @@ func (m *Model[T]) Find(ctx context.Context, filter interface{}, page int, limit
 	return entities, nil
 }
 
+// Count returns the number of entities matching the filter
+func (m *Model[T]) Count(ctx context.Context, filter interface{}) (int64, error) {
+	if filter == nil {
+		filter = bson.M{}
+	}
+
+	count, err := m.collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, fmt.Errorf("error counting entities: %w", err)
+	}
+
+	return count, nil
+}
+
+// unwrap turns the entity references returned by Find into the entities
+func unwrap[T identifier](references []*T) []T {
+	entities := make([]T, len(references))
+	for i, reference := range references {
+		entities[i] = *reference
+	}
+
+	return entities
+}
+
 func (m *Model[T]) Update(ctx context.Context, id string, entity T) (*T, error) {
 	objID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
@@ -135,7 +172,7 @@ func (m *Model[T]) Update(ctx context.Context, id string, entity T) (*T, error)
 	}
 
 	if result.MatchedCount == 0 {
-		return nil, fmt.Errorf("entity not found")
+		return nil, ErrNotFound
 	}
 
 	return &entity, nil
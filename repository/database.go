@@ -2,6 +2,8 @@ package repository
 
 import (
 	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"log"
@@ -11,13 +13,21 @@ import (
 
 // Constants representing allowed DB names
 const (
-	Rooms   = "rooms"
-	User    = "users"
-	Message = "messages"
+	Rooms        = "rooms"
+	User         = "users"
+	Message      = "messages"
+	Presence     = "presence"
+	Instances    = "instances"
+	ReadReceipts = "read_receipts"
+	Outbox       = "outbox"
+	Migrations   = "schema_migrations"
 )
 
+// Database is only set with the MongoDB storage
 var Database *mongo.Database
 
+// SetupDatabase connects to MongoDB. It is only called when STORAGE selects MongoDB,
+// the other storages run without DB_URL and DB_NAME.
 func SetupDatabase() {
 	dbURL := os.Getenv("DB_URL")
 	if dbURL == "" {
@@ -44,5 +54,33 @@ func SetupDatabase() {
 		log.Fatal(err)
 	}
 
+	var hello helloReply
+	err = client.Database("admin").RunCommand(ctx, bson.D{{Key: "hello", Value: 1}}).Decode(&hello)
+	if err != nil {
+		log.Fatal("Failed to query the MongoDB deployment:", err)
+	}
+
+	err = hello.checkTransactions()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	Database = client.Database(dbName)
 }
+
+// helloReply is the part of the reply to the hello command describing the deployment
+type helloReply struct {
+	SetName string `bson:"setName"` // Name of the replica set, empty outside of replica sets
+	Msg     string `bson:"msg"`     // "isdbgrid" when connected to a mongos router
+}
+
+// checkTransactions fails unless the deployment supports transactions, which messages
+// are stored in: standalone servers do not, replica sets and sharded clusters do
+func (h helloReply) checkTransactions() error {
+	if h.SetName != "" || h.Msg == "isdbgrid" {
+		return nil
+	}
+
+	return errors.New("MongoDB at DB_URL is a standalone server, but messages are stored in transactions which require a replica set: " +
+		"start mongod with --replSet and run rs.initiate(), a single node replica set is enough")
+}
@@ -0,0 +1,24 @@
+package repository
+
+import "testing"
+
+func TestCheckTransactions(t *testing.T) {
+	tests := []struct {
+		name  string
+		hello helloReply
+		ok    bool
+	}{
+		{name: "standalone", hello: helloReply{}, ok: false},
+		{name: "replica set", hello: helloReply{SetName: "rs0"}, ok: true},
+		{name: "sharded cluster", hello: helloReply{Msg: "isdbgrid"}, ok: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.hello.checkTransactions()
+			if (err == nil) != test.ok {
+				t.Errorf("checkTransactions() = %v; want ok %v", err, test.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package repository
+
+import (
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sync"
+)
+
+// RoomJoinListener is notified whenever a user becomes a participant of a room
+type RoomJoinListener func(roomID primitive.ObjectID, userID primitive.ObjectID)
+
+// ReadListener is notified whenever a read cursor moves forward
+type ReadListener func(receipt *ReadReceiptModel)
+
+// Listeners are notified of the changes made through the stores of a Store.
+// Storage implementations call the Notify methods, which are no-ops on a nil Listeners.
+type Listeners struct {
+	mu       sync.RWMutex
+	roomJoin []RoomJoinListener
+	read     []ReadListener
+}
+
+// OnRoomJoin registers a listener that is called after a user joins a room
+func (l *Listeners) OnRoomJoin(listener RoomJoinListener) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.roomJoin = append(l.roomJoin, listener)
+}
+
+// OnRead registers a listener that is called after a user read messages in a room
+func (l *Listeners) OnRead(listener ReadListener) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.read = append(l.read, listener)
+}
+
+// NotifyRoomJoin calls the room join listeners, storage implementations
+// call it whenever users become participants of a room
+func (l *Listeners) NotifyRoomJoin(roomID primitive.ObjectID, userIDs ...primitive.ObjectID) {
+	if l == nil {
+		return
+	}
+
+	l.mu.RLock()
+	listeners := l.roomJoin
+	l.mu.RUnlock()
+
+	for _, listener := range listeners {
+		for _, userID := range userIDs {
+			listener(roomID, userID)
+		}
+	}
+}
+
+// NotifyRead calls the read listeners, storage implementations
+// call it whenever a read cursor moves forward, and only then
+func (l *Listeners) NotifyRead(receipt *ReadReceiptModel) {
+	if l == nil {
+		return
+	}
+
+	l.mu.RLock()
+	listeners := l.read
+	l.mu.RUnlock()
+
+	for _, listener := range listeners {
+		listener(receipt)
+	}
+}
@@ -0,0 +1,186 @@
+package memory
+
+import (
+	"chat-server/repository"
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sort"
+	"time"
+)
+
+// isAfter orders the messages by timestamp and then ID
+func isAfter(timestamp time.Time, id primitive.ObjectID, afterTimestamp time.Time, afterId primitive.ObjectID) bool {
+	if !timestamp.Equal(afterTimestamp) {
+		return timestamp.After(afterTimestamp)
+	}
+
+	return id.Hex() > afterId.Hex()
+}
+
+func (db *DB) FindMessage(ctx context.Context, id primitive.ObjectID) (*repository.MessageModel, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, message := range db.messages {
+		if message.ID == id {
+			messageCopy := *message
+
+			return &messageCopy, nil
+		}
+	}
+
+	return nil, repository.ErrNotFound
+}
+
+func (db *DB) FindMessages(ctx context.Context, roomId primitive.ObjectID, page repository.Page) ([]*repository.MessageModel, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	messages := make([]*repository.MessageModel, 0)
+	for _, message := range db.messages {
+		if roomId.IsZero() || message.RoomID == roomId {
+			messageCopy := *message
+			messages = append(messages, &messageCopy)
+		}
+	}
+
+	sortPage(messages, page, compareMessages, (*repository.MessageModel).GetID)
+
+	return paginate(messages, page.Number, page.Limit), nil
+}
+
+func compareMessages(a *repository.MessageModel, b *repository.MessageModel, field string) int {
+	if field == "timestamp" {
+		return a.Timestamp.Compare(b.Timestamp)
+	}
+
+	return 0
+}
+
+func (db *DB) CountMessages(ctx context.Context, roomId primitive.ObjectID) (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var count int64
+	for _, message := range db.messages {
+		if roomId.IsZero() || message.RoomID == roomId {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// sortMessages orders the messages by timestamp and then ID, oldest first
+func sortMessages(messages []*repository.MessageModel) {
+	sort.Slice(messages, func(i, j int) bool {
+		return isAfter(messages[j].Timestamp, messages[j].ID, messages[i].Timestamp, messages[i].ID)
+	})
+}
+
+func (db *DB) FindByClientMessageID(ctx context.Context, senderId primitive.ObjectID, clientMessageId string) (*repository.MessageModel, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, message := range db.messages {
+		if message.SenderID == senderId && message.ClientMessageID == clientMessageId {
+			messageCopy := *message
+
+			return &messageCopy, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (db *DB) FindAfter(ctx context.Context, roomId primitive.ObjectID, timestamp time.Time, afterId primitive.ObjectID, limit int) ([]*repository.MessageModel, error) {
+	db.mu.RLock()
+	var messages []*repository.MessageModel
+	for _, message := range db.messages {
+		if !roomId.IsZero() && message.RoomID != roomId {
+			continue
+		}
+
+		// Without an afterId every message newer than the timestamp is returned
+		newer := message.Timestamp.After(timestamp)
+		if !afterId.IsZero() {
+			newer = isAfter(message.Timestamp, message.ID, timestamp, afterId)
+		}
+
+		if newer {
+			messageCopy := *message
+			messages = append(messages, &messageCopy)
+		}
+	}
+	db.mu.RUnlock()
+
+	sortMessages(messages)
+
+	return paginate(messages, 1, limit), nil
+}
+
+func (db *DB) FindBefore(ctx context.Context, roomId primitive.ObjectID, timestamp time.Time, beforeId primitive.ObjectID, limit int) ([]*repository.MessageModel, error) {
+	db.mu.RLock()
+	var messages []*repository.MessageModel
+	for _, message := range db.messages {
+		if !roomId.IsZero() && message.RoomID != roomId {
+			continue
+		}
+
+		// Without a timestamp every message is returned, the newest are kept below.
+		// Without a beforeId every message older than the timestamp is returned.
+		older := timestamp.IsZero() || message.Timestamp.Before(timestamp)
+		if !timestamp.IsZero() && !beforeId.IsZero() {
+			older = isAfter(timestamp, beforeId, message.Timestamp, message.ID)
+		}
+
+		if older {
+			messageCopy := *message
+			messages = append(messages, &messageCopy)
+		}
+	}
+	db.mu.RUnlock()
+
+	sortMessages(messages)
+
+	// Keep the messages closest to the position
+	if limit > 0 && len(messages) > limit {
+		messages = messages[len(messages)-limit:]
+	}
+
+	return messages, nil
+}
+
+// CreateWithOutbox stores the message and its outbox record at once
+func (db *DB) CreateWithOutbox(ctx context.Context, message *repository.MessageModel, topic string, encode func(*repository.MessageModel) ([]byte, error)) (*repository.MessageModel, error) {
+	message.SetID(primitive.NewObjectID())
+	message.SetTimestamp()
+
+	body, err := encode(message)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &repository.OutboxModel{Topic: topic, Body: body, Status: repository.OutboxPending}
+	record.SetID(primitive.NewObjectID())
+	record.SetTimestamp()
+
+	messageCopy := *message
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if message.ClientMessageID != "" {
+		for _, sent := range db.messages {
+			if sent.SenderID == message.SenderID && sent.ClientMessageID == message.ClientMessageID {
+				return nil, fmt.Errorf("message '%s' was already sent: %w", message.ClientMessageID, repository.ErrDuplicate)
+			}
+		}
+	}
+
+	db.messages = append(db.messages, &messageCopy)
+	db.outbox = append(db.outbox, record)
+
+	return message, nil
+}
@@ -0,0 +1,83 @@
+package memory
+
+import (
+	"chat-server/repository"
+	"context"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// ClaimPending locks the oldest pending record that is not being relayed and
+// that is due for an attempt. It returns nil without an error when nothing is pending.
+func (db *DB) ClaimPending(ctx context.Context, instanceId string, lease time.Duration) (*repository.OutboxModel, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	now := time.Now()
+	for _, record := range db.outbox {
+		if record.Status != repository.OutboxPending || record.LockedUntil.After(now) || record.NextAttempt.After(now) {
+			continue
+		}
+
+		record.LockedBy = instanceId
+		record.LockedUntil = now.Add(lease)
+		record.Attempts++
+
+		recordCopy := *record
+
+		return &recordCopy, nil
+	}
+
+	return nil, nil
+}
+
+// MarkSent drops the published record, there is no need to keep it in memory
+func (db *DB) MarkSent(ctx context.Context, id primitive.ObjectID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for i, record := range db.outbox {
+		if record.ID == id {
+			db.outbox = append(db.outbox[:i], db.outbox[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+// Release unlocks a claimed record that failed to be published, so that it is
+// retried from retryAt
+func (db *DB) Release(ctx context.Context, id primitive.ObjectID, retryAt time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, record := range db.outbox {
+		if record.ID == id {
+			record.LockedBy = ""
+			record.LockedUntil = time.Time{}
+			record.NextAttempt = retryAt
+			break
+		}
+	}
+
+	return nil
+}
+
+// MarkFailed gives up on a claimed record, it is no longer relayed
+func (db *DB) MarkFailed(ctx context.Context, id primitive.ObjectID) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for _, record := range db.outbox {
+		if record.ID == id {
+			record.Status = repository.OutboxFailed
+			record.LockedBy = ""
+			record.LockedUntil = time.Time{}
+			record.NextAttempt = time.Time{}
+			break
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package memory
+
+import (
+	"chat-server/repository"
+	"context"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"slices"
+	"time"
+)
+
+func copyPresence(presence *repository.PresenceModel) *repository.PresenceModel {
+	presenceCopy := *presence
+	presenceCopy.Instances = slices.Clone(presence.Instances)
+
+	return &presenceCopy
+}
+
+func (db *DB) FindPresence(ctx context.Context, userId primitive.ObjectID) (*repository.PresenceModel, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	presence, found := db.presence[userId.Hex()]
+	if !found {
+		return nil, repository.ErrNotFound
+	}
+
+	return copyPresence(presence), nil
+}
+
+// ConnectInstance records that the user is connected to the instance and marks them online
+func (db *DB) ConnectInstance(ctx context.Context, userId primitive.ObjectID, instanceId string) (*repository.PresenceModel, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	presence, found := db.presence[userId.Hex()]
+	if !found {
+		presence = &repository.PresenceModel{ID: userId}
+		db.presence[userId.Hex()] = presence
+	}
+
+	if !slices.Contains(presence.Instances, instanceId) {
+		presence.Instances = append(presence.Instances, instanceId)
+	}
+	presence.Status = repository.PresenceOnline
+	presence.LastSeen = time.Now()
+
+	return copyPresence(presence), nil
+}
+
+// DisconnectInstance records that the user is no longer connected to the instance.
+// The user goes offline when no other instance holds a connection of theirs.
+func (db *DB) DisconnectInstance(ctx context.Context, userId primitive.ObjectID, instanceId string) (*repository.PresenceModel, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	presence, found := db.presence[userId.Hex()]
+	if !found {
+		return nil, nil
+	}
+
+	leaveInstance(presence, instanceId)
+
+	return copyPresence(presence), nil
+}
+
+// SetStatus changes the status of a connected user, e.g. to away
+func (db *DB) SetStatus(ctx context.Context, userId primitive.ObjectID, status string) (*repository.PresenceModel, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	presence, found := db.presence[userId.Hex()]
+	if !found || len(presence.Instances) == 0 {
+		return nil, nil
+	}
+
+	presence.Status = status
+	presence.LastSeen = time.Now()
+
+	return copyPresence(presence), nil
+}
+
+// ReleaseInstance removes the instance from every user and deletes its lease
+func (db *DB) ReleaseInstance(ctx context.Context, instanceId string) ([]*repository.PresenceModel, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	released := []*repository.PresenceModel{}
+	for _, presence := range db.presence {
+		if slices.Contains(presence.Instances, instanceId) {
+			leaveInstance(presence, instanceId)
+			released = append(released, copyPresence(presence))
+		}
+	}
+	delete(db.leases, instanceId)
+
+	return released, nil
+}
+
+// Heartbeat extends the lease of the instance until ttl from now
+func (db *DB) Heartbeat(ctx context.Context, instanceId string, ttl time.Duration) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	db.leases[instanceId] = time.Now().Add(ttl)
+
+	return nil
+}
+
+// ExpiredInstances returns the instances holding users whose lease expired or
+// who never had one
+func (db *DB) ExpiredInstances(ctx context.Context) ([]string, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	now := time.Now()
+	expired := []string{}
+	for _, presence := range db.presence {
+		for _, instance := range presence.Instances {
+			expiresAt, found := db.leases[instance]
+			if (!found || !expiresAt.After(now)) && !slices.Contains(expired, instance) {
+				expired = append(expired, instance)
+			}
+		}
+	}
+	slices.Sort(expired)
+
+	return expired, nil
+}
+
+func leaveInstance(presence *repository.PresenceModel, instanceId string) {
+	presence.Instances = slices.DeleteFunc(presence.Instances, func(instance string) bool {
+		return instance == instanceId
+	})
+	presence.LastSeen = time.Now()
+
+	if len(presence.Instances) == 0 {
+		presence.Status = repository.PresenceOffline
+	}
+}
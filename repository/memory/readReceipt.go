@@ -0,0 +1,88 @@
+package memory
+
+import (
+	"chat-server/repository"
+	"context"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+type readReceiptKey struct {
+	roomID primitive.ObjectID
+	userID primitive.ObjectID
+}
+
+// MarkRead moves the read cursor of the user in the message's room up to the message.
+// The cursor never moves backwards, marking an older message as read is a no-op.
+func (db *DB) MarkRead(ctx context.Context, userId primitive.ObjectID, message *repository.MessageModel) (*repository.ReadReceiptModel, error) {
+	key := readReceiptKey{roomID: message.RoomID, userID: userId}
+
+	db.mu.Lock()
+	receipt, found := db.readReceipts[key]
+	if !found {
+		receipt = &repository.ReadReceiptModel{RoomID: message.RoomID, UserID: userId}
+		receipt.SetID(primitive.NewObjectID())
+		db.readReceipts[key] = receipt
+	}
+
+	moved := !found || isAfter(message.Timestamp, message.ID, receipt.LastReadAt, receipt.LastReadMessageID)
+	if moved {
+		receipt.LastReadMessageID = message.ID
+		receipt.LastReadAt = message.Timestamp
+		receipt.UpdatedAt = time.Now()
+	}
+
+	receiptCopy := *receipt
+	db.mu.Unlock()
+
+	if moved {
+		db.listeners.NotifyRead(&receiptCopy)
+	}
+
+	return &receiptCopy, nil
+}
+
+// CountUnread counts the messages of other users in the room that come after the user's read cursor
+func (db *DB) CountUnread(ctx context.Context, roomId primitive.ObjectID, userId primitive.ObjectID) (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	receipt, found := db.readReceipts[readReceiptKey{roomID: roomId, userID: userId}]
+
+	var count int64
+	for _, message := range db.messages {
+		if message.RoomID != roomId || message.SenderID == userId {
+			continue
+		}
+
+		if !found || isAfter(message.Timestamp, message.ID, receipt.LastReadAt, receipt.LastReadMessageID) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// CountUnreadByRooms counts the unread messages of the user in each of the rooms
+func (db *DB) CountUnreadByRooms(ctx context.Context, userId primitive.ObjectID, roomIds []primitive.ObjectID) (map[primitive.ObjectID]int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	counts := make(map[primitive.ObjectID]int64, len(roomIds))
+	for _, roomId := range roomIds {
+		counts[roomId] = 0
+	}
+
+	for _, message := range db.messages {
+		if _, requested := counts[message.RoomID]; !requested || message.SenderID == userId {
+			continue
+		}
+
+		receipt, found := db.readReceipts[readReceiptKey{roomID: message.RoomID, userID: userId}]
+		if !found || isAfter(message.Timestamp, message.ID, receipt.LastReadAt, receipt.LastReadMessageID) {
+			counts[message.RoomID]++
+		}
+	}
+
+	return counts, nil
+}
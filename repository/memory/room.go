@@ -0,0 +1,155 @@
+package memory
+
+import (
+	"chat-server/repository"
+	"cmp"
+	"context"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"slices"
+)
+
+func copyRoom(room *repository.RoomModel) *repository.RoomModel {
+	roomCopy := *room
+	roomCopy.Participants = slices.Clone(room.Participants)
+
+	return &roomCopy
+}
+
+func (db *DB) FindRoom(ctx context.Context, id primitive.ObjectID) (*repository.RoomModel, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	room, found := db.rooms[id.Hex()]
+	if !found {
+		return nil, repository.ErrNotFound
+	}
+
+	return copyRoom(room), nil
+}
+
+func (db *DB) FindRooms(ctx context.Context, page repository.Page) ([]*repository.RoomModel, error) {
+	db.mu.RLock()
+	rooms := make([]*repository.RoomModel, 0, len(db.rooms))
+	for _, room := range db.rooms {
+		rooms = append(rooms, copyRoom(room))
+	}
+	db.mu.RUnlock()
+
+	sortPage(rooms, page, compareRooms, (*repository.RoomModel).GetID)
+
+	return paginate(rooms, page.Number, page.Limit), nil
+}
+
+func compareRooms(a *repository.RoomModel, b *repository.RoomModel, field string) int {
+	switch field {
+	case "created_at":
+		return a.CreatedAt.Compare(b.CreatedAt)
+	case "name":
+		return cmp.Compare(a.Name, b.Name)
+	default:
+		return 0
+	}
+}
+
+func (db *DB) CountRooms(ctx context.Context) (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return int64(len(db.rooms)), nil
+}
+
+func (db *DB) FindParticipantRooms(ctx context.Context, userId primitive.ObjectID) ([]*repository.RoomModel, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var rooms []*repository.RoomModel
+	for _, room := range db.rooms {
+		if slices.Contains(room.Participants, userId) {
+			rooms = append(rooms, copyRoom(room))
+		}
+	}
+
+	return rooms, nil
+}
+
+func (db *DB) JoinPrivateChatRoom(currentUserId primitive.ObjectID, targetUserId primitive.ObjectID) (*repository.RoomModel, error) {
+	db.mu.Lock()
+
+	// Validate only the targetUserId as the currentUserId is decoded from auth token
+	_, found := db.users[targetUserId.Hex()]
+	if !found {
+		db.mu.Unlock()
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid targetParticipantId received")
+	}
+	if targetUserId == currentUserId {
+		db.mu.Unlock()
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "targetParticipantId cannot be the same as the current user id")
+	}
+
+	for _, room := range db.rooms {
+		if room.Type == repository.PrivateChatRoom && len(room.Participants) == 2 &&
+			slices.Contains(room.Participants, currentUserId) && slices.Contains(room.Participants, targetUserId) {
+			existingRoom := copyRoom(room)
+			db.mu.Unlock()
+
+			return existingRoom, nil
+		}
+	}
+
+	newRoom := &repository.RoomModel{
+		Type:         repository.PrivateChatRoom,
+		Participants: []primitive.ObjectID{currentUserId, targetUserId},
+	}
+	newRoom.SetID(primitive.NewObjectID())
+	newRoom.SetTimestamp()
+	db.rooms[newRoom.ID.Hex()] = newRoom
+	newRoom = copyRoom(newRoom)
+	db.mu.Unlock()
+
+	db.listeners.NotifyRoomJoin(newRoom.ID, currentUserId, targetUserId)
+
+	return newRoom, nil
+}
+
+func (db *DB) JoinGroupChatRoom(currentUserId primitive.ObjectID, roomName string) (*repository.RoomModel, error) {
+	db.mu.Lock()
+
+	for _, room := range db.rooms {
+		if room.Name != roomName {
+			continue
+		}
+
+		// a user should not join a room twice
+		if slices.Contains(room.Participants, currentUserId) {
+			existingRoom := copyRoom(room)
+			db.mu.Unlock()
+
+			return existingRoom, nil
+		}
+
+		room.Participants = append(room.Participants, currentUserId)
+		updatedRoom := copyRoom(room)
+		db.mu.Unlock()
+
+		db.listeners.NotifyRoomJoin(updatedRoom.ID, currentUserId)
+
+		return updatedRoom, nil
+	}
+
+	newRoom := &repository.RoomModel{
+		Name:         roomName,
+		Type:         repository.GroupChatRoom,
+		Participants: []primitive.ObjectID{currentUserId},
+	}
+	newRoom.SetID(primitive.NewObjectID())
+	newRoom.SetTimestamp()
+	db.rooms[newRoom.ID.Hex()] = newRoom
+	newRoom = copyRoom(newRoom)
+	db.mu.Unlock()
+
+	db.listeners.NotifyRoomJoin(newRoom.ID, currentUserId)
+
+	return newRoom, nil
+}
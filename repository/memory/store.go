@@ -0,0 +1,94 @@
+// Package memory implements the repository stores in memory, for tests and
+// for running a single server instance without MongoDB. Nothing is persisted.
+package memory
+
+import (
+	"chat-server/repository"
+	"cmp"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DB holds every entity. It implements all the stores of repository.Store.
+// Entities are copied in and out, so callers never share them with the DB.
+type DB struct {
+	*entities
+	listeners *repository.Listeners
+}
+
+type entities struct {
+	mu           sync.RWMutex
+	users        map[string]*repository.UserModel // By ID hex
+	rooms        map[string]*repository.RoomModel
+	messages     []*repository.MessageModel // In insertion order
+	readReceipts map[readReceiptKey]*repository.ReadReceiptModel
+	presence     map[string]*repository.PresenceModel
+	leases       map[string]time.Time // Lease expiry by instance ID
+	outbox       []*repository.OutboxModel
+}
+
+func NewDB() *DB {
+	return &DB{
+		entities: &entities{
+			users:        make(map[string]*repository.UserModel),
+			rooms:        make(map[string]*repository.RoomModel),
+			readReceipts: make(map[readReceiptKey]*repository.ReadReceiptModel),
+			presence:     make(map[string]*repository.PresenceModel),
+			leases:       make(map[string]time.Time),
+		},
+		listeners: &repository.Listeners{},
+	}
+}
+
+// Connect returns a DB sharing the entities of db with its own listeners,
+// like another server instance connecting to the same database
+func (db *DB) Connect() *DB {
+	return &DB{entities: db.entities, listeners: &repository.Listeners{}}
+}
+
+// Store returns the stores backed by the DB
+func (db *DB) Store() *repository.Store {
+	return &repository.Store{
+		Users:        db,
+		Rooms:        db,
+		Messages:     db,
+		ReadReceipts: db,
+		Presence:     db,
+		Outbox:       db,
+		Listeners:    db.listeners,
+	}
+}
+
+// NewStore returns the stores backed by a new, empty in-memory DB
+func NewStore() *repository.Store {
+	return NewDB().Store()
+}
+
+// paginate returns the page of the entities, every entity with a limit of zero
+func paginate[T any](entities []T, page int, limit int) []T {
+	if limit <= 0 {
+		return entities
+	}
+
+	start := max(page-1, 0) * limit
+	if start >= len(entities) {
+		return []T{}
+	}
+
+	return entities[start:min(start+limit, len(entities))]
+}
+
+// sortPage orders the entities on the sort field of the page, compared by compareField,
+// the ID breaking ties in the same direction
+func sortPage[T any](entities []T, page repository.Page, compareField func(a T, b T, field string) int, id func(T) primitive.ObjectID) {
+	slices.SortFunc(entities, func(a T, b T) int {
+		order := cmp.Or(compareField(a, b, page.Sort.Field), cmp.Compare(id(a).Hex(), id(b).Hex()))
+		if page.Sort.Descending {
+			return -order
+		}
+
+		return order
+	})
+}
@@ -0,0 +1,13 @@
+package memory
+
+import (
+	"chat-server/repository"
+	"chat-server/repository/storetest"
+	"testing"
+)
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) *repository.Store {
+		return NewStore()
+	})
+}
@@ -0,0 +1,94 @@
+package memory
+
+import (
+	"chat-server/repository"
+	"cmp"
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func (db *DB) CreateUser(ctx context.Context, user *repository.UserModel) (*repository.UserModel, error) {
+	newUser := *user
+	newUser.SetID(primitive.NewObjectID())
+	newUser.SetTimestamp()
+
+	db.mu.Lock()
+	for _, existingUser := range db.users {
+		if existingUser.Username == newUser.Username {
+			db.mu.Unlock()
+			return nil, fmt.Errorf("username '%s' is taken: %w", newUser.Username, repository.ErrDuplicate)
+		}
+	}
+	db.users[newUser.ID.Hex()] = &newUser
+	db.mu.Unlock()
+
+	*user = newUser
+
+	return &newUser, nil
+}
+
+func (db *DB) FindUser(ctx context.Context, id primitive.ObjectID) (*repository.UserModel, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	user, found := db.users[id.Hex()]
+	if !found {
+		return nil, repository.ErrNotFound
+	}
+
+	userCopy := *user
+
+	return &userCopy, nil
+}
+
+func (db *DB) FindUserByUsername(ctx context.Context, username string) (*repository.UserModel, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	for _, user := range db.users {
+		if user.Username == username {
+			userCopy := *user
+
+			return &userCopy, nil
+		}
+	}
+
+	return nil, repository.ErrNotFound
+}
+
+func (db *DB) FindUsers(ctx context.Context, page repository.Page) ([]*repository.UserModel, error) {
+	db.mu.RLock()
+	users := make([]*repository.UserModel, 0, len(db.users))
+	for _, user := range db.users {
+		userCopy := *user
+		users = append(users, &userCopy)
+	}
+	db.mu.RUnlock()
+
+	sortPage(users, page, compareUsers, (*repository.UserModel).GetID)
+
+	return paginate(users, page.Number, page.Limit), nil
+}
+
+func compareUsers(a *repository.UserModel, b *repository.UserModel, field string) int {
+	switch field {
+	case "created_at":
+		return a.CreatedAt.Compare(b.CreatedAt)
+	case "username":
+		return cmp.Compare(a.Username, b.Username)
+	case "first_name":
+		return cmp.Compare(a.FirstName, b.FirstName)
+	case "last_name":
+		return cmp.Compare(a.LastName, b.LastName)
+	default:
+		return 0
+	}
+}
+
+func (db *DB) CountUsers(ctx context.Context) (int64, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	return int64(len(db.users)), nil
+}
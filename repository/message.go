@@ -1,17 +1,24 @@
 package repository
 
 import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"slices"
 	"time"
 )
 
 type MessageModel struct {
-	ID        primitive.ObjectID `bson:"_id"`
-	RoomID    primitive.ObjectID `bson:"room_id"`
-	SenderID  primitive.ObjectID `bson:"sender_id"`
-	Content   string             `bson:"content"`
-	Username  string             `bson:"username"`
-	Timestamp time.Time          `bson:"timestamp"`
+	ID              primitive.ObjectID `bson:"_id"`
+	RoomID          primitive.ObjectID `bson:"room_id"`
+	SenderID        primitive.ObjectID `bson:"sender_id"`
+	ClientMessageID string             `bson:"client_message_id,omitempty"`
+	Content         string             `bson:"content"`
+	Username        string             `bson:"username"`
+	Timestamp       time.Time          `bson:"timestamp"`
 }
 
 func NewMessage() *Model[*MessageModel] {
@@ -31,3 +38,179 @@ func (mm *MessageModel) SetID(id primitive.ObjectID) {
 func (mm *MessageModel) SetTimestamp() {
 	mm.Timestamp = time.Now()
 }
+
+func (m *Model[T]) FindMessage(ctx context.Context, id primitive.ObjectID) (*MessageModel, error) {
+	msgRepo := NewMessage()
+
+	message, err := msgRepo.FindOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return nil, err
+	}
+
+	return *message, nil
+}
+
+func (m *Model[T]) FindMessages(ctx context.Context, roomId primitive.ObjectID, page Page) ([]*MessageModel, error) {
+	msgRepo := NewMessage()
+
+	messages, err := msgRepo.Find(ctx, roomFilter(roomId), page)
+	if err != nil {
+		return nil, err
+	}
+
+	return unwrap(messages), nil
+}
+
+func (m *Model[T]) CountMessages(ctx context.Context, roomId primitive.ObjectID) (int64, error) {
+	return NewMessage().Count(ctx, roomFilter(roomId))
+}
+
+// roomFilter matches the messages of a room, or of every room with a zero roomId
+func roomFilter(roomId primitive.ObjectID) bson.M {
+	if roomId.IsZero() {
+		return bson.M{}
+	}
+
+	return bson.M{"room_id": roomId}
+}
+
+func findMessages(ctx context.Context, filter interface{}, findOptions *options.FindOptions) ([]*MessageModel, error) {
+	msgRepo := NewMessage()
+
+	cursor, err := msgRepo.collection.Find(ctx, filter, findOptions)
+	if err != nil {
+		return nil, fmt.Errorf("error finding messages: %w", err)
+	}
+	defer func(cursor *mongo.Cursor, ctx context.Context) {
+		_ = cursor.Close(ctx)
+	}(cursor, ctx)
+
+	messages := make([]*MessageModel, 0)
+	if err = cursor.All(ctx, &messages); err != nil {
+		return nil, fmt.Errorf("error decoding messages: %w", err)
+	}
+
+	return messages, nil
+}
+
+// FindByClientMessageID looks up a message previously sent by the sender with the same
+// client generated ID. It returns nil without an error when no such message exists.
+func (m *Model[T]) FindByClientMessageID(ctx context.Context, senderId primitive.ObjectID, clientMessageId string) (*MessageModel, error) {
+	msgRepo := NewMessage()
+
+	messages, err := msgRepo.Find(ctx, bson.M{"sender_id": senderId, "client_message_id": clientMessageId}, Page{Number: 1, Limit: 1})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(messages) == 0 {
+		return nil, nil
+	}
+
+	return *messages[0], nil
+}
+
+// FindAfter returns up to limit messages of a room sent after the given position, oldest first.
+// Messages are ordered by timestamp and then ID, so with an afterId, messages sharing the
+// timestamp of that message are only returned when their ID is greater. Without an afterId
+// (a zero ObjectID) every message newer than the timestamp is returned.
+// A zero roomId returns the messages of every room.
+func (m *Model[T]) FindAfter(ctx context.Context, roomId primitive.ObjectID, timestamp time.Time, afterId primitive.ObjectID, limit int) ([]*MessageModel, error) {
+	filter := roomFilter(roomId)
+	if afterId.IsZero() {
+		filter["timestamp"] = bson.M{"$gt": timestamp}
+	} else {
+		filter["$or"] = bson.A{
+			bson.M{"timestamp": bson.M{"$gt": timestamp}},
+			bson.M{"timestamp": timestamp, "_id": bson.M{"$gt": afterId}},
+		}
+	}
+
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "timestamp", Value: 1}, {Key: "_id", Value: 1}})
+	findOptions.SetLimit(int64(limit))
+
+	return findMessages(ctx, filter, findOptions)
+}
+
+// FindBefore returns up to limit messages of a room sent right before the given position,
+// oldest first. It mirrors FindAfter, a zero roomId returns the messages of every room.
+// A zero timestamp returns the newest messages.
+func (m *Model[T]) FindBefore(ctx context.Context, roomId primitive.ObjectID, timestamp time.Time, beforeId primitive.ObjectID, limit int) ([]*MessageModel, error) {
+	filter := roomFilter(roomId)
+	switch {
+	case timestamp.IsZero():
+		// No position, the newest messages are returned
+	case beforeId.IsZero():
+		filter["timestamp"] = bson.M{"$lt": timestamp}
+	default:
+		filter["$or"] = bson.A{
+			bson.M{"timestamp": bson.M{"$lt": timestamp}},
+			bson.M{"timestamp": timestamp, "_id": bson.M{"$lt": beforeId}},
+		}
+	}
+
+	// The closest messages are found newest first
+	findOptions := options.Find()
+	findOptions.SetSort(bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}})
+	findOptions.SetLimit(int64(limit))
+
+	messages, err := findMessages(ctx, filter, findOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	slices.Reverse(messages)
+
+	return messages, nil
+}
+
+// CreateWithOutbox persists the message together with the outbox record announcing it,
+// in a single transaction, so that the message is published if and only if it is stored.
+// The body of the record is encoded from the message once its ID and timestamp are set.
+// Transactions require MongoDB to run as a replica set.
+func (m *Model[T]) CreateWithOutbox(ctx context.Context, message *MessageModel, topic string, encode func(*MessageModel) ([]byte, error)) (*MessageModel, error) {
+	msgRepo := NewMessage()
+	outboxRepo := NewOutbox()
+
+	message.SetID(primitive.NewObjectID())
+	message.SetTimestamp()
+	// Announce the timestamp as stored, so that clients can sync from it
+	message.Timestamp = message.Timestamp.Truncate(time.Millisecond)
+
+	body, err := encode(message)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &OutboxModel{Topic: topic, Body: body, Status: OutboxPending}
+	record.SetID(primitive.NewObjectID())
+	record.SetTimestamp()
+
+	session, err := Database.Client().StartSession()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start session: %w", err)
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sessCtx mongo.SessionContext) (interface{}, error) {
+		_, err := msgRepo.collection.InsertOne(sessCtx, message)
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, fmt.Errorf("message '%s' was already sent: %w", message.ClientMessageID, ErrDuplicate)
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to create message: %w", err)
+		}
+
+		_, err = outboxRepo.collection.InsertOne(sessCtx, record)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create outbox record: %w", err)
+		}
+
+		return nil, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
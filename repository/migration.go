@@ -0,0 +1,230 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"log"
+	"slices"
+	"time"
+)
+
+// Migration changes the schema of the database, e.g. creates indexes.
+// Migrations must be idempotent: concurrently starting instances may apply the same one.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(ctx context.Context, db *mongo.Database) error
+}
+
+type migrationRecord struct {
+	Version     int       `bson:"_id"`
+	Description string    `bson:"description"`
+	AppliedAt   time.Time `bson:"applied_at"`
+}
+
+// migrations are applied in order of version, append new ones at the end
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "index usernames, room messages and rooms",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			err := createIndexes(ctx, db.Collection(User),
+				mongo.IndexModel{Keys: bson.D{{Key: "username", Value: 1}}, Options: options.Index().SetUnique(true)},
+			)
+			if err != nil {
+				return err
+			}
+
+			err = createIndexes(ctx, db.Collection(Message),
+				mongo.IndexModel{Keys: bson.D{{Key: "room_id", Value: 1}, {Key: "timestamp", Value: 1}}},
+			)
+			if err != nil {
+				return err
+			}
+
+			return createIndexes(ctx, db.Collection(Rooms),
+				mongo.IndexModel{Keys: bson.D{{Key: "type", Value: 1}, {Key: "participants", Value: 1}}},
+				mongo.IndexModel{Keys: bson.D{{Key: "name", Value: 1}}},
+			)
+		},
+	},
+	{
+		Version:     2,
+		Description: "index client message IDs, read receipts, presence instances and the outbox",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			err := createIndexes(ctx, db.Collection(Message),
+				mongo.IndexModel{
+					Keys: bson.D{{Key: "sender_id", Value: 1}, {Key: "client_message_id", Value: 1}},
+					// Messages sent without a client message ID are not deduplicated
+					Options: options.Index().SetUnique(true).
+						SetPartialFilterExpression(bson.M{"client_message_id": bson.M{"$type": "string"}}),
+				},
+			)
+			if err != nil {
+				return err
+			}
+
+			err = createIndexes(ctx, db.Collection(ReadReceipts),
+				mongo.IndexModel{Keys: bson.D{{Key: "room_id", Value: 1}, {Key: "user_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+			)
+			if err != nil {
+				return err
+			}
+
+			err = createIndexes(ctx, db.Collection(Presence),
+				mongo.IndexModel{Keys: bson.D{{Key: "instances", Value: 1}}},
+			)
+			if err != nil {
+				return err
+			}
+
+			return createIndexes(ctx, db.Collection(Outbox),
+				mongo.IndexModel{Keys: bson.D{{Key: "status", Value: 1}, {Key: "_id", Value: 1}}},
+			)
+		},
+	},
+	{
+		Version:     3,
+		Description: "expire instance leases",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			// An expired lease already counts as missing, MongoDB only deletes it eventually
+			return createIndexes(ctx, db.Collection(Instances),
+				mongo.IndexModel{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+			)
+		},
+	},
+	{
+		Version:     4,
+		Description: "expire sent outbox records",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			// Pending and failed records have no sent_at and are kept
+			return createIndexes(ctx, db.Collection(Outbox),
+				mongo.IndexModel{
+					Keys:    bson.D{{Key: "sent_at", Value: 1}},
+					Options: options.Index().SetExpireAfterSeconds(int32(OutboxRetention.Seconds())),
+				},
+			)
+		},
+	},
+	{
+		Version:     5,
+		Description: "make group names unique",
+		Up: func(ctx context.Context, db *mongo.Database) error {
+			err := mergeDuplicateGroups(ctx, db)
+			if err != nil {
+				return err
+			}
+
+			// Private rooms have no name
+			return createIndexes(ctx, db.Collection(Rooms),
+				mongo.IndexModel{
+					Keys:    bson.D{{Key: "name", Value: 1}, {Key: "type", Value: 1}},
+					Options: options.Index().SetUnique(true).SetPartialFilterExpression(bson.M{"type": GroupChatRoom}),
+				},
+			)
+		},
+	},
+}
+
+// mergeDuplicateGroups merges the groups created more than once under the same name
+// into the oldest one, moving their participants and messages. The read receipts of
+// the merged groups are dropped, their participants are marked read again.
+func mergeDuplicateGroups(ctx context.Context, db *mongo.Database) error {
+	cursor, err := db.Collection(Rooms).Aggregate(ctx, bson.A{
+		bson.M{"$match": bson.M{"type": GroupChatRoom}},
+		bson.M{"$sort": bson.M{"_id": 1}},
+		bson.M{"$group": bson.M{"_id": "$name", "ids": bson.M{"$push": "$_id"}, "participants": bson.M{"$push": "$participants"}}},
+		bson.M{"$match": bson.M{"ids.1": bson.M{"$exists": true}}},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to find duplicate groups: %w", err)
+	}
+
+	var duplicates []struct {
+		Name         string                 `bson:"_id"`
+		IDs          []primitive.ObjectID   `bson:"ids"`
+		Participants [][]primitive.ObjectID `bson:"participants"`
+	}
+	err = cursor.All(ctx, &duplicates)
+	if err != nil {
+		return fmt.Errorf("failed to read duplicate groups: %w", err)
+	}
+
+	for _, duplicate := range duplicates {
+		kept, merged := duplicate.IDs[0], duplicate.IDs[1:]
+
+		_, err = db.Collection(Rooms).UpdateByID(ctx, kept, bson.M{
+			"$addToSet": bson.M{"participants": bson.M{"$each": slices.Concat(duplicate.Participants...)}},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to merge the participants of group '%s': %w", duplicate.Name, err)
+		}
+
+		_, err = db.Collection(Message).UpdateMany(ctx, bson.M{"room_id": bson.M{"$in": merged}}, bson.M{"$set": bson.M{"room_id": kept}})
+		if err != nil {
+			return fmt.Errorf("failed to merge the messages of group '%s': %w", duplicate.Name, err)
+		}
+
+		_, err = db.Collection(ReadReceipts).DeleteMany(ctx, bson.M{"room_id": bson.M{"$in": merged}})
+		if err != nil {
+			return fmt.Errorf("failed to delete the read receipts of group '%s': %w", duplicate.Name, err)
+		}
+
+		_, err = db.Collection(Rooms).DeleteMany(ctx, bson.M{"_id": bson.M{"$in": merged}})
+		if err != nil {
+			return fmt.Errorf("failed to delete the duplicates of group '%s': %w", duplicate.Name, err)
+		}
+
+		log.Printf("merged %d duplicates of group '%s'", len(merged), duplicate.Name)
+	}
+
+	return nil
+}
+
+func createIndexes(ctx context.Context, collection *mongo.Collection, indexes ...mongo.IndexModel) error {
+	_, err := collection.Indexes().CreateMany(ctx, indexes)
+	if err != nil {
+		return fmt.Errorf("failed to create indexes on %s: %w", collection.Name(), err)
+	}
+
+	return nil
+}
+
+// Migrate applies the migrations that have not been applied yet and records
+// their versions in the Migrations collection. SetupDatabase must be called first.
+func Migrate(ctx context.Context) error {
+	collection := Database.Collection(Migrations)
+
+	for _, migration := range migrations {
+		err := collection.FindOne(ctx, bson.M{"_id": migration.Version}).Err()
+		if err == nil {
+			continue
+		} else if !errors.Is(err, mongo.ErrNoDocuments) {
+			return fmt.Errorf("failed to read migration %d: %w", migration.Version, err)
+		}
+
+		err = migration.Up(ctx, Database)
+		if err != nil {
+			return fmt.Errorf("failed to apply migration %d (%s): %w", migration.Version, migration.Description, err)
+		}
+
+		_, err = collection.InsertOne(ctx, migrationRecord{
+			Version:     migration.Version,
+			Description: migration.Description,
+			AppliedAt:   time.Now(),
+		})
+		// Another instance may have applied it meanwhile
+		if err != nil && !mongo.IsDuplicateKeyError(err) {
+			return fmt.Errorf("failed to record migration %d: %w", migration.Version, err)
+		}
+
+		log.Printf("applied migration %d: %s", migration.Version, migration.Description)
+	}
+
+	return nil
+}
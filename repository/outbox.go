@@ -0,0 +1,151 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+const (
+	OutboxPending = "pending"
+	OutboxSent    = "sent"
+	OutboxFailed  = "failed" // Given up after too many attempts, kept for inspection
+)
+
+// OutboxRetention is how long sent records are kept before they are deleted
+const OutboxRetention = 24 * time.Hour
+
+// OutboxModel is a message waiting to be published to the broker. It is written
+// in the same transaction as the data it announces, and published by a relay,
+// so that everything persisted is eventually delivered.
+type OutboxModel struct {
+	ID          primitive.ObjectID `bson:"_id"`
+	Topic       string             `bson:"topic"`
+	Body        []byte             `bson:"body"`
+	Status      string             `bson:"status"`
+	Attempts    int                `bson:"attempts"`
+	LockedBy    string             `bson:"locked_by,omitempty"`       // Instance relaying the record
+	LockedUntil time.Time          `bson:"locked_until,omitempty"`    // Another instance may relay the record afterwards
+	NextAttempt time.Time          `bson:"next_attempt_at,omitempty"` // A failed record is not retried before
+	CreatedAt   time.Time          `bson:"created_at"`
+	SentAt      *time.Time         `bson:"sent_at,omitempty"`
+}
+
+func NewOutbox() *Model[*OutboxModel] {
+	outboxCollection := Database.Collection(Outbox)
+
+	return newModel[*OutboxModel](outboxCollection)
+}
+
+func (om *OutboxModel) GetID() primitive.ObjectID {
+	return om.ID
+}
+
+func (om *OutboxModel) SetID(id primitive.ObjectID) {
+	om.ID = id
+}
+
+func (om *OutboxModel) SetTimestamp() {
+	om.CreatedAt = time.Now()
+}
+
+// ClaimPending locks the oldest pending record that no other instance is relaying
+// and that is due for an attempt, for the lease duration. It returns nil without
+// an error when nothing is pending.
+func (m *Model[T]) ClaimPending(ctx context.Context, instanceId string, lease time.Duration) (*OutboxModel, error) {
+	outboxRepo := NewOutbox()
+
+	now := time.Now()
+	filter := bson.M{
+		"status": OutboxPending,
+		"$and": bson.A{
+			bson.M{"$or": bson.A{
+				bson.M{"locked_until": bson.M{"$exists": false}},
+				bson.M{"locked_until": bson.M{"$lte": now}},
+			}},
+			bson.M{"$or": bson.A{
+				bson.M{"next_attempt_at": bson.M{"$exists": false}},
+				bson.M{"next_attempt_at": bson.M{"$lte": now}},
+			}},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{"locked_by": instanceId, "locked_until": now.Add(lease)},
+		"$inc": bson.M{"attempts": 1},
+	}
+	updateOptions := options.FindOneAndUpdate().
+		SetSort(bson.D{{Key: "_id", Value: 1}}).
+		SetReturnDocument(options.After)
+
+	result := outboxRepo.collection.FindOneAndUpdate(ctx, filter, update, updateOptions)
+	if errors.Is(result.Err(), mongo.ErrNoDocuments) {
+		return nil, nil
+	} else if result.Err() != nil {
+		return nil, fmt.Errorf("failed to claim outbox record: %w", result.Err())
+	}
+
+	var record OutboxModel
+	err := result.Decode(&record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode outbox record: %w", err)
+	}
+
+	return &record, nil
+}
+
+// MarkSent records that the claimed record has been published
+func (m *Model[T]) MarkSent(ctx context.Context, id primitive.ObjectID) error {
+	outboxRepo := NewOutbox()
+
+	update := bson.M{
+		"$set":   bson.M{"status": OutboxSent, "sent_at": time.Now()},
+		"$unset": bson.M{"locked_by": "", "locked_until": ""},
+	}
+
+	_, err := outboxRepo.collection.UpdateByID(ctx, id, update)
+	if err != nil {
+		return fmt.Errorf("failed to mark outbox record as sent: %w", err)
+	}
+
+	return nil
+}
+
+// Release unlocks a claimed record that failed to be published, so that it is
+// retried from retryAt
+func (m *Model[T]) Release(ctx context.Context, id primitive.ObjectID, retryAt time.Time) error {
+	outboxRepo := NewOutbox()
+
+	update := bson.M{
+		"$set":   bson.M{"next_attempt_at": retryAt},
+		"$unset": bson.M{"locked_by": "", "locked_until": ""},
+	}
+
+	_, err := outboxRepo.collection.UpdateByID(ctx, id, update)
+	if err != nil {
+		return fmt.Errorf("failed to release outbox record: %w", err)
+	}
+
+	return nil
+}
+
+// MarkFailed gives up on a claimed record, it is no longer relayed
+func (m *Model[T]) MarkFailed(ctx context.Context, id primitive.ObjectID) error {
+	outboxRepo := NewOutbox()
+
+	update := bson.M{
+		"$set":   bson.M{"status": OutboxFailed},
+		"$unset": bson.M{"locked_by": "", "locked_until": "", "next_attempt_at": ""},
+	}
+
+	_, err := outboxRepo.collection.UpdateByID(ctx, id, update)
+	if err != nil {
+		return fmt.Errorf("failed to mark outbox record as failed: %w", err)
+	}
+
+	return nil
+}
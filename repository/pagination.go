@@ -0,0 +1,20 @@
+package repository
+
+// Sort orders a list on a stored field, e.g. created_at, the ID breaking ties in the same
+// direction. The SQL stores write the field into the query, it must come from a whitelist.
+type Sort struct {
+	Field      string
+	Descending bool
+}
+
+// Page selects a page of a list, numbered from 1. A limit of zero selects every entity.
+type Page struct {
+	Number int
+	Limit  int
+	Sort   Sort
+}
+
+// Skip returns the number of entities listed before the page
+func (p Page) Skip() int {
+	return max(p.Number-1, 0) * p.Limit
+}
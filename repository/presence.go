@@ -0,0 +1,207 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"slices"
+	"time"
+)
+
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// PresenceModel is keyed by the user ID. Instances lists the server instances
+// currently holding a connection of the user, so that the user only goes
+// offline once the last instance lets go of them.
+type PresenceModel struct {
+	ID        primitive.ObjectID `bson:"_id"`
+	Status    string             `bson:"status"`
+	Instances []string           `bson:"instances"`
+	LastSeen  time.Time          `bson:"last_seen"`
+}
+
+func NewPresence() *Model[*PresenceModel] {
+	presenceCollection := Database.Collection(Presence)
+
+	return newModel[*PresenceModel](presenceCollection)
+}
+
+func (pm *PresenceModel) GetID() primitive.ObjectID {
+	return pm.ID
+}
+
+func (pm *PresenceModel) SetID(id primitive.ObjectID) {
+	pm.ID = id
+}
+
+func (pm *PresenceModel) SetTimestamp() {
+	pm.LastSeen = time.Now()
+}
+
+func (m *Model[T]) FindPresence(ctx context.Context, userId primitive.ObjectID) (*PresenceModel, error) {
+	presenceRepo := NewPresence()
+
+	presence, err := presenceRepo.FindOne(ctx, bson.M{"_id": userId})
+	if err != nil {
+		return nil, err
+	}
+
+	return *presence, nil
+}
+
+// ConnectInstance records that the user is connected to the instance and marks them online
+func (m *Model[T]) ConnectInstance(ctx context.Context, userId primitive.ObjectID, instanceId string) (*PresenceModel, error) {
+	update := bson.M{
+		"$addToSet": bson.M{"instances": instanceId},
+		"$set":      bson.M{"status": PresenceOnline, "last_seen": time.Now()},
+	}
+
+	return updatePresence(ctx, bson.M{"_id": userId}, update, true)
+}
+
+// DisconnectInstance records that the user is no longer connected to the instance.
+// The user goes offline when no other instance holds a connection of theirs.
+func (m *Model[T]) DisconnectInstance(ctx context.Context, userId primitive.ObjectID, instanceId string) (*PresenceModel, error) {
+	return updatePresence(ctx, bson.M{"_id": userId}, leaveInstancePipeline(instanceId), false)
+}
+
+// SetStatus changes the status of a connected user, e.g. to away
+func (m *Model[T]) SetStatus(ctx context.Context, userId primitive.ObjectID, status string) (*PresenceModel, error) {
+	filter := bson.M{"_id": userId, "instances.0": bson.M{"$exists": true}}
+	update := bson.M{"$set": bson.M{"status": status, "last_seen": time.Now()}}
+
+	return updatePresence(ctx, filter, update, false)
+}
+
+// ReleaseInstance removes the instance from every user, e.g. when the instance
+// restarts and none of its previous connections exist anymore, and deletes its lease
+func (m *Model[T]) ReleaseInstance(ctx context.Context, instanceId string) ([]*PresenceModel, error) {
+	presenceRepo := NewPresence()
+
+	cursor, err := presenceRepo.collection.Find(ctx, bson.M{"instances": instanceId}, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("failed to release instance '%s': %w", instanceId, err)
+	}
+
+	var users []struct {
+		ID primitive.ObjectID `bson:"_id"`
+	}
+	err = cursor.All(ctx, &users)
+	if err != nil {
+		return nil, fmt.Errorf("failed to release instance '%s': %w", instanceId, err)
+	}
+
+	// Each user is only returned by the instance removing the instance from them,
+	// when several instances release the same one
+	released := make([]*PresenceModel, 0, len(users))
+	for _, user := range users {
+		presence, err := updatePresence(ctx, bson.M{"_id": user.ID, "instances": instanceId}, leaveInstancePipeline(instanceId), false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to release instance '%s': %w", instanceId, err)
+		}
+		if presence != nil {
+			released = append(released, presence)
+		}
+	}
+
+	_, err = Database.Collection(Instances).DeleteOne(ctx, bson.M{"_id": instanceId})
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete lease of instance '%s': %w", instanceId, err)
+	}
+
+	return released, nil
+}
+
+// Heartbeat extends the lease of the instance until ttl from now
+func (m *Model[T]) Heartbeat(ctx context.Context, instanceId string, ttl time.Duration) error {
+	update := bson.M{"$set": bson.M{"expires_at": time.Now().Add(ttl)}}
+
+	_, err := Database.Collection(Instances).UpdateOne(ctx, bson.M{"_id": instanceId}, update, options.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("failed to extend lease of instance '%s': %w", instanceId, err)
+	}
+
+	return nil
+}
+
+// ExpiredInstances returns the instances holding users whose lease expired or
+// who never had one
+func (m *Model[T]) ExpiredInstances(ctx context.Context) ([]string, error) {
+	presenceRepo := NewPresence()
+
+	instances, err := presenceRepo.collection.Distinct(ctx, "instances", bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find presence instances: %w", err)
+	}
+
+	cursor, err := Database.Collection(Instances).Find(ctx, bson.M{"expires_at": bson.M{"$gt": time.Now()}})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find instance leases: %w", err)
+	}
+
+	var leases []struct {
+		ID string `bson:"_id"`
+	}
+	err = cursor.All(ctx, &leases)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode instance leases: %w", err)
+	}
+
+	live := make(map[string]bool, len(leases))
+	for _, lease := range leases {
+		live[lease.ID] = true
+	}
+
+	expired := []string{}
+	for _, instance := range instances {
+		instanceId, ok := instance.(string)
+		if ok && !live[instanceId] {
+			expired = append(expired, instanceId)
+		}
+	}
+	slices.Sort(expired)
+
+	return expired, nil
+}
+
+func leaveInstancePipeline(instanceId string) bson.A {
+	return bson.A{
+		bson.M{"$set": bson.M{
+			"instances": bson.M{"$setDifference": bson.A{bson.M{"$ifNull": bson.A{"$instances", bson.A{}}}, bson.A{instanceId}}},
+			"last_seen": time.Now(),
+		}},
+		bson.M{"$set": bson.M{
+			"status": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{bson.M{"$size": "$instances"}, 0}}, PresenceOffline, "$status"}},
+		}},
+	}
+}
+
+// updatePresence applies the update and returns the resulting presence,
+// or nil when no presence matches the filter and upsert is disabled
+func updatePresence(ctx context.Context, filter interface{}, update interface{}, upsert bool) (*PresenceModel, error) {
+	presenceRepo := NewPresence()
+
+	updateOptions := options.FindOneAndUpdate().SetUpsert(upsert).SetReturnDocument(options.After)
+	result := presenceRepo.collection.FindOneAndUpdate(ctx, filter, update, updateOptions)
+	if errors.Is(result.Err(), mongo.ErrNoDocuments) {
+		return nil, nil
+	} else if result.Err() != nil {
+		return nil, fmt.Errorf("failed to update presence: %w", result.Err())
+	}
+
+	var presence PresenceModel
+	err := result.Decode(&presence)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode presence: %w", err)
+	}
+
+	return &presence, nil
+}
@@ -0,0 +1,178 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"time"
+)
+
+// ReadReceiptModel is the read cursor of a user in a room:
+// the last message the user has read there
+type ReadReceiptModel struct {
+	ID                primitive.ObjectID `bson:"_id"`
+	RoomID            primitive.ObjectID `bson:"room_id"`
+	UserID            primitive.ObjectID `bson:"user_id"`
+	LastReadMessageID primitive.ObjectID `bson:"last_read_message_id"`
+	LastReadAt        time.Time          `bson:"last_read_at"` // Timestamp of the last read message
+	UpdatedAt         time.Time          `bson:"updated_at"`
+}
+
+func NewReadReceipt() *Model[*ReadReceiptModel] {
+	readReceiptCollection := Database.Collection(ReadReceipts)
+
+	return newModel[*ReadReceiptModel](readReceiptCollection)
+}
+
+func (rm *ReadReceiptModel) GetID() primitive.ObjectID {
+	return rm.ID
+}
+
+func (rm *ReadReceiptModel) SetID(id primitive.ObjectID) {
+	rm.ID = id
+}
+
+func (rm *ReadReceiptModel) SetTimestamp() {
+	rm.UpdatedAt = time.Now()
+}
+
+// MarkRead moves the read cursor of the user in the message's room up to the message.
+// The cursor never moves backwards, marking an older message as read is a no-op.
+func (m *Model[T]) MarkRead(ctx context.Context, userId primitive.ObjectID, message *MessageModel) (*ReadReceiptModel, error) {
+	readReceiptRepo := NewReadReceipt()
+
+	// Messages are ordered by timestamp and then ID
+	isNewer := bson.M{"$or": bson.A{
+		bson.M{"$gt": bson.A{message.Timestamp, "$last_read_at"}},
+		bson.M{"$and": bson.A{
+			bson.M{"$eq": bson.A{message.Timestamp, "$last_read_at"}},
+			bson.M{"$gt": bson.A{message.ID, "$last_read_message_id"}},
+		}},
+	}}
+	// Dates are stored with a millisecond precision, updated_at tells whether this update moved the cursor
+	now := time.Now().Truncate(time.Millisecond)
+	update := bson.A{
+		bson.M{"$set": bson.M{
+			"last_read_message_id": bson.M{"$cond": bson.A{isNewer, message.ID, "$last_read_message_id"}},
+			"last_read_at":         bson.M{"$cond": bson.A{isNewer, message.Timestamp, "$last_read_at"}},
+			"updated_at":           bson.M{"$cond": bson.A{isNewer, now, "$updated_at"}},
+		}},
+	}
+
+	filter := bson.M{"room_id": message.RoomID, "user_id": userId}
+	updateOptions := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	result := readReceiptRepo.collection.FindOneAndUpdate(ctx, filter, update, updateOptions)
+	if result.Err() != nil {
+		return nil, fmt.Errorf("failed to update read receipt: %w", result.Err())
+	}
+
+	var receipt ReadReceiptModel
+	err := result.Decode(&receipt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode read receipt: %w", err)
+	}
+
+	if receipt.LastReadMessageID == message.ID && receipt.UpdatedAt.Equal(now) {
+		m.listeners.NotifyRead(&receipt)
+	}
+
+	return &receipt, nil
+}
+
+// CountUnread counts the messages of other users in the room that come after the user's read cursor
+func (m *Model[T]) CountUnread(ctx context.Context, roomId primitive.ObjectID, userId primitive.ObjectID) (int64, error) {
+	readReceiptRepo := NewReadReceipt()
+	msgRepo := NewMessage()
+
+	filter := bson.M{"room_id": roomId, "sender_id": bson.M{"$ne": userId}}
+
+	receipt, err := readReceiptRepo.FindOne(ctx, bson.M{"room_id": roomId, "user_id": userId})
+	if err == nil {
+		filter["$or"] = bson.A{
+			bson.M{"timestamp": bson.M{"$gt": (*receipt).LastReadAt}},
+			bson.M{"timestamp": (*receipt).LastReadAt, "_id": bson.M{"$gt": (*receipt).LastReadMessageID}},
+		}
+	} else if !errors.Is(err, ErrNotFound) {
+		return 0, err
+	}
+
+	count, err := msgRepo.collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count unread messages: %w", err)
+	}
+
+	return count, nil
+}
+
+// CountUnreadByRooms counts the unread messages of the user in each of the rooms, in a single
+// aggregation grouping the messages after the read cursors of the user by room
+func (m *Model[T]) CountUnreadByRooms(ctx context.Context, userId primitive.ObjectID, roomIds []primitive.ObjectID) (map[primitive.ObjectID]int64, error) {
+	counts := make(map[primitive.ObjectID]int64, len(roomIds))
+	if len(roomIds) == 0 {
+		return counts, nil
+	}
+
+	readReceiptRepo := NewReadReceipt()
+	msgRepo := NewMessage()
+
+	receipts, err := readReceiptRepo.Find(ctx, bson.M{"user_id": userId, "room_id": bson.M{"$in": roomIds}}, Page{})
+	if err != nil {
+		return nil, err
+	}
+
+	// Every message of a room without read cursor is unread
+	unreadAfter := make(map[primitive.ObjectID]*ReadReceiptModel, len(receipts))
+	for _, receipt := range receipts {
+		unreadAfter[(*receipt).RoomID] = *receipt
+	}
+
+	var unread bson.A
+	var unreadRooms bson.A
+	for _, roomId := range roomIds {
+		counts[roomId] = 0
+
+		receipt, found := unreadAfter[roomId]
+		if !found {
+			unreadRooms = append(unreadRooms, roomId)
+			continue
+		}
+
+		unread = append(unread, bson.M{"room_id": roomId, "$or": bson.A{
+			bson.M{"timestamp": bson.M{"$gt": receipt.LastReadAt}},
+			bson.M{"timestamp": receipt.LastReadAt, "_id": bson.M{"$gt": receipt.LastReadMessageID}},
+		}})
+	}
+	if len(unreadRooms) > 0 {
+		unread = append(unread, bson.M{"room_id": bson.M{"$in": unreadRooms}})
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"sender_id": bson.M{"$ne": userId}, "$or": unread}}},
+		{{Key: "$group", Value: bson.M{"_id": "$room_id", "count": bson.M{"$sum": 1}}}},
+	}
+
+	cursor, err := msgRepo.collection.Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count unread messages: %w", err)
+	}
+
+	var results []struct {
+		RoomID primitive.ObjectID `bson:"_id"`
+		Count  int64              `bson:"count"`
+	}
+	err = cursor.All(ctx, &results)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode unread counts: %w", err)
+	}
+
+	for _, result := range results {
+		counts[result.RoomID] = result.Count
+	}
+
+	return counts, nil
+}
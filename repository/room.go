@@ -2,10 +2,14 @@ package repository
 
 import (
 	"context"
+	"errors"
 	"github.com/labstack/echo/v4"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
-	"log"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"net/http"
+	"slices"
 	"time"
 )
 
@@ -57,16 +61,10 @@ func (m *Model[T]) JoinPrivateChatRoom(currentUserId primitive.ObjectID, targetU
 	userRepo := NewUser()
 	targetUser, err := userRepo.FindById(ctx, targetUserId.Hex())
 	if err != nil {
-		badRequestError := echo.ErrBadRequest
-		badRequestError.Message = "invalid targetParticipantId received"
-
-		return nil, badRequestError
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid targetParticipantId received")
 	}
 	if (*targetUser).ID == currentUserId {
-		badRequestError := echo.ErrBadRequest
-		badRequestError.Message = "targetParticipantId cannot be the same as the current user id"
-
-		return nil, badRequestError
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "targetParticipantId cannot be the same as the current user id")
 	}
 
 	existingRoom, err := roomRepo.FindOne(ctx, filter)
@@ -77,12 +75,11 @@ func (m *Model[T]) JoinPrivateChatRoom(currentUserId primitive.ObjectID, targetU
 			Participants: []primitive.ObjectID{currentUserId, targetUserId},
 		})
 		if err != nil {
-			serverError := echo.ErrInternalServerError
-			serverError.Message = "failed to join room: " + err.Error()
-
-			return nil, serverError
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to join room: "+err.Error())
 		}
 
+		m.listeners.NotifyRoomJoin((*newChatRoom).ID, currentUserId, targetUserId)
+
 		return *newChatRoom, nil
 	} else {
 		return *existingRoom, nil
@@ -90,48 +87,93 @@ func (m *Model[T]) JoinPrivateChatRoom(currentUserId primitive.ObjectID, targetU
 }
 
 func (m *Model[T]) JoinGroupChatRoom(currentUserId primitive.ObjectID, roomName string) (*RoomModel, error) {
-
 	roomRepo := NewRoom()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	existingRoomReference, err := roomRepo.FindOne(ctx, bson.M{"name": roomName})
+	// The participant is added in place and the room created by the first join,
+	// so that concurrent joins neither lose participants nor create the room twice
+	newRoom := &RoomModel{
+		ID:           primitive.NewObjectID(),
+		Name:         roomName,
+		Type:         GroupChatRoom,
+		Participants: []primitive.ObjectID{currentUserId},
+		CreatedAt:    time.Now(),
+	}
+	filter := bson.M{"name": roomName, "type": GroupChatRoom}
+	update := bson.M{
+		"$addToSet":    bson.M{"participants": currentUserId},
+		"$setOnInsert": bson.M{"_id": newRoom.ID, "created_at": newRoom.CreatedAt},
+	}
+	// The room before the update tells whether the user joined it
+	updateOptions := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before)
+
+	result := roomRepo.collection.FindOneAndUpdate(ctx, filter, update, updateOptions)
+	if mongo.IsDuplicateKeyError(result.Err()) {
+		// Another user created the room meanwhile, join it instead
+		result = roomRepo.collection.FindOneAndUpdate(ctx, filter, update, updateOptions)
+	}
+
+	if errors.Is(result.Err(), mongo.ErrNoDocuments) {
+		m.listeners.NotifyRoomJoin(newRoom.ID, currentUserId)
+
+		return newRoom, nil
+	} else if result.Err() != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to join room: "+result.Err().Error())
+	}
+
+	var room RoomModel
+	err := result.Decode(&room)
 	if err != nil {
-		log.Printf("room '%s' does not exist. creating one...", roomName)
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to decode room: "+err.Error())
 	}
 
-	if existingRoomReference != nil {
-		existingRoom := *existingRoomReference
+	// a user should not join a room twice
+	if slices.Contains(room.Participants, currentUserId) {
+		return &room, nil
+	}
 
-		// a user should not join a room twice
-		for _, v := range existingRoom.Participants {
-			if v == currentUserId {
-				return existingRoom, nil
-			}
-		}
+	room.Participants = append(room.Participants, currentUserId)
+	m.listeners.NotifyRoomJoin(room.ID, currentUserId)
 
-		existingRoom.Participants = append(existingRoom.Participants, currentUserId)
-		updatedRoom, err := roomRepo.Update(ctx, existingRoom.ID.Hex(), existingRoom)
-		if err != nil {
-			serverError := echo.ErrInternalServerError
-			serverError.Message = "failed to join room: " + err.Error()
+	return &room, nil
+}
 
-			return nil, serverError
-		}
+func (m *Model[T]) FindParticipantRooms(ctx context.Context, userId primitive.ObjectID) ([]*RoomModel, error) {
+	roomRepo := NewRoom()
 
-		return *updatedRoom, nil
+	// A limit of zero returns every room the user participates in
+	roomReferences, err := roomRepo.Find(ctx, bson.M{"participants": userId}, Page{Number: 1})
+	if err != nil {
+		return nil, err
 	}
 
-	var participants []primitive.ObjectID
-	participants = make([]primitive.ObjectID, 1)
-	participants[0] = currentUserId
+	return unwrap(roomReferences), nil
+}
 
-	newRoom, err := roomRepo.Create(ctx, &RoomModel{
-		Name:         roomName,
-		Type:         GroupChatRoom,
-		Participants: participants,
-	})
+func (m *Model[T]) FindRoom(ctx context.Context, id primitive.ObjectID) (*RoomModel, error) {
+	roomRepo := NewRoom()
+
+	room, err := roomRepo.FindOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return nil, err
+	}
+
+	return *room, nil
+}
+
+func (m *Model[T]) FindRooms(ctx context.Context, page Page) ([]*RoomModel, error) {
+	roomRepo := NewRoom()
+
+	rooms, err := roomRepo.Find(ctx, bson.M{}, page)
+	if err != nil {
+		return nil, err
+	}
+
+	return unwrap(rooms), nil
+}
 
-	return *newRoom, nil
+func (m *Model[T]) CountRooms(ctx context.Context) (int64, error) {
+	return NewRoom().Count(ctx, bson.M{})
 }
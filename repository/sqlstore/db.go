@@ -0,0 +1,229 @@
+// Package sqlstore implements the repository stores on top of a SQL database.
+// Queries are written once with ? placeholders and adapted to the dialect.
+package sqlstore
+
+import (
+	"chat-server/repository"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dialect describes the differences between the supported databases
+type Dialect struct {
+	Name       string
+	DriverName string
+	// numberedPlaceholders replaces ? with $1, $2...
+	numberedPlaceholders bool
+	// skipLocked is appended to the row selections that lock rows for an update
+	skipLocked string
+	// migrationLock serializes the migrations of concurrently starting instances
+	migrationLock string
+	// maxOpenConns limits the connection pool, zero means unlimited
+	maxOpenConns int
+	// isDuplicate reports whether the error is a unique constraint violation
+	isDuplicate func(err error) bool
+}
+
+// DB holds the connection pool. It implements all the stores of repository.Store.
+type DB struct {
+	db        *sql.DB
+	dialect   Dialect
+	listeners *repository.Listeners
+	stopPurge context.CancelFunc // Stops the outbox purge
+}
+
+// Open connects to the database and applies the pending migrations
+func Open(dialect Dialect, dataSourceName string) (*DB, error) {
+	sqlDB, err := sql.Open(dialect.DriverName, dataSourceName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s database: %w", dialect.Name, err)
+	}
+
+	sqlDB.SetMaxOpenConns(dialect.maxOpenConns)
+	db := &DB{db: sqlDB, dialect: dialect, listeners: &repository.Listeners{}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err = sqlDB.PingContext(ctx)
+	if err != nil {
+		_ = sqlDB.Close()
+		return nil, fmt.Errorf("failed to connect to %s database: %w", dialect.Name, err)
+	}
+
+	err = db.migrate(ctx)
+	if err != nil {
+		_ = sqlDB.Close()
+		return nil, err
+	}
+
+	purgeCtx, stopPurge := context.WithCancel(context.Background())
+	db.stopPurge = stopPurge
+	go db.purgeOutbox(purgeCtx)
+
+	return db, nil
+}
+
+// Store returns the stores backed by the database
+func (db *DB) Store() *repository.Store {
+	return &repository.Store{
+		Users:        db,
+		Rooms:        db,
+		Messages:     db,
+		ReadReceipts: db,
+		Presence:     db,
+		Outbox:       db,
+		Listeners:    db.listeners,
+	}
+}
+
+func (db *DB) Close() error {
+	db.stopPurge()
+
+	return db.db.Close()
+}
+
+// rebind adapts the placeholders of the query to the dialect
+func (db *DB) rebind(query string) string {
+	if !db.dialect.numberedPlaceholders {
+		return query
+	}
+
+	var rebound strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			rebound.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		rebound.WriteRune(r)
+	}
+
+	return rebound.String()
+}
+
+// querier is implemented by both *sql.DB and *sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// inTx runs fn in a transaction, committed when fn succeeds
+func (db *DB) inTx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+
+	err = fn(tx)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
+
+// notFound turns sql.ErrNoRows into repository.ErrNotFound
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return repository.ErrNotFound
+	}
+
+	return err
+}
+
+// utc stores every time in UTC, so that times compare the same way in every dialect
+func utc(t time.Time) time.Time {
+	return t.UTC()
+}
+
+// nullTime stores a zero time as NULL
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: utc(t), Valid: !t.IsZero()}
+}
+
+// limitOffset returns the pagination clause, every row with a limit of zero
+func limitOffset(page int, limit int) string {
+	if limit <= 0 {
+		return ""
+	}
+
+	return fmt.Sprintf(" LIMIT %d OFFSET %d", limit, max(page-1, 0)*limit)
+}
+
+// orderBy returns the sorting clause of the page, the ID breaking ties in the same direction
+func orderBy(page repository.Page) string {
+	if page.Sort.Field == "" {
+		return ""
+	}
+
+	direction := "ASC"
+	if page.Sort.Descending {
+		direction = "DESC"
+	}
+
+	return " ORDER BY " + page.Sort.Field + " " + direction + ", id " + direction
+}
+
+// count runs a COUNT query
+func (db *DB) count(ctx context.Context, query string, args ...any) (int64, error) {
+	var count int64
+	err := db.db.QueryRowContext(ctx, db.rebind(query), args...).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error counting: %w", err)
+	}
+
+	return count, nil
+}
+
+// placeholders returns n comma separated placeholders, for IN clauses
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// objectID scans the hex encoded IDs
+type objectID struct {
+	id *primitive.ObjectID
+}
+
+func scanID(id *primitive.ObjectID) objectID {
+	return objectID{id: id}
+}
+
+func (o objectID) Scan(value any) error {
+	var hex string
+	switch v := value.(type) {
+	case nil:
+		*o.id = primitive.NilObjectID
+		return nil
+	case string:
+		hex = v
+	case []byte:
+		hex = string(v)
+	default:
+		return fmt.Errorf("cannot scan %T into an object ID", value)
+	}
+
+	id, err := primitive.ObjectIDFromHex(hex)
+	if err != nil {
+		return err
+	}
+
+	*o.id = id
+
+	return nil
+}
@@ -0,0 +1,236 @@
+package sqlstore
+
+import (
+	"chat-server/repository"
+	"chat-server/repository/storetest"
+	"context"
+	"database/sql"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var dialects = []Dialect{SQLite, Postgres}
+
+var schemas atomic.Int64
+
+// newDataSource returns the data source of an empty database. SQLite databases are
+// files in a temporary directory, Postgres ones are schemas of the database at
+// POSTGRES_URL, dropped afterwards; Postgres tests are skipped without POSTGRES_URL.
+func newDataSource(t *testing.T, dialect Dialect) string {
+	t.Helper()
+
+	if dialect.Name == SQLite.Name {
+		return SQLiteDataSource(filepath.Join(t.TempDir(), "chat.db"))
+	}
+
+	postgresURL := os.Getenv("POSTGRES_URL")
+	if postgresURL == "" {
+		t.Skip("POSTGRES_URL is not set")
+	}
+
+	admin, err := sql.Open(Postgres.DriverName, postgresURL)
+	if err != nil {
+		t.Fatalf("failed to open the postgres database: %v", err)
+	}
+	t.Cleanup(func() { _ = admin.Close() })
+
+	schema := fmt.Sprintf("chat_server_test_%d_%d", os.Getpid(), schemas.Add(1))
+	_, err = admin.Exec("CREATE SCHEMA " + schema)
+	if err != nil {
+		t.Fatalf("failed to create schema: %v", err)
+	}
+	t.Cleanup(func() { _, _ = admin.Exec("DROP SCHEMA " + schema + " CASCADE") })
+
+	dataSource, err := url.Parse(postgresURL)
+	if err != nil {
+		t.Fatalf("POSTGRES_URL must be a URL: %v", err)
+	}
+
+	// pgx sets the unknown parameters on the connections
+	query := dataSource.Query()
+	query.Set("search_path", schema)
+	dataSource.RawQuery = query.Encode()
+
+	return dataSource.String()
+}
+
+func open(t *testing.T, dialect Dialect, dataSource string) *DB {
+	t.Helper()
+
+	db, err := Open(dialect, dataSource)
+	if err != nil {
+		t.Fatalf("Open() failed: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	return db
+}
+
+func TestStore(t *testing.T) {
+	for _, dialect := range dialects {
+		t.Run(dialect.Name, func(t *testing.T) {
+			storetest.Run(t, func(t *testing.T) *repository.Store {
+				return open(t, dialect, newDataSource(t, dialect)).Store()
+			})
+		})
+	}
+}
+
+func assertMigrated(t *testing.T, db *DB) {
+	t.Helper()
+
+	files, err := fs.ReadDir(migrations, path.Join("migrations", db.dialect.Name))
+	if err != nil {
+		t.Fatalf("failed to read migrations: %v", err)
+	}
+
+	var applied int
+	err = db.db.QueryRow("SELECT COUNT(*) FROM schema_migrations").Scan(&applied)
+	if err != nil || applied != len(files) {
+		t.Errorf("%d migrations recorded, %v; want %d", applied, err, len(files))
+	}
+}
+
+func TestMigrateTwice(t *testing.T) {
+	for _, dialect := range dialects {
+		t.Run(dialect.Name, func(t *testing.T) {
+			dataSource := newDataSource(t, dialect)
+
+			db := open(t, dialect, dataSource)
+			storetest.CreateUser(t, db.Store(), "alice")
+
+			err := db.migrate(context.Background())
+			if err != nil {
+				t.Fatalf("migrate() of a migrated database failed: %v", err)
+			}
+			_ = db.Close()
+
+			// Reopening keeps the data
+			db = open(t, dialect, dataSource)
+			assertMigrated(t, db)
+
+			count, err := db.CountUsers(context.Background())
+			if err != nil || count != 1 {
+				t.Errorf("CountUsers() after migrating twice = %d, %v; want 1", count, err)
+			}
+		})
+	}
+}
+
+// TestConcurrentMigrations starts instances together on an empty database,
+// the migration lock lets a single one apply each migration
+func TestConcurrentMigrations(t *testing.T) {
+	dataSource := newDataSource(t, Postgres)
+
+	var wg sync.WaitGroup
+	dbs := make([]*DB, 5)
+	errs := make([]error, len(dbs))
+	for i := range dbs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dbs[i], errs[i] = Open(Postgres, dataSource)
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent Open() failed: %v", err)
+		}
+		t.Cleanup(func() { _ = dbs[i].Close() })
+	}
+
+	assertMigrated(t, dbs[0])
+}
+
+// TestConcurrentGroupJoin has users join a group room that does not exist yet
+// together, they must all end up in the same room
+func TestConcurrentGroupJoin(t *testing.T) {
+	for _, dialect := range dialects {
+		t.Run(dialect.Name, func(t *testing.T) {
+			store := open(t, dialect, newDataSource(t, dialect)).Store()
+
+			users := make([]*repository.UserModel, 10)
+			for i := range users {
+				users[i] = storetest.CreateUser(t, store, fmt.Sprintf("user%d", i))
+			}
+
+			var wg sync.WaitGroup
+			rooms := make([]*repository.RoomModel, len(users))
+			errs := make([]error, len(users))
+			for i, user := range users {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					rooms[i], errs[i] = store.Rooms.JoinGroupChatRoom(user.ID, "general")
+				}()
+			}
+			wg.Wait()
+
+			for i, err := range errs {
+				if err != nil {
+					t.Fatalf("concurrent JoinGroupChatRoom() failed: %v", err)
+				}
+				if rooms[i].ID != rooms[0].ID {
+					t.Fatalf("concurrent JoinGroupChatRoom() created rooms %s and %s", rooms[0].ID.Hex(), rooms[i].ID.Hex())
+				}
+			}
+
+			room, err := store.Rooms.FindRoom(context.Background(), rooms[0].ID)
+			if err != nil || len(room.Participants) != len(users) {
+				t.Errorf("FindRoom() = %+v, %v; want %d participants", room, err, len(users))
+			}
+		})
+	}
+}
+
+// TestOutboxPurge deletes the records sent before the retention, and keeps
+// the pending ones
+func TestOutboxPurge(t *testing.T) {
+	for _, dialect := range dialects {
+		t.Run(dialect.Name, func(t *testing.T) {
+			db := open(t, dialect, newDataSource(t, dialect))
+			store := db.Store()
+			ctx := context.Background()
+
+			alice := storetest.CreateUser(t, store, "alice")
+			room := storetest.JoinGroup(t, store, alice, "general")
+			storetest.SendMessage(t, store, alice, room, "sent", "")
+
+			record, err := store.Outbox.ClaimPending(ctx, "a", time.Minute)
+			if err != nil || record == nil {
+				t.Fatalf("ClaimPending() = %+v, %v; want the message's record", record, err)
+			}
+			err = store.Outbox.MarkSent(ctx, record.ID)
+			if err != nil {
+				t.Fatalf("MarkSent() failed: %v", err)
+			}
+
+			pending := storetest.SendMessage(t, store, alice, room, "pending", "")
+
+			deleted, err := db.deleteSent(ctx, time.Now().Add(-repository.OutboxRetention))
+			if err != nil || deleted != 0 {
+				t.Errorf("deleteSent() within the retention = %d, %v; want 0", deleted, err)
+			}
+
+			deleted, err = db.deleteSent(ctx, time.Now().Add(time.Second))
+			if err != nil || deleted != 1 {
+				t.Errorf("deleteSent() = %d, %v; want 1", deleted, err)
+			}
+
+			record, err = store.Outbox.ClaimPending(ctx, "a", time.Minute)
+			if err != nil || record == nil || string(record.Body) != pending.ID.Hex() {
+				t.Errorf("ClaimPending() after deleteSent() = %+v, %v; want the pending record", record, err)
+			}
+		})
+	}
+}
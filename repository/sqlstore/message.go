@@ -0,0 +1,163 @@
+package sqlstore
+
+import (
+	"chat-server/repository"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"slices"
+	"time"
+)
+
+const messageColumns = "id, room_id, sender_id, client_message_id, content, username, timestamp"
+
+func scanMessage(row interface{ Scan(...any) error }) (*repository.MessageModel, error) {
+	var message repository.MessageModel
+	var clientMessageID sql.NullString
+	err := row.Scan(scanID(&message.ID), scanID(&message.RoomID), scanID(&message.SenderID), &clientMessageID, &message.Content, &message.Username, &message.Timestamp)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	message.ClientMessageID = clientMessageID.String
+
+	return &message, nil
+}
+
+func (db *DB) findMessages(ctx context.Context, query string, args ...any) ([]*repository.MessageModel, error) {
+	rows, err := db.db.QueryContext(ctx, db.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error finding messages: %w", err)
+	}
+	defer rows.Close()
+
+	messages := make([]*repository.MessageModel, 0)
+	for rows.Next() {
+		message, err := scanMessage(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding messages: %w", err)
+		}
+
+		messages = append(messages, message)
+	}
+
+	return messages, rows.Err()
+}
+
+func (db *DB) FindMessage(ctx context.Context, id primitive.ObjectID) (*repository.MessageModel, error) {
+	row := db.db.QueryRowContext(ctx, db.rebind("SELECT "+messageColumns+" FROM messages WHERE id = ?"), id.Hex())
+
+	return scanMessage(row)
+}
+
+func (db *DB) FindMessages(ctx context.Context, roomId primitive.ObjectID, page repository.Page) ([]*repository.MessageModel, error) {
+	var args []any
+	return db.findMessages(ctx, "SELECT "+messageColumns+" FROM messages WHERE "+roomCondition(roomId, &args)+"1 = 1"+
+		orderBy(page)+limitOffset(page.Number, page.Limit), args...)
+}
+
+func (db *DB) CountMessages(ctx context.Context, roomId primitive.ObjectID) (int64, error) {
+	var args []any
+	return db.count(ctx, "SELECT COUNT(*) FROM messages WHERE "+roomCondition(roomId, &args)+"1 = 1", args...)
+}
+
+// FindByClientMessageID looks up a message previously sent by the sender with the same
+// client generated ID. It returns nil without an error when no such message exists.
+func (db *DB) FindByClientMessageID(ctx context.Context, senderId primitive.ObjectID, clientMessageId string) (*repository.MessageModel, error) {
+	row := db.db.QueryRowContext(ctx, db.rebind("SELECT "+messageColumns+" FROM messages WHERE sender_id = ? AND client_message_id = ?"), senderId.Hex(), clientMessageId)
+
+	message, err := scanMessage(row)
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, nil
+	}
+
+	return message, err
+}
+
+// FindAfter returns up to limit messages of a room sent after the given position, oldest first
+func (db *DB) FindAfter(ctx context.Context, roomId primitive.ObjectID, timestamp time.Time, afterId primitive.ObjectID, limit int) ([]*repository.MessageModel, error) {
+	condition, args := "timestamp > ?", []any{utc(timestamp)}
+	if !afterId.IsZero() {
+		condition, args = "(timestamp > ? OR (timestamp = ? AND id > ?))", []any{utc(timestamp), utc(timestamp), afterId.Hex()}
+	}
+
+	return db.findMessages(ctx, "SELECT "+messageColumns+" FROM messages WHERE "+roomCondition(roomId, &args)+condition+
+		" ORDER BY timestamp, id"+limitOffset(1, limit), args...)
+}
+
+// FindBefore returns up to limit messages of a room sent right before the given position, oldest first.
+// A zero timestamp returns the newest messages.
+func (db *DB) FindBefore(ctx context.Context, roomId primitive.ObjectID, timestamp time.Time, beforeId primitive.ObjectID, limit int) ([]*repository.MessageModel, error) {
+	var condition string
+	var args []any
+	switch {
+	case timestamp.IsZero():
+		// No position, the newest messages are returned
+		condition = "1 = 1"
+	case beforeId.IsZero():
+		condition, args = "timestamp < ?", []any{utc(timestamp)}
+	default:
+		condition, args = "(timestamp < ? OR (timestamp = ? AND id < ?))", []any{utc(timestamp), utc(timestamp), beforeId.Hex()}
+	}
+
+	messages, err := db.findMessages(ctx, "SELECT "+messageColumns+" FROM messages WHERE "+roomCondition(roomId, &args)+condition+
+		" ORDER BY timestamp DESC, id DESC"+limitOffset(1, limit), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// The closest messages are found newest first
+	slices.Reverse(messages)
+
+	return messages, nil
+}
+
+// roomCondition matches the messages of a room, or of every room with a zero roomId
+func roomCondition(roomId primitive.ObjectID, args *[]any) string {
+	if roomId.IsZero() {
+		return ""
+	}
+
+	*args = append([]any{roomId.Hex()}, *args...)
+
+	return "room_id = ? AND "
+}
+
+// CreateWithOutbox persists the message together with the outbox record announcing it,
+// in a single transaction, so that the message is published if and only if it is stored
+func (db *DB) CreateWithOutbox(ctx context.Context, message *repository.MessageModel, topic string, encode func(*repository.MessageModel) ([]byte, error)) (*repository.MessageModel, error) {
+	message.SetID(primitive.NewObjectID())
+	message.SetTimestamp()
+	// Announce the timestamp as stored, so that clients can sync from it
+	message.Timestamp = message.Timestamp.Truncate(time.Microsecond)
+
+	body, err := encode(message)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &repository.OutboxModel{Topic: topic, Body: body, Status: repository.OutboxPending}
+	record.SetID(primitive.NewObjectID())
+	record.SetTimestamp()
+
+	err = db.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, db.rebind("INSERT INTO messages ("+messageColumns+") VALUES (?, ?, ?, ?, ?, ?, ?)"),
+			message.ID.Hex(), message.RoomID.Hex(), message.SenderID.Hex(),
+			sql.NullString{String: message.ClientMessageID, Valid: message.ClientMessageID != ""},
+			message.Content, message.Username, utc(message.Timestamp))
+		if db.dialect.isDuplicate(err) {
+			return fmt.Errorf("message '%s' was already sent: %w", message.ClientMessageID, repository.ErrDuplicate)
+		} else if err != nil {
+			return fmt.Errorf("failed to create message: %w", err)
+		}
+
+		return db.createOutboxRecord(ctx, tx, record)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
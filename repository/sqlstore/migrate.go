@@ -0,0 +1,112 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// migrations holds the schema of each dialect, as numbered SQL files
+// (0001_init.sql, 0002_...) applied in order and exactly once
+//
+//go:embed migrations
+var migrations embed.FS
+
+// migrate applies the migrations of the dialect that have not been applied yet,
+// each one in its own transaction, and records them in schema_migrations
+func (db *DB) migrate(ctx context.Context) error {
+	err := db.inTx(ctx, func(tx *sql.Tx) error {
+		err := db.lockMigrations(ctx, tx)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			applied_at TIMESTAMP NOT NULL
+		)`)
+
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create schema_migrations table: %w", err)
+	}
+
+	dir := path.Join("migrations", db.dialect.Name)
+	files, err := fs.ReadDir(migrations, dir)
+	if err != nil {
+		return fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Name() < files[j].Name()
+	})
+
+	for _, file := range files {
+		versionPart, _, _ := strings.Cut(file.Name(), "_")
+		version, err := strconv.Atoi(versionPart)
+		if err != nil {
+			return fmt.Errorf("invalid migration file name '%s': %w", file.Name(), err)
+		}
+
+		script, err := migrations.ReadFile(path.Join(dir, file.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read migration '%s': %w", file.Name(), err)
+		}
+
+		err = db.inTx(ctx, func(tx *sql.Tx) error {
+			err := db.lockMigrations(ctx, tx)
+			if err != nil {
+				return err
+			}
+
+			var applied int
+			err = tx.QueryRowContext(ctx, db.rebind("SELECT COUNT(*) FROM schema_migrations WHERE version = ?"), version).Scan(&applied)
+			if err != nil || applied > 0 {
+				return err
+			}
+
+			_, err = tx.ExecContext(ctx, string(script))
+			if err != nil {
+				return err
+			}
+
+			_, err = tx.ExecContext(ctx, db.rebind("INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)"), version, utc(time.Now()))
+			if err != nil {
+				return err
+			}
+
+			log.Printf("applied %s migration %s", db.dialect.Name, file.Name())
+
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to apply migration '%s': %w", file.Name(), err)
+		}
+	}
+
+	return nil
+}
+
+// lockMigrations serializes the migrations of concurrently starting instances
+// until the end of the transaction, when the dialect needs it
+func (db *DB) lockMigrations(ctx context.Context, tx *sql.Tx) error {
+	if db.dialect.migrationLock == "" {
+		return nil
+	}
+
+	_, err := tx.ExecContext(ctx, db.dialect.migrationLock)
+	if err != nil {
+		return fmt.Errorf("failed to lock migrations: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,80 @@
+CREATE TABLE users (
+    id         CHAR(24) PRIMARY KEY,
+    first_name TEXT        NOT NULL,
+    last_name  TEXT        NOT NULL,
+    username   TEXT        NOT NULL UNIQUE,
+    password   TEXT        NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX users_created_at_idx ON users (created_at);
+
+CREATE TABLE rooms (
+    id         CHAR(24) PRIMARY KEY,
+    name       TEXT        NOT NULL,
+    type       TEXT        NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL
+);
+
+CREATE UNIQUE INDEX rooms_group_name_idx ON rooms (name) WHERE type = 'group';
+CREATE INDEX rooms_created_at_idx ON rooms (created_at);
+
+CREATE TABLE room_participants (
+    room_id  CHAR(24) NOT NULL REFERENCES rooms (id) ON DELETE CASCADE,
+    user_id  CHAR(24) NOT NULL,
+    position INTEGER  NOT NULL,
+    PRIMARY KEY (room_id, user_id)
+);
+
+CREATE INDEX room_participants_user_id_idx ON room_participants (user_id);
+
+CREATE TABLE messages (
+    id                CHAR(24) PRIMARY KEY,
+    room_id           CHAR(24)    NOT NULL,
+    sender_id         CHAR(24)    NOT NULL,
+    client_message_id TEXT,
+    content           TEXT        NOT NULL,
+    username          TEXT        NOT NULL,
+    timestamp         TIMESTAMPTZ NOT NULL
+);
+
+CREATE INDEX messages_room_id_timestamp_idx ON messages (room_id, timestamp, id);
+CREATE UNIQUE INDEX messages_client_message_id_idx ON messages (sender_id, client_message_id) WHERE client_message_id IS NOT NULL;
+
+CREATE TABLE read_receipts (
+    id                   CHAR(24) PRIMARY KEY,
+    room_id              CHAR(24)    NOT NULL,
+    user_id              CHAR(24)    NOT NULL,
+    last_read_message_id CHAR(24)    NOT NULL,
+    last_read_at         TIMESTAMPTZ NOT NULL,
+    updated_at           TIMESTAMPTZ NOT NULL,
+    UNIQUE (room_id, user_id)
+);
+
+CREATE TABLE presence (
+    user_id   CHAR(24) PRIMARY KEY,
+    status    TEXT        NOT NULL,
+    last_seen TIMESTAMPTZ NOT NULL
+);
+
+CREATE TABLE presence_instances (
+    user_id     CHAR(24) NOT NULL REFERENCES presence (user_id) ON DELETE CASCADE,
+    instance_id TEXT     NOT NULL,
+    PRIMARY KEY (user_id, instance_id)
+);
+
+CREATE INDEX presence_instances_instance_id_idx ON presence_instances (instance_id);
+
+CREATE TABLE outbox (
+    id           CHAR(24) PRIMARY KEY,
+    topic        TEXT        NOT NULL,
+    body         BYTEA       NOT NULL,
+    status       TEXT        NOT NULL,
+    attempts     INTEGER     NOT NULL DEFAULT 0,
+    locked_by    TEXT,
+    locked_until TIMESTAMPTZ,
+    created_at   TIMESTAMPTZ NOT NULL,
+    sent_at      TIMESTAMPTZ
+);
+
+CREATE INDEX outbox_pending_idx ON outbox (id) WHERE status = 'pending';
@@ -0,0 +1,5 @@
+-- A record failing to be published is retried from next_attempt_at, and sent
+-- records are deleted once they are older than the retention
+ALTER TABLE outbox ADD COLUMN next_attempt_at TIMESTAMPTZ;
+
+CREATE INDEX outbox_sent_at_idx ON outbox (sent_at) WHERE status = 'sent';
@@ -0,0 +1,6 @@
+-- Leases of the server instances, the users of an instance without a live
+-- lease are taken offline by the other instances
+CREATE TABLE instances (
+    instance_id TEXT        PRIMARY KEY,
+    expires_at  TIMESTAMP   NOT NULL
+);
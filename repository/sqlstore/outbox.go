@@ -0,0 +1,127 @@
+package sqlstore
+
+import (
+	"chat-server/repository"
+	"context"
+	"database/sql"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"time"
+)
+
+const outboxColumns = "id, topic, body, status, attempts, locked_by, locked_until, next_attempt_at, created_at, sent_at"
+
+// outboxPurgeInterval is how often the sent records older than the retention are deleted
+const outboxPurgeInterval = time.Hour
+
+func (db *DB) createOutboxRecord(ctx context.Context, tx *sql.Tx, record *repository.OutboxModel) error {
+	_, err := tx.ExecContext(ctx, db.rebind("INSERT INTO outbox (id, topic, body, status, attempts, created_at) VALUES (?, ?, ?, ?, ?, ?)"),
+		record.ID.Hex(), record.Topic, record.Body, record.Status, record.Attempts, utc(record.CreatedAt))
+	if err != nil {
+		return fmt.Errorf("failed to create outbox record: %w", err)
+	}
+
+	return nil
+}
+
+// ClaimPending locks the oldest pending record that no other instance is relaying
+// and that is due for an attempt, for the lease duration. It returns nil without
+// an error when nothing is pending.
+func (db *DB) ClaimPending(ctx context.Context, instanceId string, lease time.Duration) (*repository.OutboxModel, error) {
+	now := time.Now()
+
+	var record repository.OutboxModel
+	var lockedBy sql.NullString
+	var lockedUntil, nextAttempt, sentAt sql.NullTime
+	err := db.db.QueryRowContext(ctx, db.rebind(`UPDATE outbox SET locked_by = ?, locked_until = ?, attempts = attempts + 1
+		WHERE id = (
+			SELECT id FROM outbox
+			WHERE status = ? AND (locked_until IS NULL OR locked_until <= ?) AND (next_attempt_at IS NULL OR next_attempt_at <= ?)
+			ORDER BY id LIMIT 1`+db.dialect.skipLocked+`
+		)
+		RETURNING `+outboxColumns),
+		instanceId, utc(now.Add(lease)), repository.OutboxPending, utc(now), utc(now)).
+		Scan(scanID(&record.ID), &record.Topic, &record.Body, &record.Status, &record.Attempts, &lockedBy, &lockedUntil, &nextAttempt, &record.CreatedAt, &sentAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to claim outbox record: %w", err)
+	}
+
+	record.LockedBy = lockedBy.String
+	record.LockedUntil = lockedUntil.Time
+	record.NextAttempt = nextAttempt.Time
+	if sentAt.Valid {
+		record.SentAt = &sentAt.Time
+	}
+
+	return &record, nil
+}
+
+// MarkSent records that the claimed record has been published
+func (db *DB) MarkSent(ctx context.Context, id primitive.ObjectID) error {
+	_, err := db.db.ExecContext(ctx, db.rebind("UPDATE outbox SET status = ?, sent_at = ?, locked_by = NULL, locked_until = NULL WHERE id = ?"),
+		repository.OutboxSent, utc(time.Now()), id.Hex())
+	if err != nil {
+		return fmt.Errorf("failed to mark outbox record as sent: %w", err)
+	}
+
+	return nil
+}
+
+// Release unlocks a claimed record that failed to be published, so that it is
+// retried from retryAt
+func (db *DB) Release(ctx context.Context, id primitive.ObjectID, retryAt time.Time) error {
+	_, err := db.db.ExecContext(ctx, db.rebind("UPDATE outbox SET locked_by = NULL, locked_until = NULL, next_attempt_at = ? WHERE id = ?"),
+		utc(retryAt), id.Hex())
+	if err != nil {
+		return fmt.Errorf("failed to release outbox record: %w", err)
+	}
+
+	return nil
+}
+
+// MarkFailed gives up on a claimed record, it is no longer relayed
+func (db *DB) MarkFailed(ctx context.Context, id primitive.ObjectID) error {
+	_, err := db.db.ExecContext(ctx, db.rebind("UPDATE outbox SET status = ?, locked_by = NULL, locked_until = NULL, next_attempt_at = NULL WHERE id = ?"),
+		repository.OutboxFailed, id.Hex())
+	if err != nil {
+		return fmt.Errorf("failed to mark outbox record as failed: %w", err)
+	}
+
+	return nil
+}
+
+// deleteSent deletes the records sent before the given time
+func (db *DB) deleteSent(ctx context.Context, before time.Time) (int64, error) {
+	result, err := db.db.ExecContext(ctx, db.rebind("DELETE FROM outbox WHERE status = ? AND sent_at < ?"), repository.OutboxSent, utc(before))
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete sent outbox records: %w", err)
+	}
+
+	return result.RowsAffected()
+}
+
+// purgeOutbox deletes the sent records older than the retention until the
+// database is closed, like the TTL index of MongoDB
+func (db *DB) purgeOutbox(ctx context.Context) {
+	ticker := time.NewTicker(outboxPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		deleteCtx, cancel := context.WithTimeout(ctx, time.Minute)
+		_, err := db.deleteSent(deleteCtx, time.Now().Add(-repository.OutboxRetention))
+		cancel()
+
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
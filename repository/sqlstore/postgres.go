@@ -0,0 +1,22 @@
+package sqlstore
+
+import (
+	"errors"
+	"github.com/jackc/pgx/v5/pgconn"
+	// Registers the pgx driver with database/sql
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// Postgres locks outbox rows with SKIP LOCKED, so that concurrent relays claim distinct
+// records, and serializes migrations with a transaction level advisory lock
+var Postgres = Dialect{
+	Name:                 "postgres",
+	DriverName:           "pgx",
+	numberedPlaceholders: true,
+	skipLocked:           " FOR UPDATE SKIP LOCKED",
+	migrationLock:        "SELECT pg_advisory_xact_lock(7265)",
+	isDuplicate: func(err error) bool {
+		var pgErr *pgconn.PgError
+		return errors.As(err, &pgErr) && pgErr.Code == "23505" // unique_violation
+	},
+}
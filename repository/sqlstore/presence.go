@@ -0,0 +1,219 @@
+package sqlstore
+
+import (
+	"chat-server/repository"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+func (db *DB) findPresence(ctx context.Context, q querier, userId primitive.ObjectID) (*repository.PresenceModel, error) {
+	presence := repository.PresenceModel{ID: userId, Instances: []string{}}
+	err := q.QueryRowContext(ctx, db.rebind("SELECT status, last_seen FROM presence WHERE user_id = ?"), userId.Hex()).
+		Scan(&presence.Status, &presence.LastSeen)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	rows, err := q.QueryContext(ctx, db.rebind("SELECT instance_id FROM presence_instances WHERE user_id = ? ORDER BY instance_id"), userId.Hex())
+	if err != nil {
+		return nil, fmt.Errorf("failed to find presence instances: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var instance string
+		err := rows.Scan(&instance)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode presence instances: %w", err)
+		}
+
+		presence.Instances = append(presence.Instances, instance)
+	}
+
+	return &presence, rows.Err()
+}
+
+func (db *DB) FindPresence(ctx context.Context, userId primitive.ObjectID) (*repository.PresenceModel, error) {
+	return db.findPresence(ctx, db.db, userId)
+}
+
+// ConnectInstance records that the user is connected to the instance and marks them online
+func (db *DB) ConnectInstance(ctx context.Context, userId primitive.ObjectID, instanceId string) (*repository.PresenceModel, error) {
+	var presence *repository.PresenceModel
+	err := db.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, db.rebind(`INSERT INTO presence (user_id, status, last_seen) VALUES (?, ?, ?)
+			ON CONFLICT (user_id) DO UPDATE SET status = excluded.status, last_seen = excluded.last_seen`),
+			userId.Hex(), repository.PresenceOnline, utc(time.Now()))
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, db.rebind("INSERT INTO presence_instances (user_id, instance_id) VALUES (?, ?) ON CONFLICT DO NOTHING"),
+			userId.Hex(), instanceId)
+		if err != nil {
+			return err
+		}
+
+		presence, err = db.findPresence(ctx, tx, userId)
+
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to update presence: %w", err)
+	}
+
+	return presence, nil
+}
+
+// DisconnectInstance records that the user is no longer connected to the instance.
+// The user goes offline when no other instance holds a connection of theirs.
+func (db *DB) DisconnectInstance(ctx context.Context, userId primitive.ObjectID, instanceId string) (*repository.PresenceModel, error) {
+	var presence *repository.PresenceModel
+	err := db.inTx(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, db.rebind("DELETE FROM presence_instances WHERE user_id = ? AND instance_id = ?"), userId.Hex(), instanceId)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, db.rebind(`UPDATE presence SET last_seen = ?,
+			status = CASE WHEN EXISTS (SELECT 1 FROM presence_instances WHERE user_id = ?) THEN status ELSE ? END
+			WHERE user_id = ?`),
+			utc(time.Now()), userId.Hex(), repository.PresenceOffline, userId.Hex())
+		if err != nil {
+			return err
+		}
+
+		presence, err = db.findPresence(ctx, tx, userId)
+
+		return err
+	})
+	if errors.Is(err, repository.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to update presence: %w", err)
+	}
+
+	return presence, nil
+}
+
+// SetStatus changes the status of a connected user, e.g. to away
+func (db *DB) SetStatus(ctx context.Context, userId primitive.ObjectID, status string) (*repository.PresenceModel, error) {
+	result, err := db.db.ExecContext(ctx, db.rebind(`UPDATE presence SET status = ?, last_seen = ?
+		WHERE user_id = ? AND EXISTS (SELECT 1 FROM presence_instances WHERE user_id = ?)`),
+		status, utc(time.Now()), userId.Hex(), userId.Hex())
+	if err != nil {
+		return nil, fmt.Errorf("failed to update presence: %w", err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to update presence: %w", err)
+	}
+	if updated == 0 {
+		return nil, nil
+	}
+
+	return db.findPresence(ctx, db.db, userId)
+}
+
+// ReleaseInstance removes the instance from every user, e.g. when the instance
+// restarts and none of its previous connections exist anymore, and deletes its lease
+func (db *DB) ReleaseInstance(ctx context.Context, instanceId string) ([]*repository.PresenceModel, error) {
+	released := []*repository.PresenceModel{}
+	err := db.inTx(ctx, func(tx *sql.Tx) error {
+		// Each user is only returned by the transaction deleting their row,
+		// when several instances release the same one
+		rows, err := tx.QueryContext(ctx, db.rebind("DELETE FROM presence_instances WHERE instance_id = ? RETURNING user_id"), instanceId)
+		if err != nil {
+			return err
+		}
+
+		var userIds []string
+		for rows.Next() {
+			var userId string
+			err := rows.Scan(&userId)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+
+			userIds = append(userIds, userId)
+		}
+		rows.Close()
+		if rows.Err() != nil {
+			return rows.Err()
+		}
+
+		for _, userId := range userIds {
+			_, err = tx.ExecContext(ctx, db.rebind(`UPDATE presence SET last_seen = ?,
+				status = CASE WHEN EXISTS (SELECT 1 FROM presence_instances WHERE user_id = ?) THEN status ELSE ? END
+				WHERE user_id = ?`),
+				utc(time.Now()), userId, repository.PresenceOffline, userId)
+			if err != nil {
+				return err
+			}
+
+			id, err := primitive.ObjectIDFromHex(userId)
+			if err != nil {
+				return err
+			}
+
+			presence, err := db.findPresence(ctx, tx, id)
+			if err != nil {
+				return err
+			}
+
+			released = append(released, presence)
+		}
+
+		_, err = tx.ExecContext(ctx, db.rebind("DELETE FROM instances WHERE instance_id = ?"), instanceId)
+
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to release instance '%s': %w", instanceId, err)
+	}
+
+	return released, nil
+}
+
+// Heartbeat extends the lease of the instance until ttl from now
+func (db *DB) Heartbeat(ctx context.Context, instanceId string, ttl time.Duration) error {
+	_, err := db.db.ExecContext(ctx, db.rebind(`INSERT INTO instances (instance_id, expires_at) VALUES (?, ?)
+		ON CONFLICT (instance_id) DO UPDATE SET expires_at = excluded.expires_at`),
+		instanceId, utc(time.Now().Add(ttl)))
+	if err != nil {
+		return fmt.Errorf("failed to extend lease of instance '%s': %w", instanceId, err)
+	}
+
+	return nil
+}
+
+// ExpiredInstances returns the instances holding users whose lease expired or
+// who never had one
+func (db *DB) ExpiredInstances(ctx context.Context) ([]string, error) {
+	rows, err := db.db.QueryContext(ctx, db.rebind(`SELECT DISTINCT instance_id FROM presence_instances p
+		WHERE NOT EXISTS (SELECT 1 FROM instances i WHERE i.instance_id = p.instance_id AND i.expires_at > ?)
+		ORDER BY instance_id`), utc(time.Now()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find expired instances: %w", err)
+	}
+	defer rows.Close()
+
+	expired := []string{}
+	for rows.Next() {
+		var instance string
+		err := rows.Scan(&instance)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode expired instances: %w", err)
+		}
+
+		expired = append(expired, instance)
+	}
+
+	return expired, rows.Err()
+}
@@ -0,0 +1,112 @@
+package sqlstore
+
+import (
+	"chat-server/repository"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// MarkRead moves the read cursor of the user in the message's room up to the message.
+// The cursor never moves backwards, marking an older message as read is a no-op.
+func (db *DB) MarkRead(ctx context.Context, userId primitive.ObjectID, message *repository.MessageModel) (*repository.ReadReceiptModel, error) {
+	// Messages are ordered by timestamp and then ID
+	result, err := db.db.ExecContext(ctx, db.rebind(`INSERT INTO read_receipts (id, room_id, user_id, last_read_message_id, last_read_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (room_id, user_id) DO UPDATE SET
+			last_read_message_id = excluded.last_read_message_id,
+			last_read_at = excluded.last_read_at,
+			updated_at = excluded.updated_at
+		WHERE excluded.last_read_at > read_receipts.last_read_at
+			OR (excluded.last_read_at = read_receipts.last_read_at AND excluded.last_read_message_id > read_receipts.last_read_message_id)`),
+		primitive.NewObjectID().Hex(), message.RoomID.Hex(), userId.Hex(), message.ID.Hex(), utc(message.Timestamp), utc(time.Now()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to update read receipt: %w", err)
+	}
+
+	// The upsert leaves the row untouched when the cursor does not move
+	moved, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("failed to update read receipt: %w", err)
+	}
+
+	var receipt repository.ReadReceiptModel
+	err = db.db.QueryRowContext(ctx, db.rebind(`SELECT id, room_id, user_id, last_read_message_id, last_read_at, updated_at
+		FROM read_receipts WHERE room_id = ? AND user_id = ?`), message.RoomID.Hex(), userId.Hex()).
+		Scan(scanID(&receipt.ID), scanID(&receipt.RoomID), scanID(&receipt.UserID), scanID(&receipt.LastReadMessageID), &receipt.LastReadAt, &receipt.UpdatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode read receipt: %w", err)
+	}
+
+	if moved > 0 {
+		db.listeners.NotifyRead(&receipt)
+	}
+
+	return &receipt, nil
+}
+
+// CountUnread counts the messages of other users in the room that come after the user's read cursor
+func (db *DB) CountUnread(ctx context.Context, roomId primitive.ObjectID, userId primitive.ObjectID) (int64, error) {
+	var lastReadMessageID primitive.ObjectID
+	var lastReadAt time.Time
+	err := db.db.QueryRowContext(ctx, db.rebind("SELECT last_read_message_id, last_read_at FROM read_receipts WHERE room_id = ? AND user_id = ?"),
+		roomId.Hex(), userId.Hex()).Scan(scanID(&lastReadMessageID), &lastReadAt)
+
+	var count int64
+	if errors.Is(err, sql.ErrNoRows) {
+		err = db.db.QueryRowContext(ctx, db.rebind("SELECT COUNT(*) FROM messages WHERE room_id = ? AND sender_id <> ?"),
+			roomId.Hex(), userId.Hex()).Scan(&count)
+	} else if err == nil {
+		err = db.db.QueryRowContext(ctx, db.rebind(`SELECT COUNT(*) FROM messages WHERE room_id = ? AND sender_id <> ?
+			AND (timestamp > ? OR (timestamp = ? AND id > ?))`),
+			roomId.Hex(), userId.Hex(), utc(lastReadAt), utc(lastReadAt), lastReadMessageID.Hex()).Scan(&count)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to count unread messages: %w", err)
+	}
+
+	return count, nil
+}
+
+// CountUnreadByRooms counts the unread messages of the user in each of the rooms with a single
+// query, joining the messages with the read cursors of the user and grouping them by room
+func (db *DB) CountUnreadByRooms(ctx context.Context, userId primitive.ObjectID, roomIds []primitive.ObjectID) (map[primitive.ObjectID]int64, error) {
+	counts := make(map[primitive.ObjectID]int64, len(roomIds))
+	if len(roomIds) == 0 {
+		return counts, nil
+	}
+
+	args := []any{userId.Hex()}
+	for _, roomId := range roomIds {
+		counts[roomId] = 0
+		args = append(args, roomId.Hex())
+	}
+	args = append(args, userId.Hex())
+
+	// Every message of a room without read cursor is unread
+	rows, err := db.db.QueryContext(ctx, db.rebind(`SELECT m.room_id, COUNT(*) FROM messages m
+		LEFT JOIN read_receipts r ON r.room_id = m.room_id AND r.user_id = ?
+		WHERE m.room_id IN (`+placeholders(len(roomIds))+`) AND m.sender_id <> ?
+			AND (r.id IS NULL OR m.timestamp > r.last_read_at OR (m.timestamp = r.last_read_at AND m.id > r.last_read_message_id))
+		GROUP BY m.room_id`), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count unread messages: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var roomId primitive.ObjectID
+		var count int64
+		err = rows.Scan(scanID(&roomId), &count)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode unread counts: %w", err)
+		}
+
+		counts[roomId] = count
+	}
+
+	return counts, rows.Err()
+}
@@ -0,0 +1,232 @@
+package sqlstore
+
+import (
+	"chat-server/repository"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http"
+	"time"
+)
+
+const roomColumns = "id, name, type, created_at"
+
+// findRooms runs the query on the rooms table and loads the participants of the rooms found
+func (db *DB) findRooms(ctx context.Context, q querier, query string, args ...any) ([]*repository.RoomModel, error) {
+	rows, err := q.QueryContext(ctx, db.rebind(query), args...)
+	if err != nil {
+		return nil, fmt.Errorf("error finding rooms: %w", err)
+	}
+
+	rooms := make([]*repository.RoomModel, 0)
+	roomsByID := make(map[string]*repository.RoomModel)
+	for rows.Next() {
+		var room repository.RoomModel
+		err := rows.Scan(scanID(&room.ID), &room.Name, &room.Type, &room.CreatedAt)
+		if err != nil {
+			_ = rows.Close()
+			return nil, fmt.Errorf("error decoding rooms: %w", err)
+		}
+
+		rooms = append(rooms, &room)
+		roomsByID[room.ID.Hex()] = &room
+	}
+	_ = rows.Close()
+	if rows.Err() != nil {
+		return nil, fmt.Errorf("error finding rooms: %w", rows.Err())
+	}
+
+	if len(rooms) == 0 {
+		return rooms, nil
+	}
+
+	roomIDs := make([]any, len(rooms))
+	for i, room := range rooms {
+		roomIDs[i] = room.ID.Hex()
+	}
+
+	participantQuery := "SELECT room_id, user_id FROM room_participants WHERE room_id IN (" + placeholders(len(roomIDs)) + ") ORDER BY room_id, position"
+	participantRows, err := q.QueryContext(ctx, db.rebind(participantQuery), roomIDs...)
+	if err != nil {
+		return nil, fmt.Errorf("error finding room participants: %w", err)
+	}
+	defer participantRows.Close()
+
+	for participantRows.Next() {
+		var roomID, userID primitive.ObjectID
+		err := participantRows.Scan(scanID(&roomID), scanID(&userID))
+		if err != nil {
+			return nil, fmt.Errorf("error decoding room participants: %w", err)
+		}
+
+		room := roomsByID[roomID.Hex()]
+		room.Participants = append(room.Participants, userID)
+	}
+
+	return rooms, participantRows.Err()
+}
+
+func (db *DB) findRoom(ctx context.Context, q querier, query string, args ...any) (*repository.RoomModel, error) {
+	rooms, err := db.findRooms(ctx, q, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rooms) == 0 {
+		return nil, repository.ErrNotFound
+	}
+
+	return rooms[0], nil
+}
+
+func (db *DB) FindRoom(ctx context.Context, id primitive.ObjectID) (*repository.RoomModel, error) {
+	return db.findRoom(ctx, db.db, "SELECT "+roomColumns+" FROM rooms WHERE id = ?", id.Hex())
+}
+
+func (db *DB) FindRooms(ctx context.Context, page repository.Page) ([]*repository.RoomModel, error) {
+	return db.findRooms(ctx, db.db, "SELECT "+roomColumns+" FROM rooms"+orderBy(page)+limitOffset(page.Number, page.Limit))
+}
+
+func (db *DB) CountRooms(ctx context.Context) (int64, error) {
+	return db.count(ctx, "SELECT COUNT(*) FROM rooms")
+}
+
+func (db *DB) FindParticipantRooms(ctx context.Context, userId primitive.ObjectID) ([]*repository.RoomModel, error) {
+	return db.findRooms(ctx, db.db, "SELECT "+roomColumns+" FROM rooms WHERE id IN (SELECT room_id FROM room_participants WHERE user_id = ?)", userId.Hex())
+}
+
+// createRoom inserts the room and its participants
+func (db *DB) createRoom(ctx context.Context, tx *sql.Tx, room *repository.RoomModel) error {
+	room.SetID(primitive.NewObjectID())
+	room.SetTimestamp()
+
+	_, err := tx.ExecContext(ctx, db.rebind("INSERT INTO rooms ("+roomColumns+") VALUES (?, ?, ?, ?)"),
+		room.ID.Hex(), room.Name, room.Type, utc(room.CreatedAt))
+	if err != nil {
+		return fmt.Errorf("failed to create room: %w", err)
+	}
+
+	for position, participant := range room.Participants {
+		_, err = tx.ExecContext(ctx, db.rebind("INSERT INTO room_participants (room_id, user_id, position) VALUES (?, ?, ?)"),
+			room.ID.Hex(), participant.Hex(), position)
+		if err != nil {
+			return fmt.Errorf("failed to add room participant: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (db *DB) JoinPrivateChatRoom(currentUserId primitive.ObjectID, targetUserId primitive.ObjectID) (*repository.RoomModel, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Validate only the targetUserId as the currentUserId is decoded from auth token
+	_, err := db.FindUser(ctx, targetUserId)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid targetParticipantId received")
+	}
+	if targetUserId == currentUserId {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "targetParticipantId cannot be the same as the current user id")
+	}
+
+	var room *repository.RoomModel
+	created := false
+	err = db.inTx(ctx, func(tx *sql.Tx) error {
+		// Search for existing private room
+		existingRoom, err := db.findRoom(ctx, tx, `SELECT `+roomColumns+` FROM rooms WHERE type = ?
+			AND id IN (SELECT room_id FROM room_participants WHERE user_id = ?)
+			AND id IN (SELECT room_id FROM room_participants WHERE user_id = ?)
+			AND (SELECT COUNT(*) FROM room_participants WHERE room_id = rooms.id) = 2`,
+			repository.PrivateChatRoom, currentUserId.Hex(), targetUserId.Hex())
+		if err == nil {
+			room = existingRoom
+			return nil
+		} else if !errors.Is(err, repository.ErrNotFound) {
+			return err
+		}
+
+		// Room not found, create a new one
+		room = &repository.RoomModel{
+			Type:         repository.PrivateChatRoom,
+			Participants: []primitive.ObjectID{currentUserId, targetUserId},
+		}
+		created = true
+
+		return db.createRoom(ctx, tx, room)
+	})
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to join room: "+err.Error())
+	}
+
+	if created {
+		db.listeners.NotifyRoomJoin(room.ID, currentUserId, targetUserId)
+	}
+
+	return room, nil
+}
+
+func (db *DB) JoinGroupChatRoom(currentUserId primitive.ObjectID, roomName string) (*repository.RoomModel, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var room *repository.RoomModel
+	joined := false
+	join := func(tx *sql.Tx) error {
+		existingRoom, err := db.findRoom(ctx, tx, "SELECT "+roomColumns+" FROM rooms WHERE type = ? AND name = ?", repository.GroupChatRoom, roomName)
+		if errors.Is(err, repository.ErrNotFound) {
+			room = &repository.RoomModel{
+				Name:         roomName,
+				Type:         repository.GroupChatRoom,
+				Participants: []primitive.ObjectID{currentUserId},
+			}
+			joined = true
+
+			return db.createRoom(ctx, tx, room)
+		} else if err != nil {
+			return err
+		}
+
+		room = existingRoom
+
+		// a user should not join a room twice
+		result, err := tx.ExecContext(ctx, db.rebind(`INSERT INTO room_participants (room_id, user_id, position)
+			SELECT ?, ?, COUNT(*) FROM room_participants WHERE room_id = ?
+			ON CONFLICT (room_id, user_id) DO NOTHING`),
+			room.ID.Hex(), currentUserId.Hex(), room.ID.Hex())
+		if err != nil {
+			return fmt.Errorf("failed to add room participant: %w", err)
+		}
+
+		added, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if added > 0 {
+			room.Participants = append(room.Participants, currentUserId)
+			joined = true
+		}
+
+		return nil
+	}
+
+	err := db.inTx(ctx, join)
+	if err != nil && db.dialect.isDuplicate(err) {
+		// Another user created the room meanwhile, join it instead
+		joined = false
+		err = db.inTx(ctx, join)
+	}
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to join room: "+err.Error())
+	}
+
+	if joined {
+		db.listeners.NotifyRoomJoin(room.ID, currentUserId)
+	}
+
+	return room, nil
+}
@@ -0,0 +1,32 @@
+package sqlstore
+
+import (
+	"errors"
+	// Also registers the pure Go sqlite driver with database/sql, no cgo is required
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+	"net/url"
+)
+
+// SQLite has a single writer, a single connection serializes the transactions
+// instead of failing them with SQLITE_BUSY. No row or migration lock is needed.
+var SQLite = Dialect{
+	Name:         "sqlite",
+	DriverName:   "sqlite",
+	maxOpenConns: 1,
+	isDuplicate: func(err error) bool {
+		var sqliteErr *sqlite.Error
+		return errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+	},
+}
+
+// SQLiteDataSource returns the data source name of the database file at path,
+// with foreign keys enforced and write-ahead logging enabled
+func SQLiteDataSource(path string) string {
+	query := url.Values{}
+	query.Add("_pragma", "foreign_keys(1)")
+	query.Add("_pragma", "journal_mode(WAL)")
+	query.Add("_pragma", "busy_timeout(5000)")
+
+	return "file:" + path + "?" + query.Encode()
+}
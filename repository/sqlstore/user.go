@@ -0,0 +1,73 @@
+package sqlstore
+
+import (
+	"chat-server/repository"
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const userColumns = "id, first_name, last_name, username, password, created_at"
+
+func scanUser(row interface{ Scan(...any) error }) (*repository.UserModel, error) {
+	var user repository.UserModel
+	err := row.Scan(scanID(&user.ID), &user.FirstName, &user.LastName, &user.Username, &user.Password, &user.CreatedAt)
+	if err != nil {
+		return nil, notFound(err)
+	}
+
+	return &user, nil
+}
+
+func (db *DB) CreateUser(ctx context.Context, user *repository.UserModel) (*repository.UserModel, error) {
+	user.SetID(primitive.NewObjectID())
+	user.SetTimestamp()
+
+	_, err := db.db.ExecContext(ctx, db.rebind("INSERT INTO users ("+userColumns+") VALUES (?, ?, ?, ?, ?, ?)"),
+		user.ID.Hex(), user.FirstName, user.LastName, user.Username, user.Password, utc(user.CreatedAt))
+	if db.dialect.isDuplicate(err) {
+		return nil, fmt.Errorf("username '%s' is taken: %w", user.Username, repository.ErrDuplicate)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to create user: %w", err)
+	}
+
+	newUser := *user
+
+	return &newUser, nil
+}
+
+func (db *DB) FindUser(ctx context.Context, id primitive.ObjectID) (*repository.UserModel, error) {
+	row := db.db.QueryRowContext(ctx, db.rebind("SELECT "+userColumns+" FROM users WHERE id = ?"), id.Hex())
+
+	return scanUser(row)
+}
+
+func (db *DB) FindUserByUsername(ctx context.Context, username string) (*repository.UserModel, error) {
+	row := db.db.QueryRowContext(ctx, db.rebind("SELECT "+userColumns+" FROM users WHERE username = ?"), username)
+
+	return scanUser(row)
+}
+
+func (db *DB) FindUsers(ctx context.Context, page repository.Page) ([]*repository.UserModel, error) {
+	rows, err := db.db.QueryContext(ctx, "SELECT "+userColumns+" FROM users"+orderBy(page)+limitOffset(page.Number, page.Limit))
+	if err != nil {
+		return nil, fmt.Errorf("error finding users: %w", err)
+	}
+	defer rows.Close()
+
+	users := make([]*repository.UserModel, 0)
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding users: %w", err)
+		}
+
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+func (db *DB) CountUsers(ctx context.Context) (int64, error) {
+	return db.count(ctx, "SELECT COUNT(*) FROM users")
+}
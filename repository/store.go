@@ -0,0 +1,116 @@
+package repository
+
+import (
+	"context"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// UserStore persists the users
+type UserStore interface {
+	// CreateUser returns ErrDuplicate when the username is taken
+	CreateUser(ctx context.Context, user *UserModel) (*UserModel, error)
+	// FindUser returns ErrNotFound when no user has the ID
+	FindUser(ctx context.Context, id primitive.ObjectID) (*UserModel, error)
+	// FindUserByUsername returns ErrNotFound when no user has the username
+	FindUserByUsername(ctx context.Context, username string) (*UserModel, error)
+	// FindUsers returns a page of users
+	FindUsers(ctx context.Context, page Page) ([]*UserModel, error)
+	CountUsers(ctx context.Context) (int64, error)
+}
+
+// RoomStore persists the chat rooms and their participants
+type RoomStore interface {
+	// FindRoom returns ErrNotFound when no room has the ID
+	FindRoom(ctx context.Context, id primitive.ObjectID) (*RoomModel, error)
+	// FindRooms returns a page of rooms, newest first
+	FindRooms(ctx context.Context, page Page) ([]*RoomModel, error)
+	CountRooms(ctx context.Context) (int64, error)
+	FindParticipantRooms(ctx context.Context, userId primitive.ObjectID) ([]*RoomModel, error)
+	JoinPrivateChatRoom(currentUserId primitive.ObjectID, targetUserId primitive.ObjectID) (*RoomModel, error)
+	JoinGroupChatRoom(currentUserId primitive.ObjectID, roomName string) (*RoomModel, error)
+}
+
+// MessageStore persists the chat messages
+type MessageStore interface {
+	// FindMessage returns ErrNotFound when no message has the ID
+	FindMessage(ctx context.Context, id primitive.ObjectID) (*MessageModel, error)
+	// FindMessages returns a page of the messages of a room, or of every room with a zero roomId
+	FindMessages(ctx context.Context, roomId primitive.ObjectID, page Page) ([]*MessageModel, error)
+	CountMessages(ctx context.Context, roomId primitive.ObjectID) (int64, error)
+	FindByClientMessageID(ctx context.Context, senderId primitive.ObjectID, clientMessageId string) (*MessageModel, error)
+	// FindAfter and FindBefore return up to limit messages next to a position, oldest first.
+	// FindBefore returns the newest messages with a zero timestamp.
+	FindAfter(ctx context.Context, roomId primitive.ObjectID, timestamp time.Time, afterId primitive.ObjectID, limit int) ([]*MessageModel, error)
+	FindBefore(ctx context.Context, roomId primitive.ObjectID, timestamp time.Time, beforeId primitive.ObjectID, limit int) ([]*MessageModel, error)
+	// CreateWithOutbox returns ErrDuplicate when the sender already sent a message with the client message ID
+	CreateWithOutbox(ctx context.Context, message *MessageModel, topic string, encode func(*MessageModel) ([]byte, error)) (*MessageModel, error)
+}
+
+// ReadReceiptStore persists the read cursors of the users in their rooms
+type ReadReceiptStore interface {
+	MarkRead(ctx context.Context, userId primitive.ObjectID, message *MessageModel) (*ReadReceiptModel, error)
+	CountUnread(ctx context.Context, roomId primitive.ObjectID, userId primitive.ObjectID) (int64, error)
+	// CountUnreadByRooms counts the unread messages of the user in each of the rooms at once
+	CountUnreadByRooms(ctx context.Context, userId primitive.ObjectID, roomIds []primitive.ObjectID) (map[primitive.ObjectID]int64, error)
+}
+
+// PresenceStore persists the presence of the users across the server instances
+type PresenceStore interface {
+	// FindPresence returns ErrNotFound for a user who has never been online
+	FindPresence(ctx context.Context, userId primitive.ObjectID) (*PresenceModel, error)
+	ConnectInstance(ctx context.Context, userId primitive.ObjectID, instanceId string) (*PresenceModel, error)
+	DisconnectInstance(ctx context.Context, userId primitive.ObjectID, instanceId string) (*PresenceModel, error)
+	SetStatus(ctx context.Context, userId primitive.ObjectID, status string) (*PresenceModel, error)
+	// ReleaseInstance removes the instance and its lease, and returns the
+	// presence of the users it removed the instance from
+	ReleaseInstance(ctx context.Context, instanceId string) ([]*PresenceModel, error)
+	// Heartbeat extends the lease of the instance on the presence of its users
+	Heartbeat(ctx context.Context, instanceId string, ttl time.Duration) error
+	// ExpiredInstances returns the instances holding users without a live lease,
+	// e.g. instances that crashed or were scaled down
+	ExpiredInstances(ctx context.Context) ([]string, error)
+}
+
+// OutboxStore holds the messages waiting to be published to the broker
+type OutboxStore interface {
+	ClaimPending(ctx context.Context, instanceId string, lease time.Duration) (*OutboxModel, error)
+	MarkSent(ctx context.Context, id primitive.ObjectID) error
+	// Release unlocks a claimed record, it is claimed again from retryAt
+	Release(ctx context.Context, id primitive.ObjectID, retryAt time.Time) error
+	// MarkFailed gives up on a claimed record, it is kept but no longer claimed
+	MarkFailed(ctx context.Context, id primitive.ObjectID) error
+}
+
+// Store gathers the stores of a storage backend. The controllers and the
+// socket handler only reach the storage through it.
+type Store struct {
+	Users        UserStore
+	Rooms        RoomStore
+	Messages     MessageStore
+	ReadReceipts ReadReceiptStore
+	Presence     PresenceStore
+	Outbox       OutboxStore
+	// Listeners are notified of the changes made through the stores
+	Listeners *Listeners
+}
+
+// NewMongoStore returns the stores backed by MongoDB. SetupDatabase must be called first.
+func NewMongoStore() *Store {
+	listeners := &Listeners{}
+
+	rooms := NewRoom()
+	rooms.listeners = listeners
+	readReceipts := NewReadReceipt()
+	readReceipts.listeners = listeners
+
+	return &Store{
+		Users:        NewUser(),
+		Rooms:        rooms,
+		Messages:     NewMessage(),
+		ReadReceipts: readReceipts,
+		Presence:     NewPresence(),
+		Outbox:       NewOutbox(),
+		Listeners:    listeners,
+	}
+}
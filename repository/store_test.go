@@ -0,0 +1,119 @@
+package repository_test
+
+import (
+	"chat-server/repository"
+	"chat-server/repository/storetest"
+	"context"
+	"errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"os"
+	"testing"
+	"time"
+)
+
+// connectMongo connects to the replica set at MONGO_URL
+func connectMongo(t *testing.T) *mongo.Client {
+	t.Helper()
+
+	mongoURL := os.Getenv("MONGO_URL")
+	if mongoURL == "" {
+		t.Skip("MONGO_URL is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(mongoURL))
+	if err != nil {
+		t.Fatalf("failed to connect to MongoDB: %v", err)
+	}
+	t.Cleanup(func() { _ = client.Disconnect(context.Background()) })
+
+	return client
+}
+
+// testDatabase returns a new database, dropped afterwards
+func testDatabase(t *testing.T, client *mongo.Client) *mongo.Database {
+	t.Helper()
+
+	db := client.Database("chat_server_test_" + time.Now().Format("150405_000000"))
+	t.Cleanup(func() { _ = db.Drop(context.Background()) })
+	repository.Database = db
+
+	return db
+}
+
+// TestMongoStore runs against the replica set at MONGO_URL, in a database dropped afterwards
+func TestMongoStore(t *testing.T) {
+	client := connectMongo(t)
+
+	storetest.Run(t, func(t *testing.T) *repository.Store {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+
+		testDatabase(t, client)
+
+		err := repository.Migrate(ctx)
+		if err != nil {
+			t.Fatalf("failed to migrate: %v", err)
+		}
+
+		return repository.NewMongoStore()
+	})
+}
+
+// TestMergeDuplicateGroups migrates a database where a group was created twice,
+// the duplicate is merged into the oldest group, which can no longer be duplicated
+func TestMergeDuplicateGroups(t *testing.T) {
+	db := testDatabase(t, connectMongo(t))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	alice, bob := primitive.NewObjectID(), primitive.NewObjectID()
+	oldest, duplicate := primitive.NewObjectID(), primitive.NewObjectID()
+	_, err := db.Collection(repository.Rooms).InsertMany(ctx, []any{
+		repository.RoomModel{ID: oldest, Name: "general", Type: repository.GroupChatRoom, Participants: []primitive.ObjectID{alice}},
+		repository.RoomModel{ID: duplicate, Name: "general", Type: repository.GroupChatRoom, Participants: []primitive.ObjectID{alice, bob}},
+		repository.RoomModel{ID: primitive.NewObjectID(), Type: repository.PrivateChatRoom, Participants: []primitive.ObjectID{alice, bob}},
+		repository.RoomModel{ID: primitive.NewObjectID(), Type: repository.PrivateChatRoom, Participants: []primitive.ObjectID{alice, bob}},
+	})
+	if err != nil {
+		t.Fatalf("failed to insert rooms: %v", err)
+	}
+
+	message := repository.MessageModel{ID: primitive.NewObjectID(), RoomID: duplicate, SenderID: bob, Content: "hello", Timestamp: time.Now()}
+	_, err = db.Collection(repository.Message).InsertOne(ctx, message)
+	if err != nil {
+		t.Fatalf("failed to insert message: %v", err)
+	}
+
+	err = repository.Migrate(ctx)
+	if err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+
+	store := repository.NewMongoStore()
+
+	room, err := store.Rooms.FindRoom(ctx, oldest)
+	if err != nil || len(room.Participants) != 2 {
+		t.Errorf("FindRoom() of the oldest group = %+v, %v; want alice and bob", room, err)
+	}
+
+	_, err = store.Rooms.FindRoom(ctx, duplicate)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("FindRoom() of the duplicate = %v; want ErrNotFound", err)
+	}
+
+	moved, err := store.Messages.FindMessage(ctx, message.ID)
+	if err != nil || moved.RoomID != oldest {
+		t.Errorf("FindMessage() = %+v, %v; want the message in the oldest group", moved, err)
+	}
+
+	_, err = db.Collection(repository.Rooms).InsertOne(ctx, repository.RoomModel{ID: primitive.NewObjectID(), Name: "general", Type: repository.GroupChatRoom})
+	if !mongo.IsDuplicateKeyError(err) {
+		t.Errorf("InsertOne() of another general group = %v; want a duplicate key error", err)
+	}
+}
@@ -0,0 +1,821 @@
+// Package storetest checks that a storage backend honours the contracts of the
+// repository stores. Every backend runs the same suite from its own tests.
+package storetest
+
+import (
+	"chat-server/repository"
+	"context"
+	"errors"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// NewStore returns an empty store, it is called once per test
+type NewStore func(t *testing.T) *repository.Store
+
+// Run runs the whole suite against the backend
+func Run(t *testing.T, newStore NewStore) {
+	t.Run("Users", func(t *testing.T) { TestUsers(t, newStore(t)) })
+	t.Run("Rooms", func(t *testing.T) { TestRooms(t, newStore(t)) })
+	t.Run("Messages", func(t *testing.T) { TestMessages(t, newStore(t)) })
+	t.Run("ReadReceipts", func(t *testing.T) { TestReadReceipts(t, newStore(t)) })
+	t.Run("Presence", func(t *testing.T) { TestPresence(t, newStore(t)) })
+	t.Run("Outbox", func(t *testing.T) { TestOutbox(t, newStore(t)) })
+}
+
+func TestUsers(t *testing.T, store *repository.Store) {
+	ctx := context.Background()
+
+	alice := CreateUser(t, store, "alice")
+	if alice.ID.IsZero() || alice.CreatedAt.IsZero() {
+		t.Fatalf("created user has no ID or creation time: %+v", alice)
+	}
+
+	found, err := store.Users.FindUser(ctx, alice.ID)
+	if err != nil || found.Username != "alice" {
+		t.Fatalf("FindUser() = %+v, %v; want alice", found, err)
+	}
+
+	found, err = store.Users.FindUserByUsername(ctx, "alice")
+	if err != nil || found.ID != alice.ID {
+		t.Fatalf("FindUserByUsername() = %+v, %v; want alice", found, err)
+	}
+
+	_, err = store.Users.FindUser(ctx, primitive.NewObjectID())
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("FindUser() of an unknown user = %v; want ErrNotFound", err)
+	}
+
+	_, err = store.Users.FindUserByUsername(ctx, "nobody")
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("FindUserByUsername() of an unknown user = %v; want ErrNotFound", err)
+	}
+
+	_, err = store.Users.CreateUser(ctx, &repository.UserModel{Username: "alice"})
+	if !errors.Is(err, repository.ErrDuplicate) {
+		t.Errorf("CreateUser() of a taken username = %v; want ErrDuplicate", err)
+	}
+
+	CreateUser(t, store, "carol")
+	CreateUser(t, store, "bob")
+
+	count, err := store.Users.CountUsers(ctx)
+	if err != nil || count != 3 {
+		t.Errorf("CountUsers() = %d, %v; want 3", count, err)
+	}
+
+	byUsername := repository.Sort{Field: "username"}
+	assertUsernames(t, store, repository.Page{Number: 1, Limit: 2, Sort: byUsername}, "alice", "bob")
+	assertUsernames(t, store, repository.Page{Number: 2, Limit: 2, Sort: byUsername}, "carol")
+	assertUsernames(t, store, repository.Page{Number: 3, Limit: 2, Sort: byUsername})
+
+	byUsername.Descending = true
+	assertUsernames(t, store, repository.Page{Number: 1, Limit: 2, Sort: byUsername}, "carol", "bob")
+}
+
+func assertUsernames(t *testing.T, store *repository.Store, page repository.Page, usernames ...string) {
+	t.Helper()
+
+	users, err := store.Users.FindUsers(context.Background(), page)
+	if err != nil {
+		t.Fatalf("FindUsers(%+v) failed: %v", page, err)
+	}
+
+	var found []string
+	for _, user := range users {
+		found = append(found, user.Username)
+	}
+
+	if len(found) != len(usernames) {
+		t.Fatalf("FindUsers(%+v) = %v; want %v", page, found, usernames)
+	}
+	for i := range found {
+		if found[i] != usernames[i] {
+			t.Fatalf("FindUsers(%+v) = %v; want %v", page, found, usernames)
+		}
+	}
+}
+
+func TestRooms(t *testing.T, store *repository.Store) {
+	ctx := context.Background()
+	joins := recordJoins(store)
+
+	alice := CreateUser(t, store, "alice")
+	bob := CreateUser(t, store, "bob")
+
+	private, err := store.Rooms.JoinPrivateChatRoom(alice.ID, bob.ID)
+	if err != nil {
+		t.Fatalf("JoinPrivateChatRoom() failed: %v", err)
+	}
+	if private.Type != repository.PrivateChatRoom || len(private.Participants) != 2 {
+		t.Errorf("JoinPrivateChatRoom() = %+v; want a private room of 2", private)
+	}
+	joins.Expect(t, join{private.ID, alice.ID}, join{private.ID, bob.ID})
+
+	// Either participant finds the same room
+	again, err := store.Rooms.JoinPrivateChatRoom(bob.ID, alice.ID)
+	if err != nil || again.ID != private.ID {
+		t.Errorf("JoinPrivateChatRoom() of an existing room = %+v, %v; want %s", again, err, private.ID.Hex())
+	}
+	joins.Expect(t)
+
+	_, err = store.Rooms.JoinPrivateChatRoom(alice.ID, primitive.NewObjectID())
+	if err == nil {
+		t.Error("JoinPrivateChatRoom() with an unknown user succeeded")
+	}
+
+	_, err = store.Rooms.JoinPrivateChatRoom(alice.ID, alice.ID)
+	if err == nil {
+		t.Error("JoinPrivateChatRoom() with oneself succeeded")
+	}
+
+	group, err := store.Rooms.JoinGroupChatRoom(alice.ID, "general")
+	if err != nil {
+		t.Fatalf("JoinGroupChatRoom() failed: %v", err)
+	}
+	if group.Type != repository.GroupChatRoom || group.Name != "general" || len(group.Participants) != 1 {
+		t.Errorf("JoinGroupChatRoom() = %+v; want the general group of 1", group)
+	}
+	joins.Expect(t, join{group.ID, alice.ID})
+
+	group, err = store.Rooms.JoinGroupChatRoom(bob.ID, "general")
+	if err != nil || len(group.Participants) != 2 {
+		t.Fatalf("JoinGroupChatRoom() of an existing room = %+v, %v; want 2 participants", group, err)
+	}
+	joins.Expect(t, join{group.ID, bob.ID})
+
+	// Joining twice is a no-op
+	group, err = store.Rooms.JoinGroupChatRoom(bob.ID, "general")
+	if err != nil || len(group.Participants) != 2 {
+		t.Errorf("JoinGroupChatRoom() of a joined room = %+v, %v; want 2 participants", group, err)
+	}
+	joins.Expect(t)
+
+	found, err := store.Rooms.FindRoom(ctx, group.ID)
+	if err != nil || found.Name != "general" || len(found.Participants) != 2 {
+		t.Errorf("FindRoom() = %+v, %v; want the general group of 2", found, err)
+	}
+
+	_, err = store.Rooms.FindRoom(ctx, primitive.NewObjectID())
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("FindRoom() of an unknown room = %v; want ErrNotFound", err)
+	}
+
+	rooms, err := store.Rooms.FindParticipantRooms(ctx, bob.ID)
+	if err != nil || len(rooms) != 2 {
+		t.Errorf("FindParticipantRooms() = %d rooms, %v; want 2", len(rooms), err)
+	}
+
+	rooms, err = store.Rooms.FindParticipantRooms(ctx, primitive.NewObjectID())
+	if err != nil || len(rooms) != 0 {
+		t.Errorf("FindParticipantRooms() of a stranger = %d rooms, %v; want none", len(rooms), err)
+	}
+
+	count, err := store.Rooms.CountRooms(ctx)
+	if err != nil || count != 2 {
+		t.Errorf("CountRooms() = %d, %v; want 2", count, err)
+	}
+
+	rooms, err = store.Rooms.FindRooms(ctx, repository.Page{Number: 1, Limit: 1, Sort: repository.Sort{Field: "name", Descending: true}})
+	if err != nil || len(rooms) != 1 || rooms[0].ID != group.ID {
+		t.Errorf("FindRooms() = %v, %v; want the general group", rooms, err)
+	}
+
+	// Users joining a new group at once all end up in the same room
+	const joiners = 8
+	var users []*repository.UserModel
+	for i := 0; i < joiners; i++ {
+		users = append(users, CreateUser(t, store, fmt.Sprintf("joiner%d", i)))
+	}
+
+	var wg sync.WaitGroup
+	joined := make(chan *repository.RoomModel, joiners)
+	for _, user := range users {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			room, err := store.Rooms.JoinGroupChatRoom(user.ID, "busy")
+			if err != nil {
+				t.Errorf("JoinGroupChatRoom() of %s failed: %v", user.Username, err)
+				return
+			}
+			joined <- room
+		}()
+	}
+	wg.Wait()
+	close(joined)
+
+	var busy *repository.RoomModel
+	for room := range joined {
+		if busy != nil && room.ID != busy.ID {
+			t.Fatalf("concurrent joins created rooms %s and %s", busy.ID.Hex(), room.ID.Hex())
+		}
+		busy = room
+	}
+	if busy == nil {
+		t.FailNow()
+	}
+
+	found, err = store.Rooms.FindRoom(ctx, busy.ID)
+	if err != nil || len(found.Participants) != joiners {
+		t.Errorf("FindRoom() after concurrent joins = %+v, %v; want %d participants", found, err, joiners)
+	}
+
+	count, err = store.Rooms.CountRooms(ctx)
+	if err != nil || count != 3 {
+		t.Errorf("CountRooms() after concurrent joins = %d, %v; want 3", count, err)
+	}
+
+	notified := joins.take()
+	joinedUsers := make(map[primitive.ObjectID]bool)
+	for _, j := range notified {
+		if j.roomID != busy.ID || joinedUsers[j.userID] {
+			t.Fatalf("notified joins %v; want each joiner once in %s", notified, busy.ID.Hex())
+		}
+		joinedUsers[j.userID] = true
+	}
+	if len(joinedUsers) != joiners {
+		t.Errorf("notified %d joins; want %d", len(joinedUsers), joiners)
+	}
+}
+
+func TestMessages(t *testing.T, store *repository.Store) {
+	ctx := context.Background()
+
+	alice := CreateUser(t, store, "alice")
+	room := JoinGroup(t, store, alice, "general")
+	otherRoom := JoinGroup(t, store, alice, "random")
+
+	first := SendMessage(t, store, alice, room, "first", "client-1")
+	second := SendMessage(t, store, alice, room, "second", "")
+	third := SendMessage(t, store, alice, room, "third", "")
+	SendMessage(t, store, alice, otherRoom, "elsewhere", "")
+
+	_, err := store.Messages.FindMessage(ctx, primitive.NewObjectID())
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("FindMessage() of an unknown message = %v; want ErrNotFound", err)
+	}
+
+	found, err := store.Messages.FindByClientMessageID(ctx, alice.ID, "client-1")
+	if err != nil || found == nil || found.ID != first.ID {
+		t.Errorf("FindByClientMessageID() = %+v, %v; want the first message", found, err)
+	}
+
+	found, err = store.Messages.FindByClientMessageID(ctx, alice.ID, "client-2")
+	if err != nil || found != nil {
+		t.Errorf("FindByClientMessageID() of an unknown ID = %+v, %v; want nil", found, err)
+	}
+
+	// A client message ID is only sent once by a sender, another sender can reuse it
+	_, err = store.Messages.CreateWithOutbox(ctx, &repository.MessageModel{
+		RoomID:          room.ID,
+		SenderID:        alice.ID,
+		ClientMessageID: "client-1",
+		Content:         "first again",
+		Username:        alice.Username,
+	}, Topic, func(message *repository.MessageModel) ([]byte, error) {
+		return []byte(message.ID.Hex()), nil
+	})
+	if !errors.Is(err, repository.ErrDuplicate) {
+		t.Errorf("CreateWithOutbox() of a sent client message ID = %v; want ErrDuplicate", err)
+	}
+
+	bob := CreateUser(t, store, "bob")
+	JoinGroup(t, store, bob, "random")
+	SendMessage(t, store, bob, otherRoom, "from bob", "client-1")
+
+	count, err := store.Messages.CountMessages(ctx, room.ID)
+	if err != nil || count != 3 {
+		t.Errorf("CountMessages() = %d, %v; want 3", count, err)
+	}
+
+	count, err = store.Messages.CountMessages(ctx, primitive.NilObjectID)
+	if err != nil || count != 5 {
+		t.Errorf("CountMessages() of every room = %d, %v; want 5", count, err)
+	}
+
+	byTimestamp := repository.Sort{Field: "timestamp"}
+	messages, err := store.Messages.FindMessages(ctx, room.ID, repository.Page{Number: 2, Limit: 2, Sort: byTimestamp})
+	assertMessages(t, "FindMessages()", messages, err, third)
+
+	byTimestamp.Descending = true
+	messages, err = store.Messages.FindMessages(ctx, room.ID, repository.Page{Number: 1, Limit: 2, Sort: byTimestamp})
+	assertMessages(t, "FindMessages() newest first", messages, err, third, second)
+
+	messages, err = store.Messages.FindAfter(ctx, room.ID, first.Timestamp, first.ID, 10)
+	assertMessages(t, "FindAfter()", messages, err, second, third)
+
+	messages, err = store.Messages.FindAfter(ctx, room.ID, first.Timestamp, first.ID, 1)
+	assertMessages(t, "FindAfter() with a limit", messages, err, second)
+
+	messages, err = store.Messages.FindBefore(ctx, room.ID, third.Timestamp, third.ID, 10)
+	assertMessages(t, "FindBefore()", messages, err, first, second)
+
+	messages, err = store.Messages.FindBefore(ctx, room.ID, time.Time{}, primitive.NilObjectID, 2)
+	assertMessages(t, "FindBefore() without a position", messages, err, second, third)
+}
+
+func assertMessages(t *testing.T, call string, messages []*repository.MessageModel, err error, want ...*repository.MessageModel) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatalf("%s failed: %v", call, err)
+	}
+
+	var found, wanted []string
+	for _, message := range messages {
+		found = append(found, message.Content)
+	}
+	for _, message := range want {
+		wanted = append(wanted, message.Content)
+	}
+
+	if len(found) != len(wanted) {
+		t.Fatalf("%s = %v; want %v", call, found, wanted)
+	}
+	for i := range found {
+		if found[i] != wanted[i] {
+			t.Fatalf("%s = %v; want %v", call, found, wanted)
+		}
+	}
+}
+
+// TestReadReceipts checks that read cursors only move forward, and that the
+// read listeners are notified when, and only when, a cursor moves
+func TestReadReceipts(t *testing.T, store *repository.Store) {
+	ctx := context.Background()
+	reads := recordReads(store)
+
+	alice := CreateUser(t, store, "alice")
+	bob := CreateUser(t, store, "bob")
+	room := JoinGroup(t, store, alice, "general")
+	JoinGroup(t, store, bob, "general")
+
+	first := SendMessage(t, store, bob, room, "first", "")
+	second := SendMessage(t, store, bob, room, "second", "")
+	SendMessage(t, store, alice, room, "own", "")
+
+	assertUnread(t, store, room, alice, 2)
+
+	receipt, err := store.ReadReceipts.MarkRead(ctx, alice.ID, first)
+	if err != nil || receipt.LastReadMessageID != first.ID || receipt.UserID != alice.ID || receipt.RoomID != room.ID {
+		t.Fatalf("MarkRead() = %+v, %v; want a cursor on the first message", receipt, err)
+	}
+	reads.Expect(t, first.ID)
+	assertUnread(t, store, room, alice, 1)
+
+	// Marking the same message again does not move the cursor
+	_, err = store.ReadReceipts.MarkRead(ctx, alice.ID, first)
+	if err != nil {
+		t.Fatalf("MarkRead() failed: %v", err)
+	}
+	reads.Expect(t)
+
+	_, err = store.ReadReceipts.MarkRead(ctx, alice.ID, second)
+	if err != nil {
+		t.Fatalf("MarkRead() failed: %v", err)
+	}
+	reads.Expect(t, second.ID)
+	assertUnread(t, store, room, alice, 0)
+
+	// The cursor never moves backwards
+	receipt, err = store.ReadReceipts.MarkRead(ctx, alice.ID, first)
+	if err != nil || receipt.LastReadMessageID != second.ID {
+		t.Fatalf("MarkRead() of an older message = %+v, %v; want the cursor to stay on the second message", receipt, err)
+	}
+	reads.Expect(t)
+	assertUnread(t, store, room, alice, 0)
+
+	// Bob has not read anything, his own messages are not unread
+	assertUnread(t, store, room, bob, 1)
+
+	// Unread messages are counted in several rooms at once
+	random := JoinGroup(t, store, bob, "random")
+	JoinGroup(t, store, alice, "random")
+	quiet := JoinGroup(t, store, alice, "quiet")
+	SendMessage(t, store, bob, random, "one", "")
+	SendMessage(t, store, bob, random, "two", "")
+
+	counts, err := store.ReadReceipts.CountUnreadByRooms(ctx, alice.ID, []primitive.ObjectID{room.ID, random.ID, quiet.ID})
+	want := map[primitive.ObjectID]int64{room.ID: 0, random.ID: 2, quiet.ID: 0}
+	if err != nil || !maps.Equal(counts, want) {
+		t.Errorf("CountUnreadByRooms() = %v, %v; want %v", counts, err, want)
+	}
+
+	counts, err = store.ReadReceipts.CountUnreadByRooms(ctx, alice.ID, nil)
+	if err != nil || len(counts) != 0 {
+		t.Errorf("CountUnreadByRooms() of no room = %v, %v; want none", counts, err)
+	}
+}
+
+func assertUnread(t *testing.T, store *repository.Store, room *repository.RoomModel, user *repository.UserModel, want int64) {
+	t.Helper()
+
+	count, err := store.ReadReceipts.CountUnread(context.Background(), room.ID, user.ID)
+	if err != nil || count != want {
+		t.Errorf("CountUnread() of %s = %d, %v; want %d", user.Username, count, err, want)
+	}
+
+	counts, err := store.ReadReceipts.CountUnreadByRooms(context.Background(), user.ID, []primitive.ObjectID{room.ID})
+	if err != nil || len(counts) != 1 || counts[room.ID] != want {
+		t.Errorf("CountUnreadByRooms() of %s = %v, %v; want %d", user.Username, counts, err, want)
+	}
+}
+
+func TestPresence(t *testing.T, store *repository.Store) {
+	ctx := context.Background()
+
+	alice := primitive.NewObjectID()
+	bob := primitive.NewObjectID()
+
+	_, err := store.Presence.FindPresence(ctx, alice)
+	if !errors.Is(err, repository.ErrNotFound) {
+		t.Errorf("FindPresence() of a user never online = %v; want ErrNotFound", err)
+	}
+
+	presence, err := store.Presence.ConnectInstance(ctx, alice, "a")
+	assertPresence(t, "ConnectInstance()", presence, err, repository.PresenceOnline, "a")
+
+	presence, err = store.Presence.ConnectInstance(ctx, alice, "b")
+	assertPresence(t, "ConnectInstance() on a second instance", presence, err, repository.PresenceOnline, "a", "b")
+
+	// Connecting twice to the same instance is a no-op
+	presence, err = store.Presence.ConnectInstance(ctx, alice, "b")
+	assertPresence(t, "ConnectInstance() twice", presence, err, repository.PresenceOnline, "a", "b")
+
+	presence, err = store.Presence.DisconnectInstance(ctx, alice, "a")
+	assertPresence(t, "DisconnectInstance() of one instance", presence, err, repository.PresenceOnline, "b")
+
+	presence, err = store.Presence.SetStatus(ctx, alice, repository.PresenceAway)
+	assertPresence(t, "SetStatus()", presence, err, repository.PresenceAway, "b")
+
+	presence, err = store.Presence.DisconnectInstance(ctx, alice, "b")
+	assertPresence(t, "DisconnectInstance() of the last instance", presence, err, repository.PresenceOffline)
+
+	presence, err = store.Presence.FindPresence(ctx, alice)
+	assertPresence(t, "FindPresence()", presence, err, repository.PresenceOffline)
+
+	presence, err = store.Presence.SetStatus(ctx, alice, repository.PresenceAway)
+	if err != nil || presence != nil {
+		t.Errorf("SetStatus() of an offline user = %+v, %v; want nil", presence, err)
+	}
+
+	presence, err = store.Presence.DisconnectInstance(ctx, bob, "a")
+	if err != nil || presence != nil {
+		t.Errorf("DisconnectInstance() of a user never online = %+v, %v; want nil", presence, err)
+	}
+
+	// Releasing an instance only takes offline the users connected nowhere else
+	_, err = store.Presence.ConnectInstance(ctx, alice, "a")
+	if err != nil {
+		t.Fatalf("ConnectInstance() failed: %v", err)
+	}
+	_, err = store.Presence.ConnectInstance(ctx, alice, "b")
+	if err != nil {
+		t.Fatalf("ConnectInstance() failed: %v", err)
+	}
+	_, err = store.Presence.ConnectInstance(ctx, bob, "a")
+	if err != nil {
+		t.Fatalf("ConnectInstance() failed: %v", err)
+	}
+
+	// Instances without a lease count as expired
+	err = store.Presence.Heartbeat(ctx, "b", time.Minute)
+	if err != nil {
+		t.Fatalf("Heartbeat() failed: %v", err)
+	}
+	err = store.Presence.Heartbeat(ctx, "c", -time.Second)
+	if err != nil {
+		t.Fatalf("Heartbeat() failed: %v", err)
+	}
+	_, err = store.Presence.ConnectInstance(ctx, bob, "c")
+	if err != nil {
+		t.Fatalf("ConnectInstance() failed: %v", err)
+	}
+
+	expired, err := store.Presence.ExpiredInstances(ctx)
+	if err != nil || !slices.Equal(expired, []string{"a", "c"}) {
+		t.Errorf("ExpiredInstances() = %v, %v; want [a c]", expired, err)
+	}
+
+	released, err := store.Presence.ReleaseInstance(ctx, "a")
+	if err != nil {
+		t.Fatalf("ReleaseInstance() failed: %v", err)
+	}
+	slices.SortFunc(released, func(a *repository.PresenceModel, b *repository.PresenceModel) int {
+		return strings.Compare(a.ID.Hex(), b.ID.Hex())
+	})
+	if len(released) != 2 || released[0].ID != alice || released[1].ID != bob {
+		t.Fatalf("ReleaseInstance() = %v; want the presence of alice and bob", released)
+	}
+	assertPresence(t, "ReleaseInstance()", released[0], nil, repository.PresenceOnline, "b")
+	assertPresence(t, "ReleaseInstance()", released[1], nil, repository.PresenceOnline, "c")
+
+	// Releasing an instance again, e.g. by another instance, releases nobody
+	released, err = store.Presence.ReleaseInstance(ctx, "a")
+	if err != nil || len(released) != 0 {
+		t.Errorf("ReleaseInstance() again = %v, %v; want nobody", released, err)
+	}
+
+	presence, err = store.Presence.FindPresence(ctx, alice)
+	assertPresence(t, "FindPresence() after a release", presence, err, repository.PresenceOnline, "b")
+
+	_, err = store.Presence.ReleaseInstance(ctx, "c")
+	if err != nil {
+		t.Fatalf("ReleaseInstance() failed: %v", err)
+	}
+
+	presence, err = store.Presence.FindPresence(ctx, bob)
+	assertPresence(t, "FindPresence() after a release", presence, err, repository.PresenceOffline)
+
+	expired, err = store.Presence.ExpiredInstances(ctx)
+	if err != nil || len(expired) != 0 {
+		t.Errorf("ExpiredInstances() after the releases = %v, %v; want none", expired, err)
+	}
+}
+
+func assertPresence(t *testing.T, call string, presence *repository.PresenceModel, err error, status string, instances ...string) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatalf("%s failed: %v", call, err)
+	}
+	if presence == nil {
+		t.Fatalf("%s = nil; want %s on %v", call, status, instances)
+	}
+
+	matches := presence.Status == status && len(presence.Instances) == len(instances)
+	for i := 0; matches && i < len(instances); i++ {
+		matches = presence.Instances[i] == instances[i]
+	}
+	if !matches {
+		t.Fatalf("%s = %s on %v; want %s on %v", call, presence.Status, presence.Instances, status, instances)
+	}
+}
+
+// TestOutbox checks that a pending record is relayed by one instance at a time
+// until it is marked as sent
+func TestOutbox(t *testing.T, store *repository.Store) {
+	ctx := context.Background()
+
+	record, err := store.Outbox.ClaimPending(ctx, "a", time.Minute)
+	if err != nil || record != nil {
+		t.Fatalf("ClaimPending() of an empty outbox = %+v, %v; want nil", record, err)
+	}
+
+	alice := CreateUser(t, store, "alice")
+	room := JoinGroup(t, store, alice, "general")
+	message := SendMessage(t, store, alice, room, "hello", "")
+
+	record, err = store.Outbox.ClaimPending(ctx, "a", time.Minute)
+	if err != nil || record == nil {
+		t.Fatalf("ClaimPending() = %+v, %v; want the message's record", record, err)
+	}
+	if record.Topic != Topic || string(record.Body) != message.ID.Hex() || record.Attempts != 1 || record.LockedBy != "a" {
+		t.Errorf("ClaimPending() = %+v; want the first attempt of instance a at relaying the message", record)
+	}
+
+	claimed, err := store.Outbox.ClaimPending(ctx, "b", time.Minute)
+	if err != nil || claimed != nil {
+		t.Errorf("ClaimPending() of a claimed record = %+v, %v; want nil", claimed, err)
+	}
+
+	err = store.Outbox.Release(ctx, record.ID, time.Now())
+	if err != nil {
+		t.Fatalf("Release() failed: %v", err)
+	}
+
+	claimed, err = store.Outbox.ClaimPending(ctx, "b", time.Millisecond)
+	if err != nil || claimed == nil || claimed.ID != record.ID || claimed.Attempts != 2 {
+		t.Fatalf("ClaimPending() of a released record = %+v, %v; want the second attempt", claimed, err)
+	}
+
+	// The lease of b expires, a takes over
+	time.Sleep(20 * time.Millisecond)
+
+	claimed, err = store.Outbox.ClaimPending(ctx, "a", time.Minute)
+	if err != nil || claimed == nil || claimed.ID != record.ID || claimed.Attempts != 3 {
+		t.Fatalf("ClaimPending() of an expired lease = %+v, %v; want the third attempt", claimed, err)
+	}
+
+	err = store.Outbox.MarkSent(ctx, record.ID)
+	if err != nil {
+		t.Fatalf("MarkSent() failed: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	claimed, err = store.Outbox.ClaimPending(ctx, "b", time.Minute)
+	if err != nil || claimed != nil {
+		t.Errorf("ClaimPending() of a sent record = %+v, %v; want nil", claimed, err)
+	}
+
+	// A record released for later does not hold back the next one
+	failing := SendMessage(t, store, alice, room, "failing", "")
+	next := SendMessage(t, store, alice, room, "next", "")
+
+	record, err = store.Outbox.ClaimPending(ctx, "a", time.Minute)
+	if err != nil || record == nil || string(record.Body) != failing.ID.Hex() {
+		t.Fatalf("ClaimPending() = %+v, %v; want the record of the failing message", record, err)
+	}
+
+	err = store.Outbox.Release(ctx, record.ID, time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Release() failed: %v", err)
+	}
+
+	claimed, err = store.Outbox.ClaimPending(ctx, "a", time.Minute)
+	if err != nil || claimed == nil || string(claimed.Body) != next.ID.Hex() {
+		t.Fatalf("ClaimPending() with a record released for later = %+v, %v; want the record of the next message", claimed, err)
+	}
+
+	err = store.Outbox.MarkSent(ctx, claimed.ID)
+	if err != nil {
+		t.Fatalf("MarkSent() failed: %v", err)
+	}
+
+	claimed, err = store.Outbox.ClaimPending(ctx, "a", time.Minute)
+	if err != nil || claimed != nil {
+		t.Errorf("ClaimPending() of a record released for later = %+v, %v; want nil", claimed, err)
+	}
+
+	// A record given up is never claimed again
+	err = store.Outbox.Release(ctx, record.ID, time.Now())
+	if err != nil {
+		t.Fatalf("Release() failed: %v", err)
+	}
+
+	claimed, err = store.Outbox.ClaimPending(ctx, "a", time.Minute)
+	if err != nil || claimed == nil || claimed.ID != record.ID || claimed.Attempts != 2 {
+		t.Fatalf("ClaimPending() of a record due again = %+v, %v; want its second attempt", claimed, err)
+	}
+
+	err = store.Outbox.MarkFailed(ctx, record.ID)
+	if err != nil {
+		t.Fatalf("MarkFailed() failed: %v", err)
+	}
+
+	claimed, err = store.Outbox.ClaimPending(ctx, "a", time.Minute)
+	if err != nil || claimed != nil {
+		t.Errorf("ClaimPending() of a failed record = %+v, %v; want nil", claimed, err)
+	}
+}
+
+// Topic is the outbox topic of the messages sent by SendMessage
+const Topic = "storetest"
+
+func CreateUser(t *testing.T, store *repository.Store, username string) *repository.UserModel {
+	t.Helper()
+
+	user, err := store.Users.CreateUser(context.Background(), &repository.UserModel{
+		FirstName: username,
+		LastName:  username,
+		Username:  username,
+		Password:  "secret",
+	})
+	if err != nil {
+		t.Fatalf("CreateUser(%s) failed: %v", username, err)
+	}
+
+	return user
+}
+
+func JoinGroup(t *testing.T, store *repository.Store, user *repository.UserModel, name string) *repository.RoomModel {
+	t.Helper()
+
+	room, err := store.Rooms.JoinGroupChatRoom(user.ID, name)
+	if err != nil {
+		t.Fatalf("JoinGroupChatRoom(%s) failed: %v", name, err)
+	}
+
+	return room
+}
+
+// SendMessage stores a message with its outbox record, whose body is the message ID,
+// and returns the message as stored
+func SendMessage(t *testing.T, store *repository.Store, user *repository.UserModel, room *repository.RoomModel, content string, clientMessageID string) *repository.MessageModel {
+	t.Helper()
+
+	ctx := context.Background()
+	message, err := store.Messages.CreateWithOutbox(ctx, &repository.MessageModel{
+		RoomID:          room.ID,
+		SenderID:        user.ID,
+		ClientMessageID: clientMessageID,
+		Content:         content,
+		Username:        user.Username,
+	}, Topic, func(message *repository.MessageModel) ([]byte, error) {
+		return []byte(message.ID.Hex()), nil
+	})
+	if err != nil {
+		t.Fatalf("CreateWithOutbox(%s) failed: %v", content, err)
+	}
+
+	stored, err := store.Messages.FindMessage(ctx, message.ID)
+	if err != nil {
+		t.Fatalf("FindMessage(%s) failed: %v", content, err)
+	}
+	if !stored.Timestamp.Equal(message.Timestamp) {
+		t.Errorf("CreateWithOutbox() announced %s, stored %s", message.Timestamp, stored.Timestamp)
+	}
+
+	return stored
+}
+
+type join struct {
+	roomID primitive.ObjectID
+	userID primitive.ObjectID
+}
+
+// joinRecorder records the notified room joins
+type joinRecorder struct {
+	mu    sync.Mutex
+	joins []join
+}
+
+func recordJoins(store *repository.Store) *joinRecorder {
+	joins := &joinRecorder{}
+	store.Listeners.OnRoomJoin(func(roomID primitive.ObjectID, userID primitive.ObjectID) {
+		joins.mu.Lock()
+		defer joins.mu.Unlock()
+
+		joins.joins = append(joins.joins, join{roomID: roomID, userID: userID})
+	})
+
+	return joins
+}
+
+// take returns the joins notified since the previous call, in any order
+func (j *joinRecorder) take() []join {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	notified := j.joins
+	j.joins = nil
+
+	return notified
+}
+
+// Expect checks the joins notified since the previous call
+func (j *joinRecorder) Expect(t *testing.T, want ...join) {
+	t.Helper()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	notified := j.joins
+	j.joins = nil
+
+	if len(notified) != len(want) {
+		t.Fatalf("notified joins %v; want %v", notified, want)
+	}
+	for i := range notified {
+		if notified[i] != want[i] {
+			t.Fatalf("notified joins %v; want %v", notified, want)
+		}
+	}
+}
+
+// readRecorder records the messages of the notified read receipts
+type readRecorder struct {
+	mu       sync.Mutex
+	messages []primitive.ObjectID
+}
+
+func recordReads(store *repository.Store) *readRecorder {
+	reads := &readRecorder{}
+	store.Listeners.OnRead(func(receipt *repository.ReadReceiptModel) {
+		reads.mu.Lock()
+		defer reads.mu.Unlock()
+
+		reads.messages = append(reads.messages, receipt.LastReadMessageID)
+	})
+
+	return reads
+}
+
+// Expect checks the read receipts notified since the previous call
+func (r *readRecorder) Expect(t *testing.T, want ...primitive.ObjectID) {
+	t.Helper()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	notified := r.messages
+	r.messages = nil
+
+	if len(notified) != len(want) {
+		t.Fatalf("notified reads %v; want %v", notified, want)
+	}
+	for i := range notified {
+		if notified[i] != want[i] {
+			t.Fatalf("notified reads %v; want %v", notified, want)
+		}
+	}
+}
@@ -1,7 +1,11 @@
 package repository
 
 import (
+	"context"
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
 	"time"
 )
 
@@ -31,3 +35,50 @@ func (um *UserModel) SetID(id primitive.ObjectID) {
 func (um *UserModel) SetTimestamp() {
 	um.CreatedAt = time.Now()
 }
+
+func (m *Model[T]) CreateUser(ctx context.Context, user *UserModel) (*UserModel, error) {
+	userRepo := NewUser()
+
+	newUser, err := userRepo.Create(ctx, user)
+	if mongo.IsDuplicateKeyError(err) {
+		return nil, fmt.Errorf("username '%s' is taken: %w", user.Username, ErrDuplicate)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return *newUser, nil
+}
+
+func (m *Model[T]) FindUser(ctx context.Context, id primitive.ObjectID) (*UserModel, error) {
+	return findUser(ctx, bson.M{"_id": id})
+}
+
+func (m *Model[T]) FindUserByUsername(ctx context.Context, username string) (*UserModel, error) {
+	return findUser(ctx, bson.M{"username": username})
+}
+
+func findUser(ctx context.Context, filter interface{}) (*UserModel, error) {
+	userRepo := NewUser()
+
+	user, err := userRepo.FindOne(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return *user, nil
+}
+
+func (m *Model[T]) FindUsers(ctx context.Context, page Page) ([]*UserModel, error) {
+	userRepo := NewUser()
+
+	users, err := userRepo.Find(ctx, bson.M{}, page)
+	if err != nil {
+		return nil, err
+	}
+
+	return unwrap(users), nil
+}
+
+func (m *Model[T]) CountUsers(ctx context.Context) (int64, error) {
+	return NewUser().Count(ctx, bson.M{})
+}
@@ -0,0 +1,102 @@
+package websocket
+
+import (
+	"context"
+	"sync"
+)
+
+// changeSet coalesces the changes made to the state of keys, e.g. the users online
+// on this instance. The hub adds changes without ever blocking, and a single consumer
+// takes them in batches, only seeing the latest change of each key.
+type changeSet[K comparable, C any] struct {
+	mu      sync.Mutex
+	keys    []K // Keys with a pending change, in the order they first changed
+	changes map[K]C
+	ready   chan struct{} // Signaled when changes are pending
+
+	// Versions count the changes added, so that a producer can wait for the
+	// consumer to apply the changes added up to a point
+	added   uint64        // Version of the last change added
+	taken   uint64        // Version of the last change taken
+	applied uint64        // Version of the last change applied
+	done    chan struct{} // Closed and replaced whenever a batch was applied
+}
+
+func newChangeSet[K comparable, C any]() *changeSet[K, C] {
+	return &changeSet[K, C]{
+		changes: make(map[K]C),
+		ready:   make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// add records the change of a key, replacing the change of the key not taken yet
+func (s *changeSet[K, C]) add(key K, change C) {
+	s.mu.Lock()
+	if _, pending := s.changes[key]; !pending {
+		s.keys = append(s.keys, key)
+	}
+	s.changes[key] = change
+	s.added++
+	s.mu.Unlock()
+
+	select {
+	case s.ready <- struct{}{}:
+	default: // The consumer is already due to take the changes
+	}
+}
+
+// take waits for changes and returns the pending ones, possibly none
+func (s *changeSet[K, C]) take() []C {
+	<-s.ready
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	changes := make([]C, 0, len(s.keys))
+	for _, key := range s.keys {
+		changes = append(changes, s.changes[key])
+	}
+	s.keys = nil
+	clear(s.changes)
+	s.taken = s.added
+
+	return changes
+}
+
+// version returns the version of the last change added
+func (s *changeSet[K, C]) version() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.added
+}
+
+// markApplied reports that the consumer applied the changes of its last take
+func (s *changeSet[K, C]) markApplied() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.applied = s.taken
+	close(s.done)
+	s.done = make(chan struct{})
+}
+
+// waitApplied waits until the consumer applied the changes up to the version
+func (s *changeSet[K, C]) waitApplied(ctx context.Context, version uint64) error {
+	for {
+		s.mu.Lock()
+		applied, done := s.applied, s.done
+		s.mu.Unlock()
+
+		if applied >= version {
+			return nil
+		}
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
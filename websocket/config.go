@@ -0,0 +1,114 @@
+package websocket
+
+import (
+	"fmt"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Policies applied when a client's send queue is full
+const (
+	DropOldest = "drop_oldest" // Discard the oldest queued frame to make room for the new one
+	DropNewest = "drop_newest" // Discard the new frame
+	Disconnect = "disconnect"  // Close the connection, the client is expected to reconnect
+)
+
+// Config holds the settings of the websocket server
+type Config struct {
+	PingInterval       time.Duration // How often the server pings the client
+	PongWait           time.Duration // How long the server waits for any frame or pong before dropping the client
+	WriteWait          time.Duration // How long a single write to the client may take
+	SendBufferSize     int           // How many frames can be queued for a client
+	SlowConsumerPolicy string        // What happens when a client's queue is full
+	TypingTimeout      time.Duration // How long a typing indicator lasts without a typing.stop
+	InstanceID         string        // Identifies this server instance among the instances sharing the broker
+	InstanceTTL        time.Duration // How long the users of an instance stay online after its last heartbeat
+	OutboxMaxAttempts  int           // How many times a message is published before it is given up
+	OutboxRetryDelay   time.Duration // How long a message waits after its first failed publish, doubled on every attempt
+}
+
+// LoadConfig reads the websocket settings from the environment,
+// falling back to the defaults for missing or invalid values
+func LoadConfig() Config {
+	config := Config{
+		PingInterval:       durationFromEnv("WS_PING_INTERVAL", 50*time.Second),
+		PongWait:           durationFromEnv("WS_PONG_WAIT", 60*time.Second),
+		WriteWait:          durationFromEnv("WS_WRITE_WAIT", 10*time.Second),
+		SendBufferSize:     intFromEnv("WS_SEND_BUFFER_SIZE", 256),
+		SlowConsumerPolicy: os.Getenv("WS_SLOW_CONSUMER_POLICY"),
+		TypingTimeout:      durationFromEnv("WS_TYPING_TIMEOUT", 10*time.Second),
+		InstanceID:         instanceID(),
+		InstanceTTL:        durationFromEnv("INSTANCE_TTL", 30*time.Second),
+		OutboxMaxAttempts:  intFromEnv("OUTBOX_MAX_ATTEMPTS", 10),
+		OutboxRetryDelay:   durationFromEnv("OUTBOX_RETRY_DELAY", time.Second),
+	}
+
+	switch config.SlowConsumerPolicy {
+	case DropOldest, DropNewest, Disconnect:
+	case "":
+		config.SlowConsumerPolicy = DropNewest
+	default:
+		log.Printf("invalid WS_SLOW_CONSUMER_POLICY '%s', using %s", config.SlowConsumerPolicy, DropNewest)
+		config.SlowConsumerPolicy = DropNewest
+	}
+
+	// A ping must be sent before the client is considered dead
+	if config.PingInterval >= config.PongWait {
+		config.PingInterval = config.PongWait * 9 / 10
+		log.Printf("WS_PING_INTERVAL must be shorter than WS_PONG_WAIT, using %v", config.PingInterval)
+	}
+
+	return config
+}
+
+func durationFromEnv(key string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		log.Printf("invalid %s '%s', using %v", key, value, defaultValue)
+
+		return defaultValue
+	}
+
+	return duration
+}
+
+func intFromEnv(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil || number <= 0 {
+		log.Printf("invalid %s '%s', using %d", key, value, defaultValue)
+
+		return defaultValue
+	}
+
+	return number
+}
+
+// instanceID uses INSTANCE_ID when set, otherwise the host name and process ID,
+// which tell apart several processes on one host and stay the same when a
+// container restarts
+func instanceID() string {
+	id := os.Getenv("INSTANCE_ID")
+	if id != "" {
+		return id
+	}
+
+	hostname, err := os.Hostname()
+	if err == nil && hostname != "" {
+		return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+
+	return primitive.NewObjectID().Hex()
+}
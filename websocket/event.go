@@ -0,0 +1,131 @@
+package websocket
+
+import (
+	"encoding/json"
+)
+
+// ProtocolVersion is the version of the event envelope spoken by the server.
+// Frames without a version are treated as the current version.
+const ProtocolVersion = 1
+
+// Client-to-server event types
+const (
+	EventMessageSend = "message.send"
+	EventRoomJoin    = "room.join"
+	EventSync        = "sync"
+)
+
+// Typing events are sent by clients and fanned out with the same type to the
+// other participants of the room. They are ephemeral and never persisted.
+const (
+	EventTypingStart = "typing.start"
+	EventTypingStop  = "typing.stop"
+)
+
+// Presence events. Clients set their own status with presence.set and
+// receive presence.changed for the users they share a room with.
+const (
+	EventPresenceSet     = "presence.set"
+	EventPresenceChanged = "presence.changed"
+)
+
+// Read receipts. Clients mark messages as read with read and
+// receive read.updated when a participant of their rooms did so.
+const (
+	EventRead        = "read"
+	EventReadUpdated = "read.updated"
+)
+
+// Server-to-client event types
+const (
+	EventMessageNew = "message.new"
+	EventError      = "error"
+	EventAck        = "ack"
+)
+
+// Error codes sent in the payload of an error event
+const (
+	ErrCodeInvalidFrame       = "invalid_frame"
+	ErrCodeUnsupportedVersion = "unsupported_version"
+	ErrCodeUnknownEvent       = "unknown_event"
+	ErrCodeInvalidPayload     = "invalid_payload"
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeInternal           = "internal_error"
+)
+
+// Event is the envelope of every frame exchanged over the websocket connection
+type Event struct {
+	Version int             `json:"version,omitempty"`
+	Type    string          `json:"type"`
+	ID      string          `json:"id,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+type ErrorPayload struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ProtocolError is returned by event handlers to report a failure back to the client
+type ProtocolError struct {
+	Code    string
+	Message string
+}
+
+func (e *ProtocolError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+func newProtocolError(code, message string) *ProtocolError {
+	return &ProtocolError{Code: code, Message: message}
+}
+
+// NewEvent builds an envelope with the payload encoded as JSON
+func NewEvent(eventType, id string, payload interface{}) (Event, error) {
+	event := Event{
+		Version: ProtocolVersion,
+		Type:    eventType,
+		ID:      id,
+	}
+
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return Event{}, err
+		}
+
+		event.Payload = data
+	}
+
+	return event, nil
+}
+
+// encodeEvent builds an envelope and encodes it into a websocket frame
+func encodeEvent(eventType, id string, payload interface{}) ([]byte, error) {
+	event, err := NewEvent(eventType, id, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(event)
+}
+
+// typingUserID returns the user a typing frame was sent by, or an empty
+// string for any other frame
+func typingUserID(frame []byte) string {
+	var event Event
+	err := json.Unmarshal(frame, &event)
+	if err != nil || (event.Type != EventTypingStart && event.Type != EventTypingStop) {
+		return ""
+	}
+
+	var typing struct {
+		UserID string `json:"userId"`
+	}
+	err = json.Unmarshal(event.Payload, &typing)
+	if err != nil {
+		return ""
+	}
+
+	return typing.UserID
+}
@@ -0,0 +1,345 @@
+package websocket
+
+import (
+	"chat-server/dto"
+	"chat-server/repository"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"log"
+	"net/http"
+	"time"
+)
+
+// EventHandler processes a single client event. Returning a *ProtocolError
+// sends a structured error event with the same code back to the client.
+type EventHandler func(c *Client, event Event) error
+
+// Handle registers the handler for a client-to-server event type
+func (sh *SocketHandler) Handle(eventType string, handler EventHandler) {
+	sh.handlers[eventType] = handler
+}
+
+func (sh *SocketHandler) registerDefaultHandlers() {
+	sh.Handle(EventMessageSend, handleMessageSend)
+	sh.Handle(EventRoomJoin, handleRoomJoin)
+	sh.Handle(EventSync, handleSync)
+	sh.Handle(EventTypingStart, handleTypingStart)
+	sh.Handle(EventTypingStop, handleTypingStop)
+	sh.Handle(EventPresenceSet, handlePresenceSet)
+	sh.Handle(EventRead, handleRead)
+}
+
+// dispatch decodes a frame and routes it to the handler of its event type
+func (c *Client) dispatch(frame []byte) {
+	var event Event
+	err := json.Unmarshal(frame, &event)
+	if err != nil || event.Type == "" {
+		c.sendError("", newProtocolError(ErrCodeInvalidFrame, "frame must be an event envelope with a type"))
+		return
+	}
+
+	if event.Version != 0 && event.Version != ProtocolVersion {
+		message := fmt.Sprintf("protocol version %d is not supported, use version %d", event.Version, ProtocolVersion)
+		c.sendError(event.ID, newProtocolError(ErrCodeUnsupportedVersion, message))
+		return
+	}
+
+	handler, ok := c.Handler.handlers[event.Type]
+	if !ok {
+		c.sendError(event.ID, newProtocolError(ErrCodeUnknownEvent, "unknown event type: "+event.Type))
+		return
+	}
+
+	err = handler(c, event)
+	if err != nil {
+		c.sendError(event.ID, err)
+	}
+}
+
+// sendEvent encodes an event and queues it for delivery to the client
+func (c *Client) sendEvent(eventType, id string, payload interface{}) {
+	frame, err := encodeEvent(eventType, id, payload)
+	if err != nil {
+		log.Printf("failed to encode '%s' event: %v", eventType, err)
+		return
+	}
+
+	c.enqueue(frame)
+}
+
+func (c *Client) sendError(id string, err error) {
+	var protocolErr *ProtocolError
+	if !errors.As(err, &protocolErr) {
+		log.Println("failed to handle client event: ", err)
+		protocolErr = newProtocolError(ErrCodeInternal, err.Error())
+	}
+
+	c.sendEvent(EventError, id, ErrorPayload{
+		Code:    protocolErr.Code,
+		Message: protocolErr.Message,
+	})
+}
+
+func handleMessageSend(c *Client, event Event) error {
+	var msg dto.MessageDto
+	err := json.Unmarshal(event.Payload, &msg)
+	if err != nil {
+		return newProtocolError(ErrCodeInvalidPayload, "invalid message payload: "+err.Error())
+	}
+
+	msgModel, err := dto.ToMessageModel(msg)
+	if err != nil {
+		return newProtocolError(ErrCodeInvalidPayload, err.Error())
+	}
+
+	// Only participants of a room can send messages to it
+	if !c.isInRoom(msg.RoomID) {
+		return newProtocolError(ErrCodeForbidden, "not a participant of room "+msg.RoomID)
+	}
+
+	msgRepository := c.Handler.store.Messages
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// A retry of an already persisted message is acknowledged again
+	// instead of creating a duplicate
+	if msg.ClientMessageID != "" {
+		existingMsg, err := msgRepository.FindByClientMessageID(ctx, c.UserID, msg.ClientMessageID)
+		if err != nil {
+			return fmt.Errorf("failed to look up message '%s': %w", msg.ClientMessageID, err)
+		}
+
+		if existingMsg != nil {
+			c.sendEvent(EventAck, event.ID, dto.ToMessageAck(existingMsg))
+
+			return nil
+		}
+	}
+
+	// Persist message to DB
+	msgModel.SenderID = c.UserID
+	msgModel.Username = c.Username
+
+	// The message is published by the outbox relay, once it is stored
+	newMsg, err := msgRepository.CreateWithOutbox(ctx, msgModel, msg.RoomID, func(message *repository.MessageModel) ([]byte, error) {
+		frame, err := encodeEvent(EventMessageNew, "", dto.ToMessageDto(message))
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal message to json: %w", err)
+		}
+
+		return frame, nil
+	})
+	if errors.Is(err, repository.ErrDuplicate) {
+		// A concurrent retry stored the message first
+		existingMsg, err := msgRepository.FindByClientMessageID(ctx, c.UserID, msg.ClientMessageID)
+		if err != nil {
+			return fmt.Errorf("failed to look up message '%s': %w", msg.ClientMessageID, err)
+		}
+		if existingMsg == nil {
+			return fmt.Errorf("message '%s' was sent but cannot be found", msg.ClientMessageID)
+		}
+
+		c.sendEvent(EventAck, event.ID, dto.ToMessageAck(existingMsg))
+
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to persist message to DB: %w", err)
+	}
+	c.Handler.notifyOutbox()
+
+	c.sendEvent(EventAck, event.ID, dto.ToMessageAck(newMsg))
+
+	return nil
+}
+
+func handleRoomJoin(c *Client, event Event) error {
+	var joinData dto.JoinRoomDto
+	err := json.Unmarshal(event.Payload, &joinData)
+	if err != nil {
+		return newProtocolError(ErrCodeInvalidPayload, "invalid room.join payload: "+err.Error())
+	}
+
+	roomRepo := c.Handler.store.Rooms
+	var room *repository.RoomModel
+
+	switch joinData.Type {
+	case repository.PrivateChatRoom:
+		targetParticipant, err := primitive.ObjectIDFromHex(joinData.TargetParticipant)
+		if err != nil {
+			return newProtocolError(ErrCodeInvalidPayload, "invalid targetParticipant received")
+		}
+
+		room, err = roomRepo.JoinPrivateChatRoom(c.UserID, targetParticipant)
+		if err != nil {
+			return toProtocolError(err)
+		}
+	case repository.GroupChatRoom:
+		if joinData.Name == "" {
+			return newProtocolError(ErrCodeInvalidPayload, "room name is required for group chat")
+		}
+
+		room, err = roomRepo.JoinGroupChatRoom(c.UserID, joinData.Name)
+		if err != nil {
+			return toProtocolError(err)
+		}
+	default:
+		return newProtocolError(ErrCodeInvalidPayload, "invalid room type received: type must be either 'private' or 'group'")
+	}
+
+	c.sendEvent(EventAck, event.ID, dto.ToRoomDto(room))
+
+	return nil
+}
+
+func handleRead(c *Client, event Event) error {
+	var readData dto.ReadDto
+	err := json.Unmarshal(event.Payload, &readData)
+	if err != nil {
+		return newProtocolError(ErrCodeInvalidPayload, "invalid read payload: "+err.Error())
+	}
+
+	if !c.isInRoom(readData.RoomID) {
+		return newProtocolError(ErrCodeForbidden, "not a participant of room "+readData.RoomID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	messageID, err := primitive.ObjectIDFromHex(readData.MessageID)
+	if err != nil {
+		return newProtocolError(ErrCodeInvalidPayload, "invalid messageId: "+readData.MessageID)
+	}
+
+	message, err := c.Handler.store.Messages.FindMessage(ctx, messageID)
+	if err != nil || message.RoomID.Hex() != readData.RoomID {
+		return newProtocolError(ErrCodeInvalidPayload, "invalid messageId: "+readData.MessageID)
+	}
+
+	// The read.updated event is published by the read listener
+	receipt, err := c.Handler.store.ReadReceipts.MarkRead(ctx, c.UserID, message)
+	if err != nil {
+		return err
+	}
+
+	c.sendEvent(EventAck, event.ID, dto.ToReadReceiptDto(receipt))
+
+	return nil
+}
+
+// maxReplayMessages caps the missed messages replayed per room on sync.
+// Clients fetch anything beyond it through the REST API.
+const maxReplayMessages = 200
+
+func handleSync(c *Client, event Event) error {
+	var syncData dto.SyncDto
+	err := json.Unmarshal(event.Payload, &syncData)
+	if err != nil {
+		return newProtocolError(ErrCodeInvalidPayload, "invalid sync payload: "+err.Error())
+	}
+
+	results := make([]dto.RoomSyncResult, 0, len(syncData.Rooms))
+	for _, roomSync := range syncData.Rooms {
+		result, err := c.replayRoom(roomSync)
+		if err != nil {
+			return err
+		}
+
+		results = append(results, result)
+	}
+
+	c.sendEvent(EventAck, event.ID, echo.Map{"rooms": results})
+
+	return nil
+}
+
+// replayRoom sends the messages of a room the client missed since its last
+// position. Live messages of the room are held back by the hub during the
+// replay, and the replayed ones are skipped when the outbox relay publishes
+// them late, so the client receives every message once and in order.
+func (c *Client) replayRoom(roomSync dto.RoomSyncDto) (dto.RoomSyncResult, error) {
+	result := dto.RoomSyncResult{RoomID: roomSync.RoomID}
+
+	roomID, err := primitive.ObjectIDFromHex(roomSync.RoomID)
+	if err != nil {
+		return result, newProtocolError(ErrCodeInvalidPayload, "invalid roomId: "+roomSync.RoomID)
+	}
+
+	if !c.isInRoom(roomSync.RoomID) {
+		return result, newProtocolError(ErrCodeForbidden, "not a participant of room "+roomSync.RoomID)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	msgRepository := c.Handler.store.Messages
+
+	since := roomSync.Since
+	var lastMessageID primitive.ObjectID
+	if roomSync.LastMessageID != "" {
+		lastMessageID, err = primitive.ObjectIDFromHex(roomSync.LastMessageID)
+		if err != nil {
+			return result, newProtocolError(ErrCodeInvalidPayload, "unknown lastMessageId: "+roomSync.LastMessageID)
+		}
+
+		lastMessage, err := msgRepository.FindMessage(ctx, lastMessageID)
+		if err != nil || lastMessage.RoomID != roomID {
+			return result, newProtocolError(ErrCodeInvalidPayload, "unknown lastMessageId: "+roomSync.LastMessageID)
+		}
+
+		since = lastMessage.Timestamp
+	}
+
+	replayed := make(map[string]bool)
+
+	c.Handler.hub.BeginSync(c, roomSync.RoomID)
+	defer func() {
+		c.Handler.hub.EndSync(c, roomSync.RoomID, replayed)
+	}()
+
+	// Fetch one more message than replayed to know if the client
+	// has to fetch the rest through the REST API
+	messages, err := msgRepository.FindAfter(ctx, roomID, since, lastMessageID, maxReplayMessages+1)
+	if err != nil {
+		return result, err
+	}
+
+	if len(messages) > maxReplayMessages {
+		messages = messages[:maxReplayMessages]
+		result.HasMore = true
+	}
+
+	for _, message := range messages {
+		frame, err := encodeEvent(EventMessageNew, "", dto.ToMessageDto(message))
+		if err != nil {
+			return result, fmt.Errorf("failed to marshal message to json: %w", err)
+		}
+
+		if !c.enqueueWait(frame) {
+			return result, newProtocolError(ErrCodeInternal, "timed out replaying missed messages")
+		}
+
+		replayed[message.ID.Hex()] = true
+		result.Replayed++
+	}
+
+	return result, nil
+}
+
+// toProtocolError converts the HTTP errors returned by the repository into protocol errors
+func toProtocolError(err error) error {
+	var httpErr *echo.HTTPError
+	if !errors.As(err, &httpErr) {
+		return err
+	}
+
+	code := ErrCodeInternal
+	if httpErr.Code == http.StatusBadRequest {
+		code = ErrCodeInvalidPayload
+	}
+
+	return newProtocolError(code, fmt.Sprint(httpErr.Message))
+}
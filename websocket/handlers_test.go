@@ -0,0 +1,405 @@
+package websocket
+
+import (
+	"chat-server/broker"
+	"chat-server/dto"
+	"chat-server/repository"
+	"chat-server/repository/memory"
+	"chat-server/repository/storetest"
+	"context"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// staleMessages misses the next client message ID lookup, like a retry
+// racing with the request it repeats
+type staleMessages struct {
+	repository.MessageStore
+	miss atomic.Bool
+}
+
+func (m *staleMessages) FindByClientMessageID(ctx context.Context, senderId primitive.ObjectID, clientMessageId string) (*repository.MessageModel, error) {
+	if m.miss.CompareAndSwap(true, false) {
+		return nil, nil
+	}
+
+	return m.MessageStore.FindByClientMessageID(ctx, senderId, clientMessageId)
+}
+
+func (c *testClient) sendWithClientID(t *testing.T, roomID string, clientMessageID string) dto.MessageAck {
+	t.Helper()
+
+	c.send(t, EventMessageSend, clientMessageID, dto.MessageDto{RoomID: roomID, ClientMessageID: clientMessageID, Content: "hello"})
+	event := c.expect(t, EventAck)
+
+	var ack dto.MessageAck
+	err := json.Unmarshal(event.Payload, &ack)
+	if err != nil || event.ID != clientMessageID || ack.ClientMessageID != clientMessageID {
+		t.Fatalf("invalid ack %+v: %v", event, err)
+	}
+
+	return ack
+}
+
+// TestMessageRetry sends messages again with the same client message ID, every
+// retry is acknowledged with the stored message and nothing else is stored
+func TestMessageRetry(t *testing.T) {
+	store := memory.NewStore()
+	messages := &staleMessages{MessageStore: store.Messages}
+	store.Messages = messages
+	instance := newTestInstance(t, broker.NewMemory(), store, testConfig("retry-test"))
+
+	alice := storetest.CreateUser(t, store, "alice")
+	room := storetest.JoinGroup(t, store, alice, "general")
+	roomID := room.ID.Hex()
+
+	client := instance.dial(t, alice)
+
+	ack := client.sendWithClientID(t, roomID, "client-1")
+
+	retryAck := client.sendWithClientID(t, roomID, "client-1")
+	if retryAck.ID != ack.ID || !retryAck.Timestamp.Equal(ack.Timestamp) {
+		t.Errorf("retry acknowledged %+v; want %+v", retryAck, ack)
+	}
+
+	// The retry is only caught by the unique client message ID once stored
+	messages.miss.Store(true)
+	retryAck = client.sendWithClientID(t, roomID, "client-1")
+	if retryAck.ID != ack.ID || !retryAck.Timestamp.Equal(ack.Timestamp) {
+		t.Errorf("concurrent retry acknowledged %+v; want %+v", retryAck, ack)
+	}
+	if messages.miss.Load() {
+		t.Error("the retry did not look the message up")
+	}
+
+	count, err := store.Messages.CountMessages(context.Background(), room.ID)
+	if err != nil || count != 1 {
+		t.Errorf("CountMessages() = %d, %v; want 1", count, err)
+	}
+
+	if err := client.expectMessage(roomID, "hello"); err != nil {
+		t.Error(err)
+	}
+	if err := client.expectNoMessage(200 * time.Millisecond); err != nil {
+		t.Error(err)
+	}
+}
+
+// expectError waits for the next error event and checks the event it answers and its code
+func (c *testClient) expectError(t *testing.T, id string, code string) {
+	t.Helper()
+
+	event := c.expect(t, EventError)
+
+	var payload ErrorPayload
+	err := json.Unmarshal(event.Payload, &payload)
+	if err != nil || event.ID != id || payload.Code != code {
+		t.Fatalf("%s: error %+v for event '%s', %v; want %s for event '%s'", c.user.Username, payload, event.ID, err, code, id)
+	}
+}
+
+// expectNone checks that no event of the type is received for a while
+func (c *testClient) expectNone(t *testing.T, eventType string, wait time.Duration) {
+	t.Helper()
+
+	event, err := c.next(eventType, wait)
+	if err == nil {
+		t.Fatalf("%s: unexpected %s %s", c.user.Username, eventType, event.Payload)
+	}
+}
+
+// TestEnvelopeErrors sends invalid frames, each one is answered with an error
+// event and the connection stays usable
+func TestEnvelopeErrors(t *testing.T) {
+	store := memory.NewStore()
+	instance := newTestInstance(t, broker.NewMemory(), store, testConfig("envelope-test"))
+
+	alice := storetest.CreateUser(t, store, "alice")
+	room := storetest.JoinGroup(t, store, alice, "general")
+	client := instance.dial(t, alice)
+
+	tests := []struct {
+		name  string
+		frame string
+		id    string
+		code  string
+	}{
+		{"not json", `hello`, "", ErrCodeInvalidFrame},
+		{"no type", `{"id": "1"}`, "", ErrCodeInvalidFrame},
+		{"unsupported version", `{"version": 2, "type": "sync", "id": "2"}`, "2", ErrCodeUnsupportedVersion},
+		{"unknown type", `{"type": "message.delete", "id": "3"}`, "3", ErrCodeUnknownEvent},
+		{"malformed payload", `{"type": "message.send", "id": "4", "payload": [1]}`, "4", ErrCodeInvalidPayload},
+		{"invalid payload", `{"type": "presence.set", "id": "5", "payload": {"status": "busy"}}`, "5", ErrCodeInvalidPayload},
+		{"foreign room", `{"type": "message.send", "id": "6", "payload": {"roomId": "` + primitive.NewObjectID().Hex() + `", "content": "hi"}}`, "6", ErrCodeForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := client.conn.WriteMessage(websocket.TextMessage, []byte(test.frame))
+			if err != nil {
+				t.Fatalf("failed to send frame: %v", err)
+			}
+
+			client.expectError(t, test.id, test.code)
+		})
+	}
+
+	// Frames with the current version or none are accepted
+	client.sendMessage(t, room.ID.Hex(), "still connected")
+	err := client.conn.WriteMessage(websocket.TextMessage, []byte(`{"version": 1, "type": "typing.start", "id": "7", "payload": {"roomId": "`+room.ID.Hex()+`"}}`))
+	if err != nil {
+		t.Fatalf("failed to send frame: %v", err)
+	}
+	client.expectNone(t, EventError, 200*time.Millisecond)
+}
+
+// TestSync replays the messages missed since the last one a client has seen,
+// and skips them when the outbox relay publishes them late
+func TestSync(t *testing.T) {
+	store := memory.NewStore()
+	instance := newTestInstance(t, broker.NewMemory(), store, testConfig("sync-test"))
+
+	alice := storetest.CreateUser(t, store, "alice")
+	bob := storetest.CreateUser(t, store, "bob")
+	room := storetest.JoinGroup(t, store, alice, "general")
+	storetest.JoinGroup(t, store, bob, "general")
+	other := storetest.JoinGroup(t, store, bob, "other")
+	roomID := room.ID.Hex()
+
+	// Stored while alice was away, the storetest topic is never relayed to the room
+	var missed []*repository.MessageModel
+	for _, content := range []string{"seen", "missed 1", "missed 2"} {
+		missed = append(missed, storetest.SendMessage(t, store, bob, room, content, ""))
+	}
+
+	client := instance.dial(t, alice)
+
+	client.send(t, EventSync, "sync-1", dto.SyncDto{Rooms: []dto.RoomSyncDto{{RoomID: roomID, LastMessageID: missed[0].ID.Hex()}}})
+	for _, content := range []string{"missed 1", "missed 2"} {
+		if err := client.expectMessage(roomID, content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	event := client.expect(t, EventAck)
+	var ack struct {
+		Rooms []dto.RoomSyncResult `json:"rooms"`
+	}
+	err := json.Unmarshal(event.Payload, &ack)
+	want := dto.RoomSyncResult{RoomID: roomID, Replayed: 2}
+	if err != nil || event.ID != "sync-1" || len(ack.Rooms) != 1 || ack.Rooms[0] != want {
+		t.Fatalf("sync acknowledged %s, %v; want %+v", event.Payload, err, want)
+	}
+
+	// The relay publishes a replayed message after the sync
+	frame, err := encodeEvent(EventMessageNew, "", dto.ToMessageDto(missed[2]))
+	if err != nil {
+		t.Fatalf("failed to encode message: %v", err)
+	}
+	err = instance.broker.Publish(context.Background(), roomID, frame)
+	if err != nil {
+		t.Fatalf("Publish() failed: %v", err)
+	}
+	if err := client.expectNoMessage(200 * time.Millisecond); err != nil {
+		t.Error(err)
+	}
+
+	client.sendMessage(t, roomID, "live")
+	if err := client.expectMessage(roomID, "live"); err != nil {
+		t.Error(err)
+	}
+
+	client.send(t, EventSync, "sync-2", dto.SyncDto{Rooms: []dto.RoomSyncDto{{RoomID: other.ID.Hex()}}})
+	client.expectError(t, "sync-2", ErrCodeForbidden)
+
+	client.send(t, EventSync, "sync-3", dto.SyncDto{Rooms: []dto.RoomSyncDto{{RoomID: roomID, LastMessageID: primitive.NewObjectID().Hex()}}})
+	client.expectError(t, "sync-3", ErrCodeInvalidPayload)
+}
+
+// TestTyping relays typing indicators to the other participants of a room only,
+// and stops them on typing.stop, on expiry and on disconnect
+func TestTyping(t *testing.T) {
+	store := memory.NewStore()
+	config := testConfig("typing-test")
+	config.TypingTimeout = 300 * time.Millisecond
+	instance := newTestInstance(t, broker.NewMemory(), store, config)
+
+	alice := storetest.CreateUser(t, store, "alice")
+	bob := storetest.CreateUser(t, store, "bob")
+	room := storetest.JoinGroup(t, store, alice, "general")
+	storetest.JoinGroup(t, store, bob, "general")
+	other := storetest.JoinGroup(t, store, bob, "other")
+	roomID := room.ID.Hex()
+
+	aliceClient := instance.dial(t, alice)
+	bobClient := instance.dial(t, bob)
+
+	expectTyping := func(eventType string) {
+		t.Helper()
+
+		event := bobClient.expect(t, eventType)
+
+		var typing dto.Typing
+		err := json.Unmarshal(event.Payload, &typing)
+		want := dto.Typing{RoomID: roomID, UserID: alice.ID.Hex(), Username: alice.Username}
+		if err != nil || typing != want {
+			t.Fatalf("received %s %s, %v; want %+v", eventType, event.Payload, err, want)
+		}
+	}
+
+	// Repeating typing.start only extends the indicator
+	aliceClient.send(t, EventTypingStart, "", dto.TypingDto{RoomID: roomID})
+	aliceClient.send(t, EventTypingStart, "", dto.TypingDto{RoomID: roomID})
+	expectTyping(EventTypingStart)
+	bobClient.expectNone(t, EventTypingStart, 100*time.Millisecond)
+	aliceClient.expectNone(t, EventTypingStart, 0)
+
+	aliceClient.send(t, EventTypingStop, "", dto.TypingDto{RoomID: roomID})
+	expectTyping(EventTypingStop)
+
+	// Stopping again sends nothing
+	aliceClient.send(t, EventTypingStop, "", dto.TypingDto{RoomID: roomID})
+	bobClient.expectNone(t, EventTypingStop, 100*time.Millisecond)
+
+	// Without typing.stop, the indicator expires
+	aliceClient.send(t, EventTypingStart, "", dto.TypingDto{RoomID: roomID})
+	expectTyping(EventTypingStart)
+	started := time.Now()
+	expectTyping(EventTypingStop)
+	if elapsed := time.Since(started); elapsed < config.TypingTimeout/2 {
+		t.Errorf("typing stopped after %v; want about %v", elapsed, config.TypingTimeout)
+	}
+
+	// Disconnecting stops typing
+	aliceClient.send(t, EventTypingStart, "", dto.TypingDto{RoomID: roomID})
+	expectTyping(EventTypingStart)
+	_ = aliceClient.conn.Close()
+	expectTyping(EventTypingStop)
+
+	bobClient.send(t, EventTypingStart, "typing-1", dto.TypingDto{RoomID: primitive.NewObjectID().Hex()})
+	bobClient.expectError(t, "typing-1", ErrCodeForbidden)
+
+	// Bob's indicator in the other room does not reach him back
+	bobClient.send(t, EventTypingStart, "", dto.TypingDto{RoomID: other.ID.Hex()})
+	bobClient.expectNone(t, EventTypingStart, 200*time.Millisecond)
+}
+
+// TestRead marks a message as read, the reader is acknowledged with the
+// receipt and the other participants receive read.updated
+func TestRead(t *testing.T) {
+	store := memory.NewStore()
+	instance := newTestInstance(t, broker.NewMemory(), store, testConfig("read-test"))
+
+	alice := storetest.CreateUser(t, store, "alice")
+	bob := storetest.CreateUser(t, store, "bob")
+	room := storetest.JoinGroup(t, store, alice, "general")
+	storetest.JoinGroup(t, store, bob, "general")
+	other := storetest.JoinGroup(t, store, bob, "other")
+	roomID := room.ID.Hex()
+
+	aliceClient := instance.dial(t, alice)
+	bobClient := instance.dial(t, bob)
+
+	sent := bobClient.sendMessage(t, roomID, "hello")
+	elsewhere := storetest.SendMessage(t, store, bob, other, "elsewhere", "")
+
+	aliceClient.send(t, EventRead, "read-1", dto.ReadDto{RoomID: roomID, MessageID: sent.ID})
+	event := aliceClient.expect(t, EventAck)
+
+	var receipt dto.ReadReceipt
+	err := json.Unmarshal(event.Payload, &receipt)
+	if err != nil || event.ID != "read-1" || receipt.RoomID != roomID || receipt.UserID != alice.ID.Hex() || receipt.LastReadMessageID != sent.ID {
+		t.Fatalf("read acknowledged %s, %v; want alice's receipt of the message", event.Payload, err)
+	}
+
+	for _, client := range []*testClient{aliceClient, bobClient} {
+		event := client.expect(t, EventReadUpdated)
+
+		var updated dto.ReadReceipt
+		err := json.Unmarshal(event.Payload, &updated)
+		if err != nil || updated.UserID != alice.ID.Hex() || updated.LastReadMessageID != sent.ID {
+			t.Errorf("%s: received read.updated %s, %v; want alice's receipt", client.user.Username, event.Payload, err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		read dto.ReadDto
+		code string
+	}{
+		{"invalid message ID", dto.ReadDto{RoomID: roomID, MessageID: "latest"}, ErrCodeInvalidPayload},
+		{"unknown message", dto.ReadDto{RoomID: roomID, MessageID: primitive.NewObjectID().Hex()}, ErrCodeInvalidPayload},
+		{"message of another room", dto.ReadDto{RoomID: roomID, MessageID: elsewhere.ID.Hex()}, ErrCodeInvalidPayload},
+		{"foreign room", dto.ReadDto{RoomID: other.ID.Hex(), MessageID: elsewhere.ID.Hex()}, ErrCodeForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			aliceClient.send(t, EventRead, test.name, test.read)
+			aliceClient.expectError(t, test.name, test.code)
+		})
+	}
+}
+
+// TestHeartbeat keeps a client answering pings connected past the pong wait,
+// and drops a client that stopped answering
+func TestHeartbeat(t *testing.T) {
+	store := memory.NewStore()
+	config := testConfig("heartbeat-test")
+	config.PingInterval = 100 * time.Millisecond
+	config.PongWait = 300 * time.Millisecond
+	instance := newTestInstance(t, broker.NewMemory(), store, config)
+
+	alice := storetest.CreateUser(t, store, "alice")
+	bob := storetest.CreateUser(t, store, "bob")
+	room := storetest.JoinGroup(t, store, alice, "general")
+
+	// The client answers the pings while reading
+	aliceClient := instance.dial(t, alice)
+
+	// This one never answers
+	conn := instance.connect(t, bob)
+	pings := make(chan struct{}, 16)
+	conn.SetPingHandler(func(string) error {
+		pings <- struct{}{}
+		return nil
+	})
+
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			_, _, err := conn.ReadMessage()
+			if err != nil {
+				closed <- err
+				return
+			}
+		}
+	}()
+
+	select {
+	case <-pings:
+	case <-time.After(testTimeout):
+		t.Fatal("no ping received")
+	}
+
+	started := time.Now()
+	select {
+	case <-closed:
+		if elapsed := time.Since(started); elapsed > config.PongWait+time.Second {
+			t.Errorf("silent client dropped after %v; want about %v", elapsed, config.PongWait)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("silent client still connected")
+	}
+	eventually(t, hasPresence(store, bob, repository.PresenceOffline), "bob offline")
+
+	time.Sleep(2 * config.PongWait)
+	aliceClient.sendMessage(t, room.ID.Hex(), "still connected")
+	if presence, err := store.Presence.FindPresence(context.Background(), alice.ID); err != nil || presence.Status != repository.PresenceOnline {
+		t.Errorf("FindPresence() of alice = %+v, %v; want online", presence, err)
+	}
+}
@@ -0,0 +1,325 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"time"
+)
+
+// replayWindow is how long after a sync the replayed messages are skipped when
+// they arrive live, e.g. when the outbox relay publishes a replayed message late
+const replayWindow = time.Minute
+
+// replayedMessages are the IDs of the messages replayed to a client in a room
+type replayedMessages struct {
+	ids   map[string]bool
+	until time.Time
+}
+
+// Hub owns the connected clients and their room subscriptions.
+// All state is only ever touched by the goroutine running Run,
+// every other goroutine talks to the hub through its channels.
+type Hub struct {
+	clients map[string]map[string]*Client // Client connections (user ID -> connection ID -> client)
+	rooms   map[string]map[string]*Client // Room subscriptions (room ID -> connection ID -> client)
+
+	register   chan registration
+	unregister chan *Client
+	join       chan membership
+	broadcast  chan broadcast
+	roomCheck  chan roomCheck
+	syncStart  chan roomSync
+	syncEnd    chan roomSync
+
+	// Users going online or offline on this instance, consumed by the presence tracker.
+	// Changes are coalesced rather than queued, so that the hub never waits for the
+	// storage or the broker.
+	presenceChanges *changeSet[primitive.ObjectID, presenceChange]
+	// Rooms gaining their first or losing their last subscriber on this instance,
+	// consumed by the room binder
+	roomChanges *changeSet[string, roomChange]
+}
+
+type registration struct {
+	client  *Client
+	roomIDs []string
+	version chan uint64 // Receives the version of the room changes made by the registration
+}
+
+type membership struct {
+	userID string
+	roomID string
+}
+
+type broadcast struct {
+	roomIDs       []string
+	excludeUserID string // Connections of this user are skipped
+	frame         []byte
+}
+
+type roomChange struct {
+	roomID     string
+	subscribed bool // Whether the room gained its first or lost its last subscriber
+}
+
+type presenceChange struct {
+	userID    primitive.ObjectID
+	connected bool // Whether the user opened their first or closed their last connection
+}
+
+type roomSync struct {
+	client   *Client
+	roomID   string
+	replayed map[string]bool // IDs of the messages already replayed to the client
+}
+
+type roomCheck struct {
+	client *Client
+	roomID string
+	result chan bool
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		clients:    make(map[string]map[string]*Client),
+		rooms:      make(map[string]map[string]*Client),
+		register:   make(chan registration),
+		unregister: make(chan *Client),
+		join:       make(chan membership),
+		broadcast:  make(chan broadcast),
+		roomCheck:  make(chan roomCheck),
+		syncStart:  make(chan roomSync),
+		syncEnd:    make(chan roomSync),
+
+		presenceChanges: newChangeSet[primitive.ObjectID, presenceChange](),
+		roomChanges:     newChangeSet[string, roomChange](),
+	}
+}
+
+// Run processes the hub operations until the process exits
+func (h *Hub) Run() {
+	for {
+		select {
+		case r := <-h.register:
+			connections, ok := h.clients[r.client.UserID.Hex()]
+			if !ok {
+				connections = make(map[string]*Client)
+				h.clients[r.client.UserID.Hex()] = connections
+
+				h.presenceChanges.add(r.client.UserID, presenceChange{userID: r.client.UserID, connected: true})
+			}
+			connections[r.client.ID] = r.client
+
+			for _, roomID := range r.roomIDs {
+				h.joinRoom(roomID, r.client)
+			}
+			r.version <- h.roomChanges.version()
+		case client := <-h.unregister:
+			// Other connections of the same user are left untouched
+			connections := h.clients[client.UserID.Hex()]
+			if _, ok := connections[client.ID]; !ok {
+				continue
+			}
+
+			delete(connections, client.ID)
+			if len(connections) == 0 {
+				delete(h.clients, client.UserID.Hex())
+
+				h.presenceChanges.add(client.UserID, presenceChange{userID: client.UserID, connected: false})
+			}
+
+			for roomID := range client.Rooms {
+				h.leaveRoom(roomID, client) // Leave each room the client is in
+			}
+			client.syncing = make(map[string][][]byte)
+
+			// Nothing is sent to the client after this point,
+			// closing the queue stops its write loop
+			close(client.Send)
+		case m := <-h.join:
+			// Every device of the user joins the room
+			for _, client := range h.clients[m.userID] {
+				h.joinRoom(m.roomID, client)
+			}
+		case b := <-h.broadcast:
+			// A client sharing several of the rooms receives the frame once
+			delivered := make(map[string]bool)
+
+			for _, roomID := range b.roomIDs {
+				for _, client := range h.rooms[roomID] {
+					if delivered[client.ID] || (b.excludeUserID != "" && client.UserID.Hex() == b.excludeUserID) {
+						continue
+					}
+					delivered[client.ID] = true
+
+					// Live messages wait until the missed ones have been replayed
+					if pending, ok := client.syncing[roomID]; ok {
+						client.syncing[roomID] = append(pending, b.frame)
+						continue
+					}
+
+					if client.wasReplayed(roomID, b.frame) {
+						continue
+					}
+
+					client.enqueue(b.frame)
+				}
+			}
+		case check := <-h.roomCheck:
+			check.result <- check.client.Rooms[check.roomID]
+		case rs := <-h.syncStart:
+			if _, ok := rs.client.syncing[rs.roomID]; !ok {
+				rs.client.syncing[rs.roomID] = [][]byte{}
+			}
+		case rs := <-h.syncEnd:
+			pending, ok := rs.client.syncing[rs.roomID]
+			if !ok {
+				continue
+			}
+			delete(rs.client.syncing, rs.roomID)
+
+			// Messages that arrived live during the replay are only
+			// delivered when the replay did not include them already
+			for _, frame := range pending {
+				if !rs.replayed[messageID(frame)] {
+					rs.client.enqueue(frame)
+				}
+			}
+
+			// The replayed messages may still be published afterwards
+			if len(rs.replayed) > 0 {
+				rs.client.replayed[rs.roomID] = replayedMessages{ids: rs.replayed, until: time.Now().Add(replayWindow)}
+			}
+		}
+	}
+}
+
+// Register adds a client connection and subscribes it to the given rooms. It returns
+// the version of the room changes to pass to WaitRoomChanges.
+func (h *Hub) Register(client *Client, roomIDs []string) uint64 {
+	version := make(chan uint64, 1)
+	h.register <- registration{client: client, roomIDs: roomIDs, version: version}
+
+	return <-version
+}
+
+// WaitRoomChanges waits until the instance subscribed to the topics of the rooms
+// gaining their first subscriber up to the version
+func (h *Hub) WaitRoomChanges(ctx context.Context, version uint64) error {
+	return h.roomChanges.waitApplied(ctx, version)
+}
+
+// Unregister removes a client connection and all of its room subscriptions
+func (h *Hub) Unregister(client *Client) {
+	h.unregister <- client
+}
+
+// Join subscribes every connection of a user to a room
+func (h *Hub) Join(userID, roomID string) {
+	h.join <- membership{userID: userID, roomID: roomID}
+}
+
+// Broadcast queues a frame for every connection subscribed to a room
+func (h *Hub) Broadcast(roomID string, frame []byte) {
+	h.broadcast <- broadcast{roomIDs: []string{roomID}, frame: frame}
+}
+
+// BroadcastExcept queues a frame for every connection subscribed to a room,
+// except the connections of the given user
+func (h *Hub) BroadcastExcept(roomID, userID string, frame []byte) {
+	h.broadcast <- broadcast{roomIDs: []string{roomID}, excludeUserID: userID, frame: frame}
+}
+
+// BroadcastRooms queues a frame once for every connection subscribed to any of the rooms,
+// except the connections of the given user
+func (h *Hub) BroadcastRooms(roomIDs []string, userID string, frame []byte) {
+	h.broadcast <- broadcast{roomIDs: roomIDs, excludeUserID: userID, frame: frame}
+}
+
+// IsInRoom reports whether a client connection is subscribed to a room
+func (h *Hub) IsInRoom(client *Client, roomID string) bool {
+	result := make(chan bool, 1)
+	h.roomCheck <- roomCheck{client: client, roomID: roomID, result: result}
+
+	return <-result
+}
+
+// BeginSync holds back the live messages of a room for a client until EndSync is called.
+// Once BeginSync returns, every message broadcast to the room is held back.
+func (h *Hub) BeginSync(client *Client, roomID string) {
+	h.syncStart <- roomSync{client: client, roomID: roomID}
+}
+
+// EndSync delivers the live messages held back since BeginSync, skipping the replayed ones
+func (h *Hub) EndSync(client *Client, roomID string, replayed map[string]bool) {
+	h.syncEnd <- roomSync{client: client, roomID: roomID, replayed: replayed}
+}
+
+func (h *Hub) joinRoom(roomID string, client *Client) {
+	subscribers, ok := h.rooms[roomID]
+	if !ok {
+		subscribers = make(map[string]*Client)
+		h.rooms[roomID] = subscribers
+
+		h.roomChanges.add(roomID, roomChange{roomID: roomID, subscribed: true})
+	}
+
+	subscribers[client.ID] = client
+	client.Rooms[roomID] = true
+}
+
+func (h *Hub) leaveRoom(roomID string, client *Client) {
+	// Check if the client is in the specified room
+	_, isInRoom := client.Rooms[roomID]
+	if !isInRoom {
+		// Client is not in the specified room, nothing to do
+		return
+	}
+
+	// Remove the room from the client's rooms
+	delete(client.Rooms, roomID)
+
+	// Remove the client from the room subscribers
+	subscribers := h.rooms[roomID]
+	delete(subscribers, client.ID)
+	if len(subscribers) == 0 {
+		delete(h.rooms, roomID)
+
+		h.roomChanges.add(roomID, roomChange{roomID: roomID, subscribed: false})
+	}
+}
+
+// wasReplayed reports whether the frame carries a message recently replayed to the client in the room
+func (c *Client) wasReplayed(roomID string, frame []byte) bool {
+	replayed, ok := c.replayed[roomID]
+	if !ok {
+		return false
+	}
+
+	if time.Now().After(replayed.until) {
+		delete(c.replayed, roomID)
+		return false
+	}
+
+	return replayed.ids[messageID(frame)]
+}
+
+// messageID extracts the ID of the message carried by a message.new frame
+func messageID(frame []byte) string {
+	var event Event
+	err := json.Unmarshal(frame, &event)
+	if err != nil || event.Type != EventMessageNew {
+		return ""
+	}
+
+	var message struct {
+		ID string `json:"id"`
+	}
+	err = json.Unmarshal(event.Payload, &message)
+	if err != nil {
+		return ""
+	}
+
+	return message.ID
+}
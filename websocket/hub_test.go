@@ -0,0 +1,670 @@
+package websocket
+
+import (
+	"chat-server/auth"
+	"chat-server/broker"
+	"chat-server/dto"
+	"chat-server/repository"
+	"chat-server/repository/memory"
+	"chat-server/repository/storetest"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gorilla/websocket"
+	echojwt "github.com/labstack/echo-jwt/v4"
+	"github.com/labstack/echo/v4"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testTimeout = 5 * time.Second
+
+func testConfig(instanceID string) Config {
+	return Config{
+		PingInterval:       time.Minute,
+		PongWait:           2 * time.Minute,
+		WriteWait:          testTimeout,
+		SendBufferSize:     256,
+		SlowConsumerPolicy: DropNewest,
+		TypingTimeout:      10 * time.Second,
+		InstanceID:         instanceID,
+		InstanceTTL:        time.Minute,
+		OutboxMaxAttempts:  10,
+		OutboxRetryDelay:   10 * time.Millisecond,
+	}
+}
+
+// recordingBroker records the topics the instance is subscribed to
+type recordingBroker struct {
+	broker.Broker
+	mu     sync.Mutex
+	topics map[string]bool
+}
+
+func newRecordingBroker(messageBroker broker.Broker) *recordingBroker {
+	return &recordingBroker{Broker: messageBroker, topics: make(map[string]bool)}
+}
+
+func (b *recordingBroker) Subscribe(topic string) error {
+	err := b.Broker.Subscribe(topic)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.topics[topic] = err == nil
+
+	return err
+}
+
+func (b *recordingBroker) Unsubscribe(topic string) error {
+	err := b.Broker.Unsubscribe(topic)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		delete(b.topics, topic)
+	}
+
+	return err
+}
+
+func (b *recordingBroker) subscribed(topic string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.topics[topic]
+}
+
+// testInstance is a server instance serving websocket connections over HTTP
+type testInstance struct {
+	handler *SocketHandler
+	broker  *recordingBroker
+	store   *repository.Store
+	server  *httptest.Server
+}
+
+func newTestInstance(t *testing.T, messageBroker broker.Broker, store *repository.Store, config Config) *testInstance {
+	t.Helper()
+	t.Setenv("JWT_SECRET", "test")
+
+	recorder := newRecordingBroker(messageBroker)
+	handler := New(recorder, store, config)
+	go handler.ConsumeMessages()
+
+	e := echo.New()
+	e.GET("/chat", handler.HandleConnection, echojwt.WithConfig(auth.JwtCustomConfig()))
+
+	server := httptest.NewServer(e)
+	t.Cleanup(server.Close)
+
+	return &testInstance{handler: handler, broker: recorder, store: store, server: server}
+}
+
+// expectSubscribed checks that the instance is subscribed to the room, which
+// its clients are as soon as they are connected
+func (i *testInstance) expectSubscribed(t *testing.T, roomID string) {
+	t.Helper()
+
+	if !i.broker.subscribed(roomID) {
+		t.Fatalf("instance %s not subscribed to room %s once connected", i.handler.config.InstanceID, roomID)
+	}
+}
+
+// testClient is a device of a user connected to an instance
+type testClient struct {
+	user    *repository.UserModel
+	conn    *websocket.Conn
+	events  chan Event // Every event received, closed with the connection
+	skipped []Event    // Events received while waiting for another type
+}
+
+// connect opens a websocket connection of the user, without reading from it
+func (i *testInstance) connect(t *testing.T, user *repository.UserModel) *websocket.Conn {
+	t.Helper()
+
+	token, err := auth.GenToken(user)
+	if err != nil {
+		t.Fatalf("failed to generate token: %v", err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(i.server.URL, "http")+"/chat?auth="+token, nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
+
+func (i *testInstance) dial(t *testing.T, user *repository.UserModel) *testClient {
+	t.Helper()
+
+	conn := i.connect(t, user)
+	client := &testClient{user: user, conn: conn, events: make(chan Event, 1024)}
+	go func() {
+		defer close(client.events)
+
+		for {
+			_, frame, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			var event Event
+			err = json.Unmarshal(frame, &event)
+			if err != nil {
+				return
+			}
+
+			client.events <- event
+		}
+	}()
+
+	return client
+}
+
+func (c *testClient) send(t *testing.T, eventType string, id string, payload any) {
+	t.Helper()
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("failed to marshal payload: %v", err)
+	}
+
+	err = c.conn.WriteJSON(Event{Type: eventType, ID: id, Payload: body})
+	if err != nil {
+		t.Fatalf("failed to send %s: %v", eventType, err)
+	}
+}
+
+// next returns the next event of the type. The events of other types
+// received meanwhile are kept for later calls.
+func (c *testClient) next(eventType string, timeout time.Duration) (Event, error) {
+	for i, event := range c.skipped {
+		if event.Type == eventType {
+			c.skipped = append(c.skipped[:i], c.skipped[i+1:]...)
+			return event, nil
+		}
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case event, ok := <-c.events:
+			if !ok {
+				return Event{}, fmt.Errorf("%s: connection closed while waiting for %s", c.user.Username, eventType)
+			}
+			if event.Type == eventType {
+				return event, nil
+			}
+
+			c.skipped = append(c.skipped, event)
+		case <-timer.C:
+			return Event{}, fmt.Errorf("%s: no %s received within %v", c.user.Username, eventType, timeout)
+		}
+	}
+}
+
+func (c *testClient) expect(t *testing.T, eventType string) Event {
+	t.Helper()
+
+	event, err := c.next(eventType, testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return event
+}
+
+// expectMessage waits for the next message.new and checks its room and content
+func (c *testClient) expectMessage(roomID string, content string) error {
+	event, err := c.next(EventMessageNew, testTimeout)
+	if err != nil {
+		return err
+	}
+
+	var message dto.Message
+	err = json.Unmarshal(event.Payload, &message)
+	if err != nil {
+		return fmt.Errorf("%s: invalid message: %v", c.user.Username, err)
+	}
+
+	if message.RoomID != roomID || message.Content != content {
+		return fmt.Errorf("%s: received '%s' in room %s; want '%s' in room %s", c.user.Username, message.Content, message.RoomID, content, roomID)
+	}
+
+	return nil
+}
+
+// expectNoMessage checks that no message.new is received for a while
+func (c *testClient) expectNoMessage(wait time.Duration) error {
+	event, err := c.next(EventMessageNew, wait)
+	if err == nil {
+		return fmt.Errorf("%s: unexpected message %s", c.user.Username, event.Payload)
+	}
+
+	return nil
+}
+
+// expectPresence waits for the presence.changed of the user, skipping the
+// presence changes of other users, and checks their status
+func (c *testClient) expectPresence(t *testing.T, user *repository.UserModel, status string) {
+	t.Helper()
+
+	for {
+		event := c.expect(t, EventPresenceChanged)
+
+		var presence dto.Presence
+		err := json.Unmarshal(event.Payload, &presence)
+		if err != nil {
+			t.Fatalf("invalid presence: %v", err)
+		}
+
+		if presence.UserID == user.ID.Hex() {
+			if presence.Status != status {
+				t.Errorf("%s is %s; want %s", user.Username, presence.Status, status)
+			}
+			return
+		}
+	}
+}
+
+func (c *testClient) sendMessage(t *testing.T, roomID string, content string) dto.MessageAck {
+	t.Helper()
+
+	c.send(t, EventMessageSend, content, dto.MessageDto{RoomID: roomID, Content: content})
+	event := c.expect(t, EventAck)
+
+	var ack dto.MessageAck
+	err := json.Unmarshal(event.Payload, &ack)
+	if err != nil || event.ID != content {
+		t.Fatalf("invalid ack %+v: %v", event, err)
+	}
+
+	return ack
+}
+
+// eventually polls the condition until it holds, failing the test after the timeout
+func eventually(t *testing.T, condition func() bool, format string, args ...any) {
+	t.Helper()
+
+	deadline := time.Now().Add(testTimeout)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting: "+format, args...)
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitAll runs check for every client concurrently and reports the errors
+func waitAll(t *testing.T, clients []*testClient, check func(client *testClient) error) {
+	t.Helper()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(clients))
+	for _, client := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := check(client)
+			if err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func hasPresence(store *repository.Store, user *repository.UserModel, status string) func() bool {
+	return func() bool {
+		presence, err := store.Presence.FindPresence(context.Background(), user.ID)
+		return err == nil && presence.Status == status
+	}
+}
+
+const (
+	hubUsers          = 50
+	hubDevicesPerUser = 4
+	hubRooms          = 4
+)
+
+// TestHub connects several devices of many users to rooms, and checks that messages
+// only reach the devices in their room, that closed devices are unregistered, and
+// that users go offline with their last device
+func TestHub(t *testing.T) {
+	store := memory.NewStore()
+	instance := newTestInstance(t, broker.NewMemory(), store, testConfig("hub-test"))
+
+	// User i is in room i % hubRooms
+	var users []*repository.UserModel
+	var rooms []*repository.RoomModel
+	for i := 0; i < hubUsers; i++ {
+		user := storetest.CreateUser(t, store, fmt.Sprintf("user%d", i))
+		room := storetest.JoinGroup(t, store, user, fmt.Sprintf("room%d", i%hubRooms))
+		users = append(users, user)
+		if i < hubRooms {
+			rooms = append(rooms, room)
+		}
+	}
+
+	devices := make(map[string][]*testClient) // By user ID
+	roomClients := make([][]*testClient, hubRooms)
+	var clients []*testClient
+	for i, user := range users {
+		for d := 0; d < hubDevicesPerUser; d++ {
+			client := instance.dial(t, user)
+			devices[user.ID.Hex()] = append(devices[user.ID.Hex()], client)
+			roomClients[i%hubRooms] = append(roomClients[i%hubRooms], client)
+			clients = append(clients, client)
+		}
+	}
+
+	for _, room := range rooms {
+		instance.expectSubscribed(t, room.ID.Hex())
+	}
+	for _, user := range users {
+		eventually(t, hasPresence(store, user, repository.PresenceOnline), "%s online", user.Username)
+	}
+
+	// Every device in a room receives the room's message once, and no other message
+	for r, room := range rooms {
+		devices[users[r].ID.Hex()][0].sendMessage(t, room.ID.Hex(), "hello "+room.Name)
+	}
+	for r, room := range rooms {
+		waitAll(t, roomClients[r], func(client *testClient) error {
+			return client.expectMessage(room.ID.Hex(), "hello "+room.Name)
+		})
+	}
+	waitAll(t, clients, func(client *testClient) error {
+		return client.expectNoMessage(200 * time.Millisecond)
+	})
+
+	// Close every device of the even users, and one device of the odd ones
+	var remaining [hubRooms][]*testClient
+	for i, user := range users {
+		for d, client := range devices[user.ID.Hex()] {
+			if i%2 == 0 || d == 0 {
+				_ = client.conn.Close()
+			} else {
+				remaining[i%hubRooms] = append(remaining[i%hubRooms], client)
+			}
+		}
+	}
+
+	for i, user := range users {
+		if i%2 == 0 {
+			eventually(t, hasPresence(store, user, repository.PresenceOffline), "%s offline", user.Username)
+		}
+	}
+	for i, user := range users {
+		if i%2 == 1 {
+			presence, err := store.Presence.FindPresence(context.Background(), user.ID)
+			if err != nil || presence.Status != repository.PresenceOnline {
+				t.Errorf("presence of %s with devices left = %+v, %v; want online", user.Username, presence, err)
+			}
+		}
+	}
+
+	// Only even users were in the even rooms, the instance leaves them
+	for r, room := range rooms {
+		if r%2 == 0 {
+			eventually(t, func() bool { return !instance.broker.subscribed(room.ID.Hex()) }, "unsubscription from room %s", room.Name)
+		} else if !instance.broker.subscribed(room.ID.Hex()) {
+			t.Errorf("unsubscribed from room %s with devices left", room.Name)
+		}
+	}
+
+	for r := 1; r < hubRooms; r += 2 {
+		room := rooms[r]
+		remaining[r][0].sendMessage(t, room.ID.Hex(), "still there "+room.Name)
+		waitAll(t, remaining[r], func(client *testClient) error {
+			return client.expectMessage(room.ID.Hex(), "still there "+room.Name)
+		})
+	}
+}
+
+// TestHubChanges registers and unregisters more clients than the hub used to buffer
+// changes for, without anyone taking the changes. The hub carries on, and only the
+// latest change of each user and room is left.
+func TestHubChanges(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	const clientCount = 2000
+	clients := make([]*Client, clientCount)
+	for i := range clients {
+		clients[i] = &Client{
+			ID:      fmt.Sprintf("client%d", i),
+			UserID:  primitive.NewObjectID(),
+			Send:    make(chan []byte, 1),
+			Rooms:   make(map[string]bool),
+			syncing: make(map[string][][]byte),
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i, client := range clients {
+			hub.Register(client, []string{fmt.Sprintf("room%d", i)})
+		}
+		for _, client := range clients {
+			hub.Unregister(client)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatal("the hub is blocked by the changes nobody took")
+	}
+
+	// Returns once the hub processed the last unregistration
+	if hub.IsInRoom(clients[0], "room0") {
+		t.Fatal("unregistered client still in its room")
+	}
+
+	presenceChanges := hub.presenceChanges.take()
+	if len(presenceChanges) != clientCount {
+		t.Fatalf("%d presence changes; want %d", len(presenceChanges), clientCount)
+	}
+	for i, change := range presenceChanges {
+		if change.userID != clients[i].UserID || change.connected {
+			t.Fatalf("presence change %+v; want %s disconnected", change, clients[i].UserID.Hex())
+		}
+	}
+
+	roomChanges := hub.roomChanges.take()
+	if len(roomChanges) != clientCount {
+		t.Fatalf("%d room changes; want %d", len(roomChanges), clientCount)
+	}
+	for i, change := range roomChanges {
+		if change.roomID != fmt.Sprintf("room%d", i) || change.subscribed {
+			t.Fatalf("room change %+v; want room%d unsubscribed", change, i)
+		}
+	}
+}
+
+// TestRoomChangesApplied waits for the room changes of a registration, which only
+// completes once the consumer applied a batch taken after the registration
+func TestRoomChangesApplied(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+
+	first := &Client{ID: "first", Rooms: make(map[string]bool), syncing: make(map[string][][]byte)}
+	second := &Client{ID: "second", Rooms: make(map[string]bool), syncing: make(map[string][][]byte)}
+
+	version := hub.Register(first, []string{"room1"})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := hub.WaitRoomChanges(ctx, version)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("WaitRoomChanges() before the changes were taken = %v; want the deadline", err)
+	}
+
+	changes := hub.roomChanges.take()
+	if len(changes) != 1 || changes[0].roomID != "room1" || !changes[0].subscribed {
+		t.Fatalf("room changes %+v; want room1 subscribed", changes)
+	}
+
+	// Taken but not applied yet when the second client registers
+	laterVersion := hub.Register(second, []string{"room2"})
+	hub.roomChanges.markApplied()
+
+	err = hub.WaitRoomChanges(context.Background(), version)
+	if err != nil {
+		t.Errorf("WaitRoomChanges() once applied = %v; want nil", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = hub.WaitRoomChanges(ctx, laterVersion)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("WaitRoomChanges() of a later registration = %v; want the deadline", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- hub.WaitRoomChanges(context.Background(), laterVersion) }()
+
+	hub.roomChanges.take()
+	hub.roomChanges.markApplied()
+
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("WaitRoomChanges() once applied = %v; want nil", err)
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("WaitRoomChanges() still waiting after the changes were applied")
+	}
+}
+
+// TestHubConcurrency registers, joins, broadcasts to and unregisters clients from
+// many goroutines at once, and is meant to run with -race. Clients are unregistered
+// while frames are broadcast to their rooms: the hub must never send to a closed
+// queue, which would panic, nor deliver a frame of a room the client is not in.
+func TestHubConcurrency(t *testing.T) {
+	hub := NewHub()
+	go hub.Run()
+	handler := &SocketHandler{config: testConfig("hub-test")}
+
+	const (
+		workers          = 8
+		clientsPerWorker = 50
+		broadcasters     = 4
+		rooms            = 4
+	)
+
+	stop := make(chan struct{})
+	var broadcasting sync.WaitGroup
+	for b := 0; b < broadcasters; b++ {
+		broadcasting.Add(1)
+		go func() {
+			defer broadcasting.Done()
+
+			for i := b; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				roomID := fmt.Sprintf("room%d", i%rooms)
+				hub.Broadcast(roomID, []byte(roomID))
+			}
+		}()
+	}
+
+	var delivered atomic.Int64
+	errs := make(chan error, workers*clientsPerWorker)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := 0; i < clientsPerWorker; i++ {
+				client := &Client{
+					ID:      fmt.Sprintf("client%d-%d", w, i),
+					UserID:  primitive.NewObjectID(),
+					Send:    make(chan []byte, 4),
+					Rooms:   make(map[string]bool),
+					syncing: make(map[string][][]byte),
+					Handler: handler,
+				}
+				home := fmt.Sprintf("room%d", (w+i)%rooms)
+				joined := fmt.Sprintf("room%d", (w+i+1)%rooms)
+
+				// Drains the queue until the hub closes it
+				drained := make(chan error, 1)
+				go func() {
+					var err error
+					for frame := range client.Send {
+						delivered.Add(1)
+						if err == nil && string(frame) != home && string(frame) != joined {
+							err = fmt.Errorf("%s received a frame of %s; want %s or %s only", client.ID, frame, home, joined)
+						}
+					}
+					drained <- err
+				}()
+
+				hub.Register(client, []string{home})
+				hub.Join(client.UserID.Hex(), joined)
+				hub.Unregister(client)
+
+				select {
+				case err := <-drained:
+					if err != nil {
+						errs <- err
+					}
+				case <-time.After(testTimeout):
+					errs <- fmt.Errorf("queue of %s still open after Unregister()", client.ID)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(stop)
+	broadcasting.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+	if delivered.Load() == 0 {
+		t.Error("no frame delivered while the clients were registered")
+	}
+
+	// Returns once the hub processed the last unregistration
+	hub.IsInRoom(&Client{Rooms: make(map[string]bool)}, "room0")
+
+	// Every client left, so every room ends up unsubscribed
+	for _, change := range hub.roomChanges.take() {
+		if change.subscribed {
+			t.Errorf("room %s still subscribed", change.roomID)
+		}
+	}
+	for _, change := range hub.presenceChanges.take() {
+		if change.connected {
+			t.Errorf("user %s still connected", change.userID.Hex())
+		}
+	}
+}
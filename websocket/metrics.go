@@ -0,0 +1,14 @@
+package websocket
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Frames that could not be queued for a slow client, by slow-consumer policy.
+// Exposed on /metrics next to the HTTP metrics of the server.
+var droppedFrames = promauto.NewCounterVec(prometheus.CounterOpts{
+	Subsystem: "chatServer",
+	Name:      "websocket_dropped_frames_total",
+	Help:      "Number of frames dropped because a websocket client's send queue was full.",
+}, []string{"policy"})
@@ -0,0 +1,99 @@
+package websocket
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+const (
+	// outboxPollInterval is how often pending outbox records are looked up when
+	// no message has been sent through this instance in the meantime
+	outboxPollInterval = time.Second
+
+	// outboxLease is how long a record is reserved for this instance while it is published
+	outboxLease = 30 * time.Second
+
+	// outboxMaxRetryDelay caps the delay between two attempts at publishing a record
+	outboxMaxRetryDelay = 5 * time.Minute
+)
+
+// notifyOutbox wakes up the outbox relay after a message has been persisted
+func (sh *SocketHandler) notifyOutbox() {
+	select {
+	case sh.outboxReady <- struct{}{}:
+	default: // The relay is already due to run
+	}
+}
+
+// relayOutbox publishes the pending outbox records and marks them as sent. Every
+// instance runs a relay, a record is claimed by one of them at a time.
+func (sh *SocketHandler) relayOutbox() {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sh.outboxReady:
+		case <-ticker.C:
+		}
+
+		for sh.relayNext() {
+		}
+	}
+}
+
+// relayNext publishes the next pending record. It reports whether the relay should
+// carry on, i.e. a record was published and more are likely to be pending.
+func (sh *SocketHandler) relayNext() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	outboxRepo := sh.store.Outbox
+
+	record, err := outboxRepo.ClaimPending(ctx, sh.config.InstanceID, outboxLease)
+	if err != nil {
+		log.Println(err)
+		return false
+	}
+	if record == nil {
+		return false
+	}
+
+	err = sh.broker.Publish(ctx, record.Topic, record.Body)
+	if err != nil {
+		log.Printf("failed to publish outbox record '%s' (attempt %d): %v", record.ID.Hex(), record.Attempts, err)
+
+		// A record that keeps failing is given up, so that it does not hold back the next ones
+		if record.Attempts >= sh.config.OutboxMaxAttempts {
+			log.Printf("giving up outbox record '%s' after %d attempts", record.ID.Hex(), record.Attempts)
+			err = outboxRepo.MarkFailed(context.Background(), record.ID)
+		} else {
+			err = outboxRepo.Release(context.Background(), record.ID, time.Now().Add(sh.outboxRetryDelay(record.Attempts)))
+		}
+		if err != nil {
+			log.Println(err)
+		}
+
+		return false // The next records are relayed on the next tick
+	}
+
+	err = outboxRepo.MarkSent(ctx, record.ID)
+	if err != nil {
+		// Published again once the lease expires
+		log.Println(err)
+		return false
+	}
+
+	return true
+}
+
+// outboxRetryDelay doubles the delay before the next attempt with every failed attempt
+func (sh *SocketHandler) outboxRetryDelay(attempts int) time.Duration {
+	delay := sh.config.OutboxRetryDelay
+	for i := 1; i < attempts && delay < outboxMaxRetryDelay; i++ {
+		delay *= 2
+	}
+
+	return min(delay, outboxMaxRetryDelay)
+}
@@ -0,0 +1,170 @@
+package websocket
+
+import (
+	"chat-server/broker"
+	"chat-server/repository"
+	"chat-server/repository/memory"
+	"chat-server/repository/storetest"
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type publication struct {
+	topic string
+	body  string
+	at    time.Time
+	err   error
+}
+
+// failingBroker fails the given number of publishes of room messages, and every
+// publish of the poisoned body, and reports every attempt
+type failingBroker struct {
+	broker.Broker
+	failures atomic.Int32
+	poisoned string
+	attempts chan publication
+}
+
+func newFailingBroker(failures int) *failingBroker {
+	b := &failingBroker{Broker: broker.NewMemory(), attempts: make(chan publication, 16)}
+	b.failures.Store(int32(failures))
+
+	return b
+}
+
+func (b *failingBroker) Publish(ctx context.Context, topic string, body []byte) error {
+	if topic == broker.PresenceTopic || topic == broker.RoomJoinTopic {
+		return b.Broker.Publish(ctx, topic, body)
+	}
+
+	attempt := publication{topic: topic, body: string(body), at: time.Now()}
+	if b.failures.Add(-1) >= 0 || attempt.body == b.poisoned {
+		attempt.err = errors.New("broker unavailable")
+	}
+	b.attempts <- attempt
+
+	return attempt.err
+}
+
+func (b *failingBroker) next(t *testing.T) publication {
+	t.Helper()
+
+	select {
+	case attempt := <-b.attempts:
+		return attempt
+	case <-time.After(testTimeout):
+		t.Fatal("nothing published")
+	}
+
+	return publication{}
+}
+
+func (b *failingBroker) expectNone(t *testing.T, wait time.Duration) {
+	t.Helper()
+
+	select {
+	case attempt := <-b.attempts:
+		t.Fatalf("unexpected publish of %s on %s", attempt.body, attempt.topic)
+	case <-time.After(wait):
+	}
+}
+
+func newOutboxMessage(t *testing.T, store *repository.Store) *repository.MessageModel {
+	t.Helper()
+
+	alice := storetest.CreateUser(t, store, "alice")
+	room := storetest.JoinGroup(t, store, alice, "general")
+
+	return storetest.SendMessage(t, store, alice, room, "hello", "")
+}
+
+// TestOutboxRetry fails to publish a message twice, the relay keeps the record
+// and publishes it on a later attempt, once
+func TestOutboxRetry(t *testing.T) {
+	store := memory.NewStore()
+	messageBroker := newFailingBroker(2)
+	handler := New(messageBroker, store, testConfig("relay-test"))
+
+	message := newOutboxMessage(t, store)
+	handler.notifyOutbox()
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		published := messageBroker.next(t)
+		if published.topic != storetest.Topic || published.body != message.ID.Hex() {
+			t.Fatalf("published %s on %s; want the message on %s", published.body, published.topic, storetest.Topic)
+		}
+		if (published.err == nil) != (attempt == 3) {
+			t.Fatalf("attempt %d failed: %v; want only the first two attempts to fail", attempt, published.err)
+		}
+	}
+
+	messageBroker.expectNone(t, outboxPollInterval+200*time.Millisecond)
+
+	record, err := store.Outbox.ClaimPending(context.Background(), "check", time.Minute)
+	if err != nil || record != nil {
+		t.Errorf("ClaimPending() after publishing = %+v, %v; want nothing pending", record, err)
+	}
+}
+
+// TestOutboxLease leaves a record claimed by an instance that stopped while
+// publishing it, the relay takes over once the lease of the instance expired
+func TestOutboxLease(t *testing.T) {
+	store := memory.NewStore()
+	message := newOutboxMessage(t, store)
+
+	const lease = 500 * time.Millisecond
+	record, err := store.Outbox.ClaimPending(context.Background(), "stopped", lease)
+	if err != nil || record == nil {
+		t.Fatalf("ClaimPending() = %+v, %v; want the message's record", record, err)
+	}
+	expiry := record.LockedUntil
+
+	messageBroker := newFailingBroker(0)
+	handler := New(messageBroker, store, testConfig("relay-test"))
+	handler.notifyOutbox()
+
+	published := messageBroker.next(t)
+	if published.body != message.ID.Hex() {
+		t.Fatalf("published %s; want the message", published.body)
+	}
+	if published.at.Before(expiry) {
+		t.Errorf("published at %s, within the lease of the other instance until %s", published.at, expiry)
+	}
+
+	messageBroker.expectNone(t, outboxPollInterval+200*time.Millisecond)
+}
+
+// TestOutboxGiveUp relays a message that always fails to be published followed
+// by another one, the other message is published while the first one waits for
+// its retry, and the first one is given up after the last attempt
+func TestOutboxGiveUp(t *testing.T) {
+	store := memory.NewStore()
+	alice := storetest.CreateUser(t, store, "alice")
+	room := storetest.JoinGroup(t, store, alice, "general")
+	poison := storetest.SendMessage(t, store, alice, room, "poison", "")
+	next := storetest.SendMessage(t, store, alice, room, "next", "")
+
+	messageBroker := newFailingBroker(0)
+	messageBroker.poisoned = poison.ID.Hex()
+	config := testConfig("relay-test")
+	config.OutboxMaxAttempts = 2
+	config.OutboxRetryDelay = outboxPollInterval * 3 / 2
+	New(messageBroker, store, config).notifyOutbox()
+
+	for i, want := range []string{poison.ID.Hex(), next.ID.Hex(), poison.ID.Hex()} {
+		published := messageBroker.next(t)
+		if published.body != want || (published.err == nil) != (want == next.ID.Hex()) {
+			t.Fatalf("publish %d of %s failed: %v; want %s, only failing for the poison", i+1, published.body, published.err, want)
+		}
+	}
+
+	messageBroker.expectNone(t, outboxPollInterval+200*time.Millisecond)
+
+	record, err := store.Outbox.ClaimPending(context.Background(), "check", time.Minute)
+	if err != nil || record != nil {
+		t.Errorf("ClaimPending() after giving up = %+v, %v; want nothing pending", record, err)
+	}
+}
@@ -0,0 +1,219 @@
+package websocket
+
+import (
+	"chat-server/broker"
+	"chat-server/dto"
+	"chat-server/repository"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// presenceUpdate is published over the broker so that every instance
+// can forward a presence change to the clients sharing a room with the user
+type presenceUpdate struct {
+	UserID string          `json:"userId"`
+	Rooms  []string        `json:"rooms"`
+	Frame  json.RawMessage `json:"frame"`
+}
+
+// trackPresence records the users going online or offline on this instance
+// and announces the changes to the other instances
+func (sh *SocketHandler) trackPresence() {
+	// Changes made meanwhile are coalesced, a user who went offline and
+	// back online again is only connected again
+	for {
+		for _, change := range sh.hub.presenceChanges.take() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+
+			presenceRepo := sh.store.Presence
+			var presence *repository.PresenceModel
+			var err error
+			if change.connected {
+				presence, err = presenceRepo.ConnectInstance(ctx, change.userID, sh.config.InstanceID)
+			} else {
+				presence, err = presenceRepo.DisconnectInstance(ctx, change.userID, sh.config.InstanceID)
+			}
+			cancel()
+
+			if err != nil {
+				log.Printf("failed to update presence of user '%s': %v", change.userID.Hex(), err)
+				continue
+			}
+
+			if presence != nil {
+				err = sh.publishPresence(presence)
+				if err != nil {
+					log.Println(err)
+				}
+			}
+		}
+	}
+}
+
+// releaseInstance takes the users of this instance offline, e.g. the users
+// of a previous run of this instance
+func (sh *SocketHandler) releaseInstance(ctx context.Context) error {
+	return sh.release(ctx, sh.config.InstanceID)
+}
+
+// release takes the users of the instance offline and announces it
+func (sh *SocketHandler) release(ctx context.Context, instanceID string) error {
+	released, err := sh.store.Presence.ReleaseInstance(ctx, instanceID)
+	if err != nil {
+		return err
+	}
+
+	for _, presence := range released {
+		err = sh.publishPresence(presence)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	return nil
+}
+
+// heartbeat renews the lease of this instance
+func (sh *SocketHandler) heartbeat() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err := sh.store.Presence.Heartbeat(ctx, sh.config.InstanceID, sh.config.InstanceTTL)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// keepInstanceAlive renews the lease of this instance until it shuts down, and
+// takes offline the users of the instances that stopped renewing theirs
+func (sh *SocketHandler) keepInstanceAlive() {
+	ticker := time.NewTicker(sh.config.InstanceTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-sh.stopped:
+			return
+		case <-ticker.C:
+		}
+
+		sh.heartbeat()
+		sh.sweepInstances()
+	}
+}
+
+// sweepInstances releases the instances whose lease expired
+func (sh *SocketHandler) sweepInstances() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	expired, err := sh.store.Presence.ExpiredInstances(ctx)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for _, instanceID := range expired {
+		// This instance is alive, even when it failed to renew its lease
+		if instanceID == sh.config.InstanceID {
+			continue
+		}
+
+		err = sh.release(ctx, instanceID)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// Shutdown stops renewing the lease of this instance and takes its users
+// offline, before the broker and the storage are closed
+func (sh *SocketHandler) Shutdown(ctx context.Context) error {
+	close(sh.stopped)
+
+	return sh.releaseInstance(ctx)
+}
+
+// publishPresence announces a presence change to the rooms of the user
+func (sh *SocketHandler) publishPresence(presence *repository.PresenceModel) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rooms, err := sh.store.Rooms.FindParticipantRooms(ctx, presence.ID)
+	if err != nil {
+		return fmt.Errorf("failed to load rooms of user '%s': %w", presence.ID.Hex(), err)
+	}
+
+	if len(rooms) == 0 {
+		return nil
+	}
+
+	frame, err := encodeEvent(EventPresenceChanged, "", dto.ToPresenceDto(presence))
+	if err != nil {
+		return fmt.Errorf("failed to marshal presence to json: %w", err)
+	}
+
+	update := presenceUpdate{
+		UserID: presence.ID.Hex(),
+		Rooms:  make([]string, len(rooms)),
+		Frame:  frame,
+	}
+	for i, room := range rooms {
+		update.Rooms[i] = room.ID.Hex()
+	}
+
+	body, err := json.Marshal(update)
+	if err != nil {
+		return fmt.Errorf("failed to marshal presence update to json: %w", err)
+	}
+
+	return sh.broker.Publish(ctx, broker.PresenceTopic, body)
+}
+
+// broadcastPresence forwards a presence change received from the broker
+func (sh *SocketHandler) broadcastPresence(body []byte) error {
+	var update presenceUpdate
+	err := json.Unmarshal(body, &update)
+	if err != nil {
+		return fmt.Errorf("could not parse presence update: %w", err)
+	}
+
+	sh.hub.BroadcastRooms(update.Rooms, update.UserID, update.Frame)
+
+	return nil
+}
+
+func handlePresenceSet(c *Client, event Event) error {
+	var presenceData dto.PresenceDto
+	err := json.Unmarshal(event.Payload, &presenceData)
+	if err != nil {
+		return newProtocolError(ErrCodeInvalidPayload, "invalid presence payload: "+err.Error())
+	}
+
+	if presenceData.Status != repository.PresenceOnline && presenceData.Status != repository.PresenceAway {
+		return newProtocolError(ErrCodeInvalidPayload, "invalid status received: status must be either 'online' or 'away'")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	presence, err := c.Handler.store.Presence.SetStatus(ctx, c.UserID, presenceData.Status)
+	if err != nil {
+		return err
+	}
+	if presence == nil {
+		return newProtocolError(ErrCodeInternal, "presence of the user is not tracked yet, try again")
+	}
+
+	err = c.Handler.publishPresence(presence)
+	if err != nil {
+		return err
+	}
+
+	c.sendEvent(EventAck, event.ID, dto.ToPresenceDto(presence))
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package websocket
+
+import (
+	"chat-server/dto"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+func handleTypingStart(c *Client, event Event) error {
+	roomID, err := typingRoom(c, event)
+	if err != nil {
+		return err
+	}
+
+	c.typingMu.Lock()
+	timer, isTyping := c.typing[roomID]
+	if isTyping {
+		// Still typing, only extend the indicator
+		timer.Reset(c.Handler.config.TypingTimeout)
+		c.typingMu.Unlock()
+
+		return nil
+	}
+
+	// The indicator expires on its own when the client never sends typing.stop
+	c.typing[roomID] = time.AfterFunc(c.Handler.config.TypingTimeout, func() {
+		c.stopTyping(roomID)
+	})
+	c.typingMu.Unlock()
+
+	return c.publishTyping(EventTypingStart, roomID)
+}
+
+func handleTypingStop(c *Client, event Event) error {
+	roomID, err := typingRoom(c, event)
+	if err != nil {
+		return err
+	}
+
+	c.stopTyping(roomID)
+
+	return nil
+}
+
+func typingRoom(c *Client, event Event) (string, error) {
+	var typingData dto.TypingDto
+	err := json.Unmarshal(event.Payload, &typingData)
+	if err != nil {
+		return "", newProtocolError(ErrCodeInvalidPayload, "invalid typing payload: "+err.Error())
+	}
+
+	if !c.isInRoom(typingData.RoomID) {
+		return "", newProtocolError(ErrCodeForbidden, "not a participant of room "+typingData.RoomID)
+	}
+
+	return typingData.RoomID, nil
+}
+
+// stopTyping clears the typing indicator of a room, if the client is still typing there
+func (c *Client) stopTyping(roomID string) {
+	c.typingMu.Lock()
+	timer, isTyping := c.typing[roomID]
+	if isTyping {
+		timer.Stop()
+		delete(c.typing, roomID)
+	}
+	c.typingMu.Unlock()
+
+	if !isTyping {
+		return
+	}
+
+	err := c.publishTyping(EventTypingStop, roomID)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// stopAllTyping clears every typing indicator of the client, e.g. on disconnect
+func (c *Client) stopAllTyping() {
+	c.typingMu.Lock()
+	roomIDs := make([]string, 0, len(c.typing))
+	for roomID := range c.typing {
+		roomIDs = append(roomIDs, roomID)
+	}
+	c.typingMu.Unlock()
+
+	for _, roomID := range roomIDs {
+		c.stopTyping(roomID)
+	}
+}
+
+// publishTyping fans a typing event out to the other participants of the room
+// through the message broker, without persisting it
+func (c *Client) publishTyping(eventType, roomID string) error {
+	frame, err := encodeEvent(eventType, "", dto.Typing{
+		RoomID:   roomID,
+		UserID:   c.UserID.Hex(),
+		Username: c.Username,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal typing event to json: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return c.Broker.Publish(ctx, roomID, frame)
+}
@@ -2,16 +2,20 @@ package websocket
 
 import (
 	"chat-server/auth"
+	"chat-server/broker"
 	"chat-server/dto"
-	"chat-server/rabbitmq"
 	"chat-server/repository"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/labstack/echo/v4"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"log"
+	"net/http"
+	"sync"
+	"time"
 )
 
 var upgrader = websocket.Upgrader{
@@ -20,52 +24,141 @@ var upgrader = websocket.Upgrader{
 }
 
 type Client struct {
+	ID       string // Connection ID, unique for each device of a user
 	Conn     *websocket.Conn
 	Send     chan []byte // Channel for sending messages to the client
 	UserID   primitive.ObjectID
 	Username string
-	Rooms    map[string]bool
-	RabbitMQ *rabbitmq.RabbitMQ // RabbitMQ instance
-	Handler  *SocketHandler     // Reference to the SocketHandler
+	Rooms    map[string]bool // Rooms the client is subscribed to, owned by the hub
+	Broker   broker.Broker   // Message broker instance
+	Handler  *SocketHandler  // Reference to the SocketHandler
+
+	syncing   map[string][][]byte         // Live frames held back per room while missed messages are replayed, owned by the hub
+	replayed  map[string]replayedMessages // Messages recently replayed per room, skipped when they arrive live, owned by the hub
+	closeOnce sync.Once                   // Guards closing a slow client
+	upgraded  chan struct{}               // Closed once Conn is set, or when the upgrade failed
+
+	typing   map[string]*time.Timer // Expiry timers of the rooms the client is typing in
+	typingMu sync.Mutex             // Guards typing, the timers fire on their own goroutines
 }
 
 type SocketHandler struct {
-	clients  map[string]*Client // Client map (using user IDs as keys)
-	rabbitMQ *rabbitmq.RabbitMQ
+	hub      *Hub                    // Connected clients and their room subscriptions
+	handlers map[string]EventHandler // Client event handlers (using event types as keys)
+	config   Config                  // Connection keep-alive settings
+	broker   broker.Broker
+	store    *repository.Store
+
+	outboxReady chan struct{} // Wakes up the outbox relay
+	stopped     chan struct{} // Closed on shutdown
 }
 
-func New(rabbitMQ *rabbitmq.RabbitMQ) *SocketHandler {
-	return &SocketHandler{
-		clients:  make(map[string]*Client),
-		rabbitMQ: rabbitMQ,
+func New(messageBroker broker.Broker, store *repository.Store, config Config) *SocketHandler {
+	sh := &SocketHandler{
+		hub:      NewHub(),
+		handlers: make(map[string]EventHandler),
+		config:   config,
+		broker:   messageBroker,
+		store:    store,
+
+		outboxReady: make(chan struct{}, 1),
+		stopped:     make(chan struct{}),
 	}
-}
+	sh.registerDefaultHandlers()
 
-func (sh *SocketHandler) HandleConnection(c echo.Context) error {
-	conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	go sh.hub.Run()
+
+	// The lease is taken before any user connects, so that no other instance
+	// sweeps them meanwhile
+	sh.heartbeat()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	err := sh.releaseInstance(ctx)
+	cancel()
 	if err != nil {
-		return fmt.Errorf("error upgrading to webSocket: %w", err)
+		log.Println(err)
 	}
+	go sh.keepInstanceAlive()
+	go sh.trackPresence()
+	go sh.relayOutbox()
+
+	// Keep the subscriptions of connected clients in sync with room joins,
+	// the clients of the user on other instances join through the broker
+	store.Listeners.OnRoomJoin(func(roomID primitive.ObjectID, userID primitive.ObjectID) {
+		sh.hub.Join(userID.Hex(), roomID.Hex())
+
+		err := sh.publishRoomJoin(userID.Hex(), roomID.Hex())
+		if err != nil {
+			log.Println(err)
+		}
+	})
 
+	// Let the participants of a room know what has been read there,
+	// whether it was marked as read over websocket or the REST API
+	store.Listeners.OnRead(func(receipt *repository.ReadReceiptModel) {
+		err := sh.publishReadReceipt(receipt)
+		if err != nil {
+			log.Println(err)
+		}
+	})
+
+	return sh
+}
+
+func (sh *SocketHandler) HandleConnection(c echo.Context) error {
 	principal := auth.GetPrincipal(c)
 	userID, err := primitive.ObjectIDFromHex(principal.ID)
 	if err != nil {
-		badRequest := echo.ErrBadRequest
-		badRequest.Message = "invalid userID"
-
-		return badRequest
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid userID")
 	}
 
 	client := &Client{
-		Conn:     conn,
-		Send:     make(chan []byte),
+		ID:       primitive.NewObjectID().Hex(),
+		Send:     make(chan []byte, sh.config.SendBufferSize),
 		UserID:   userID,
 		Username: principal.Username,
 		Rooms:    make(map[string]bool),
-		RabbitMQ: sh.rabbitMQ, // Inject RabbitMQ instance
+		syncing:  make(map[string][][]byte),
+		replayed: make(map[string]replayedMessages),
+		typing:   make(map[string]*time.Timer),
+		upgraded: make(chan struct{}),
+		Broker:   sh.broker, // Inject message broker instance
 		Handler:  sh,
 	}
-	sh.clients[userID.Hex()] = client
+
+	// Load the rooms the user participates in, so that the client
+	// only receives messages sent to those rooms
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rooms, err := sh.store.Rooms.FindParticipantRooms(ctx, userID)
+	if err != nil {
+		log.Println("failed to load room membership: ", err)
+	}
+
+	roomIDs := make([]string, len(rooms))
+	for i, room := range rooms {
+		roomIDs[i] = room.ID.Hex()
+	}
+
+	// The client is registered and the instance subscribed to its rooms before
+	// the connection is upgraded, so that every message sent to the rooms once
+	// connected reaches the client, including the messages it sends itself
+	version := sh.hub.Register(client, roomIDs)
+	err = sh.hub.WaitRoomChanges(ctx, version)
+	if err != nil {
+		log.Println("failed to subscribe to the rooms before connecting: ", err)
+	}
+
+	conn, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		sh.hub.Unregister(client)
+		close(client.upgraded)
+
+		return fmt.Errorf("error upgrading to webSocket: %w", err)
+	}
+
+	client.Conn = conn
+	close(client.upgraded)
 
 	go client.readLoop()
 	go client.writeLoop()
@@ -75,12 +168,9 @@ func (sh *SocketHandler) HandleConnection(c echo.Context) error {
 
 func (c *Client) readLoop() {
 	defer func() {
-		// Clean up: Remove from a client map, Close connection, Leave Rooms...
-		delete(c.Handler.clients, c.UserID.Hex()) // Remove a client from the map
-
-		for roomID := range c.Rooms {
-			leaveRoom(roomID, c) // Leave each room the client is in
-		}
+		// Clean up: Stop typing, Remove from the hub, Leave Rooms, Close connection...
+		c.stopAllTyping()
+		c.Handler.hub.Unregister(c)
 
 		err := c.Conn.Close()
 		if err != nil {
@@ -88,15 +178,22 @@ func (c *Client) readLoop() {
 		}
 	}()
 
-	// Infinitely read messages from the clients
-	// and publish them to a message broker (RabbitMQ).
-	// This makes room for scalability as it prevents message loss
-	// even when there's network/server unavailability, and which,
-	// in turn, reduces the loads on the server
-	for {
-		var msg dto.MessageDto
+	// A client that sends neither frames nor pongs within the pong wait
+	// is considered dead, the read below then fails and the client is
+	// unregistered. Every pong extends the deadline.
+	pongWait := c.Handler.config.PongWait
+	_ = c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.Conn.SetPongHandler(func(string) error {
+		return c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
 
-		err := c.Conn.ReadJSON(&msg)
+	// Infinitely read events from the clients and dispatch them
+	// to their handlers. Chat messages are published to a message
+	// broker. This makes room for scalability as it prevents
+	// message loss even when there's network/server unavailability,
+	// and which, in turn, reduces the loads on the server
+	for {
+		_, frame, err := c.Conn.ReadMessage()
 		if err != nil {
 			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
 				fmt.Println("Client disconnected gracefully")
@@ -106,77 +203,259 @@ func (c *Client) readLoop() {
 			break
 		}
 
-		msgModel, err := dto.ToMessageModel(msg)
-		if err != nil {
-			log.Println("could not parse incoming message: ", err)
+		_ = c.Conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.dispatch(frame)
+	}
+}
+
+func (c *Client) writeLoop() {
+	ticker := time.NewTicker(c.Handler.config.PingInterval)
+	defer ticker.Stop()
+
+	// Read messages from the queue and send them to the client until
+	// the hub closes the queue on disconnect, pinging the client
+	// in between to detect half-open connections.
+	for {
+		select {
+		case message, ok := <-c.Send:
+			if !ok {
+				_ = c.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+
+			// Send messages to clients
+			err := c.write(websocket.TextMessage, message)
+			if err != nil {
+				fmt.Println("Error writing message to WebSocket:", err)
+
+				// Closing the connection stops the read loop,
+				// which unregisters the client from the hub
+				_ = c.Conn.Close()
+				return
+			}
+		case <-ticker.C:
+			err := c.write(websocket.PingMessage, nil)
+			if err != nil {
+				fmt.Println("Error pinging WebSocket client:", err)
+
+				_ = c.Conn.Close()
+				return
+			}
 		}
+	}
+}
 
-		// Persist message to DB
-		msgRepository := repository.NewMessage()
-		ctx := context.TODO()
+// write sends a single frame, giving up after the configured write wait
+func (c *Client) write(messageType int, data []byte) error {
+	err := c.Conn.SetWriteDeadline(time.Now().Add(c.Handler.config.WriteWait))
+	if err != nil {
+		return err
+	}
 
-		msgModel.SenderID = c.UserID
-		msgModel.Username = c.Username
+	return c.Conn.WriteMessage(messageType, data)
+}
 
-		newMsg, err := msgRepository.Create(ctx, msgModel)
-		if err != nil {
-			log.Println("failed to persist message to DB: ", err)
+// enqueue hands a frame over to the write loop without blocking the caller.
+// When the client's queue is full the slow-consumer policy decides what to drop.
+func (c *Client) enqueue(frame []byte) bool {
+	select {
+	case c.Send <- frame:
+		return true
+	default:
+	}
 
-			break
+	policy := c.Handler.config.SlowConsumerPolicy
+	dropped := droppedFrames.WithLabelValues(policy)
+
+	switch policy {
+	case DropOldest:
+		// Make room by discarding the oldest queued frame,
+		// unless the write loop drained the queue meanwhile
+		select {
+		case <-c.Send:
+			dropped.Inc()
+		default:
 		}
 
-		msgModelJson, err := json.Marshal(dto.ToMessageDto(*newMsg))
-		if err != nil {
-			log.Println("failed to marshal message to json")
-			break
+		select {
+		case c.Send <- frame:
+			return true
+		default:
+			// Other frames took the room meanwhile
+			dropped.Inc()
+		}
+	case Disconnect:
+		dropped.Inc()
+		go c.closeSlow()
+	default:
+		dropped.Inc()
+	}
+
+	return false
+}
+
+// enqueueWait queues a frame that must not be dropped, waiting for room
+// in the client's queue for at most the configured write wait
+func (c *Client) enqueueWait(frame []byte) bool {
+	timer := time.NewTimer(c.Handler.config.WriteWait)
+	defer timer.Stop()
+
+	select {
+	case c.Send <- frame:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// closeSlow disconnects a client that cannot keep up with its messages
+func (c *Client) closeSlow() {
+	<-c.upgraded
+
+	c.closeOnce.Do(func() {
+		if c.Conn == nil {
+			return // Never connected
 		}
 
-		err = c.RabbitMQ.Publish(ctx, rabbitmq.ExchangeName, msg.RoomID, msgModelJson)
+		log.Printf("disconnecting slow client '%s' of user '%s'", c.ID, c.UserID.Hex())
+
+		closeMessage := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "slow consumer")
+		deadline := time.Now().Add(c.Handler.config.WriteWait)
+		_ = c.Conn.WriteControl(websocket.CloseMessage, closeMessage, deadline)
+
+		// Closing the connection stops the read loop,
+		// which unregisters the client from the hub
+		_ = c.Conn.Close()
+	})
+}
+
+func (sh *SocketHandler) ConsumeMessages() {
+	messages, err := sh.broker.Consume()
+	if err != nil {
+		log.Printf("Error consuming messages from the broker: %v\n", err)
+	}
+
+	// Presence changes and room joins are received for every user, room
+	// messages only for the rooms the clients of this instance are in
+	for _, topic := range []string{broker.PresenceTopic, broker.RoomJoinTopic} {
+		err = sh.broker.Subscribe(topic)
 		if err != nil {
 			log.Println(err)
-			break
 		}
 	}
-}
+	go sh.subscribeRooms()
 
-func (c *Client) writeLoop() {
-	// Infinitely read messages from the queue,
-	// persist them to the DB and then send them to the clients.
-	for message := range c.Send {
-		// Send messages to clients
-		err := c.Conn.WriteMessage(websocket.TextMessage, message)
+	// A message is acknowledged once its fan-out has been attempted. A message
+	// that cannot be processed is delivered again, then dead-lettered.
+	for message := range messages {
+		err = sh.fanOut(message)
 		if err != nil {
-			fmt.Println("Error writing message to WebSocket:", err)
-			break
+			log.Printf("failed to process message of topic '%s': %v", message.Topic, err)
+			err = message.Nack()
+		} else {
+			err = message.Ack()
+		}
+
+		if err != nil {
+			log.Println("failed to settle message with the broker: ", err)
 		}
 	}
 }
 
-func (sh *SocketHandler) ConsumeMessages(exchange, queueName string) {
-	deliveries, err := sh.rabbitMQ.Consume(exchange, queueName)
-	if err != nil {
-		log.Printf("Error consuming messages from RabbitMQ: %v\n", err)
+// fanOut forwards a message received from the broker to the clients of this instance.
+// Messages are published with their room ID as the topic, so only the participants
+// of that room receive them. A user's own typing indicators are not sent back to them.
+func (sh *SocketHandler) fanOut(message broker.Message) error {
+	switch message.Topic {
+	case broker.PresenceTopic:
+		return sh.broadcastPresence(message.Body)
+	case broker.RoomJoinTopic:
+		return sh.applyRoomJoin(message.Body)
+	}
+
+	if !json.Valid(message.Body) {
+		return errors.New("message is not valid json")
 	}
 
-	for delivery := range deliveries {
-		for _, client := range sh.clients {
-			select {
-			case client.Send <- delivery.Body:
-			default:
-				fmt.Println("Client's message buffer is full. Skipping message.")
+	typingUser := typingUserID(message.Body)
+	if typingUser != "" {
+		sh.hub.BroadcastExcept(message.Topic, typingUser, message.Body)
+		return nil
+	}
+
+	sh.hub.Broadcast(message.Topic, message.Body)
+
+	return nil
+}
+
+// subscribeRooms subscribes this instance to the topic of a room
+// while any client of the instance is subscribed to the room
+func (sh *SocketHandler) subscribeRooms() {
+	for {
+		for _, change := range sh.hub.roomChanges.take() {
+			var err error
+			if change.subscribed {
+				err = sh.broker.Subscribe(change.roomID)
+			} else {
+				err = sh.broker.Unsubscribe(change.roomID)
+			}
+
+			if err != nil {
+				log.Println(err)
 			}
 		}
+
+		sh.hub.roomChanges.markApplied()
+	}
+}
+
+// roomJoin is published over the broker so that the clients of the user
+// on every instance join the room
+type roomJoin struct {
+	UserID string `json:"userId"`
+	RoomID string `json:"roomId"`
+}
+
+// publishRoomJoin announces that the user joined the room to every instance
+func (sh *SocketHandler) publishRoomJoin(userID string, roomID string) error {
+	body, err := json.Marshal(roomJoin{UserID: userID, RoomID: roomID})
+	if err != nil {
+		return fmt.Errorf("failed to marshal room join to json: %w", err)
 	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return sh.broker.Publish(ctx, broker.RoomJoinTopic, body)
 }
 
-func leaveRoom(roomID string, client *Client) {
-	// Check if the client is in the specified room
-	_, isInRoom := client.Rooms[roomID]
-	if !isInRoom {
-		// Client is not in the specified room, nothing to do
-		return
+// applyRoomJoin subscribes the clients of this instance to a room their user
+// joined, possibly through another instance
+func (sh *SocketHandler) applyRoomJoin(body []byte) error {
+	var join roomJoin
+	err := json.Unmarshal(body, &join)
+	if err != nil {
+		return fmt.Errorf("could not parse room join: %w", err)
 	}
 
-	// Remove the room from the client's rooms
-	delete(client.Rooms, roomID)
+	sh.hub.Join(join.UserID, join.RoomID)
+
+	return nil
+}
+
+// publishReadReceipt fans a read.updated event out to the participants of the room
+func (sh *SocketHandler) publishReadReceipt(receipt *repository.ReadReceiptModel) error {
+	frame, err := encodeEvent(EventReadUpdated, "", dto.ToReadReceiptDto(receipt))
+	if err != nil {
+		return fmt.Errorf("failed to marshal read receipt to json: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return sh.broker.Publish(ctx, receipt.RoomID.Hex(), frame)
+}
+
+func (c *Client) isInRoom(roomID string) bool {
+	return c.Handler.hub.IsInRoom(c, roomID)
 }
@@ -0,0 +1,244 @@
+package websocket
+
+import (
+	"chat-server/broker"
+	"chat-server/repository"
+	"chat-server/repository/memory"
+	"chat-server/repository/storetest"
+	"context"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestInstances runs two instances sharing a database and a broker, the users
+// of a room receive each other's messages and presence whichever instance they use
+func TestInstances(t *testing.T) {
+	db := memory.NewDB()
+	messageBroker := broker.NewMemory()
+
+	storeA := db.Store()
+	storeB := db.Connect().Store()
+	instanceA := newTestInstance(t, messageBroker, storeA, testConfig("a"))
+	instanceB := newTestInstance(t, messageBroker.Connect(), storeB, testConfig("b"))
+
+	alice := storetest.CreateUser(t, storeA, "alice")
+	bob := storetest.CreateUser(t, storeA, "bob")
+	carol := storetest.CreateUser(t, storeA, "carol")
+	room := storetest.JoinGroup(t, storeA, alice, "general")
+	storetest.JoinGroup(t, storeA, bob, "general")
+	storetest.JoinGroup(t, storeA, carol, "general")
+	roomID := room.ID.Hex()
+
+	aliceClient := instanceA.dial(t, alice)
+	bobClient := instanceB.dial(t, bob)
+	for _, instance := range []*testInstance{instanceA, instanceB} {
+		instance.expectSubscribed(t, roomID)
+	}
+
+	bobClient.sendMessage(t, roomID, "hello from b")
+	waitAll(t, []*testClient{aliceClient, bobClient}, func(client *testClient) error {
+		return client.expectMessage(roomID, "hello from b")
+	})
+
+	aliceClient.sendMessage(t, roomID, "hello from a")
+	waitAll(t, []*testClient{aliceClient, bobClient}, func(client *testClient) error {
+		return client.expectMessage(roomID, "hello from a")
+	})
+
+	// Each message is delivered once, although both instances relay the outbox
+	waitAll(t, []*testClient{aliceClient, bobClient}, func(client *testClient) error {
+		return client.expectNoMessage(200 * time.Millisecond)
+	})
+
+	// A user connected to both instances is online on both
+	instanceB.dial(t, alice)
+	eventually(t, func() bool {
+		presence, err := storeA.Presence.FindPresence(context.Background(), alice.ID)
+		return err == nil && slices.Equal(presence.Instances, []string{"a", "b"})
+	}, "alice connected to both instances")
+
+	// Alice hears from carol going online on the other instance
+	instanceB.dial(t, carol)
+	aliceClient.expectPresence(t, carol, repository.PresenceOnline)
+
+	// Dave joins the room through instance A while connected to instance B,
+	// his client on B joins the room too
+	dave := storetest.CreateUser(t, storeA, "dave")
+	daveClient := instanceB.dial(t, dave)
+	eventually(t, hasPresence(storeB, dave, repository.PresenceOnline), "dave online")
+	storetest.JoinGroup(t, storeA, dave, "general")
+
+	// The join is published before the message, so instance B applies it first
+	aliceClient.sendMessage(t, roomID, "welcome dave")
+	waitAll(t, []*testClient{aliceClient, daveClient}, func(client *testClient) error {
+		return client.expectMessage(roomID, "welcome dave")
+	})
+
+	daveClient.sendMessage(t, roomID, "hello from dave")
+	if err := aliceClient.expectMessage(roomID, "hello from dave"); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestInstanceExpiry leaves alice online on an instance that crashed without
+// releasing her, the other instance takes her offline once the lease of the
+// crashed instance expired, and releases its own users on shutdown
+func TestInstanceExpiry(t *testing.T) {
+	db := memory.NewDB()
+	messageBroker := broker.NewMemory()
+	ctx := context.Background()
+
+	config := testConfig("b")
+	config.InstanceTTL = 300 * time.Millisecond
+
+	crashed := db.Store()
+	alice := storetest.CreateUser(t, crashed, "alice")
+	bob := storetest.CreateUser(t, crashed, "bob")
+	storetest.JoinGroup(t, crashed, alice, "general")
+	storetest.JoinGroup(t, crashed, bob, "general")
+
+	err := crashed.Presence.Heartbeat(ctx, "crashed", config.InstanceTTL)
+	if err != nil {
+		t.Fatalf("Heartbeat() failed: %v", err)
+	}
+	_, err = crashed.Presence.ConnectInstance(ctx, alice.ID, "crashed")
+	if err != nil {
+		t.Fatalf("ConnectInstance() failed: %v", err)
+	}
+
+	store := db.Connect().Store()
+	instance := newTestInstance(t, messageBroker, store, config)
+	bobClient := instance.dial(t, bob)
+
+	bobClient.expectPresence(t, alice, repository.PresenceOffline)
+
+	presence, err := store.Presence.FindPresence(ctx, alice.ID)
+	if err != nil || presence.Status != repository.PresenceOffline || len(presence.Instances) != 0 {
+		t.Errorf("FindPresence() of alice = %+v, %v; want offline", presence, err)
+	}
+
+	// The instance keeps renewing its own lease
+	time.Sleep(2 * config.InstanceTTL)
+	presence, err = store.Presence.FindPresence(ctx, bob.ID)
+	if err != nil || presence.Status != repository.PresenceOnline {
+		t.Errorf("FindPresence() of bob = %+v, %v; want online", presence, err)
+	}
+
+	err = instance.handler.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("Shutdown() failed: %v", err)
+	}
+
+	presence, err = store.Presence.FindPresence(ctx, bob.ID)
+	if err != nil || presence.Status != repository.PresenceOffline {
+		t.Errorf("FindPresence() of bob after Shutdown() = %+v, %v; want offline", presence, err)
+	}
+}
+
+// newSlowClient returns a client whose queue is never drained, connected
+// to the returned peer connection
+func newSlowClient(t *testing.T, policy string, queueSize int) (*Client, *websocket.Conn) {
+	t.Helper()
+
+	config := testConfig("slow-test")
+	config.SlowConsumerPolicy = policy
+
+	conns := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Errorf("failed to upgrade: %v", err)
+			return
+		}
+		conns <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(func() { _ = peer.Close() })
+
+	conn := <-conns
+	t.Cleanup(func() { _ = conn.Close() })
+
+	client := &Client{
+		ID:       "slow",
+		Conn:     conn,
+		Send:     make(chan []byte, queueSize),
+		upgraded: make(chan struct{}),
+		Handler:  &SocketHandler{config: config},
+	}
+	close(client.upgraded)
+
+	return client, peer
+}
+
+// queued drains the queue of a client
+func queued(client *Client) []string {
+	var frames []string
+	for len(client.Send) > 0 {
+		frames = append(frames, string(<-client.Send))
+	}
+
+	return frames
+}
+
+// TestSlowConsumer fills the queue of a client that never reads, every
+// policy drops one frame and counts it once
+func TestSlowConsumer(t *testing.T) {
+	tests := []struct {
+		policy   string
+		accepted bool     // Whether the frame exceeding the queue is accepted
+		queue    []string // Frames left in the queue
+	}{
+		{policy: DropNewest, accepted: false, queue: []string{"1", "2"}},
+		{policy: DropOldest, accepted: true, queue: []string{"2", "3"}},
+		{policy: Disconnect, accepted: false, queue: []string{"1", "2"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			client, peer := newSlowClient(t, test.policy, 2)
+			dropped := droppedFrames.WithLabelValues(test.policy)
+			before := testutil.ToFloat64(dropped)
+
+			for _, frame := range []string{"1", "2"} {
+				if !client.enqueue([]byte(frame)) {
+					t.Fatalf("frame %s dropped from a queue with room left", frame)
+				}
+			}
+			if testutil.ToFloat64(dropped) != before {
+				t.Fatal("frames counted as dropped while the queue had room left")
+			}
+
+			if accepted := client.enqueue([]byte("3")); accepted != test.accepted {
+				t.Errorf("enqueue() on a full queue = %v; want %v", accepted, test.accepted)
+			}
+			if count := testutil.ToFloat64(dropped) - before; count != 1 {
+				t.Errorf("%v frames counted as dropped; want 1", count)
+			}
+			if frames := queued(client); !slices.Equal(frames, test.queue) {
+				t.Errorf("queued %v; want %v", frames, test.queue)
+			}
+
+			// Only the disconnect policy closes the connection
+			_ = peer.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+			_, _, err := peer.ReadMessage()
+
+			var closeErr *websocket.CloseError
+			disconnected := errors.As(err, &closeErr) && closeErr.Code == websocket.ClosePolicyViolation
+			if disconnected != (test.policy == Disconnect) {
+				t.Errorf("connection closed with %v", err)
+			}
+		})
+	}
+}